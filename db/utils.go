@@ -5,6 +5,9 @@
 package db
 
 import (
+	"context"
+	"time"
+
 	"gopkg.in/mgo.v2"
 
 	"github.com/njdup/func/settings"
@@ -38,3 +41,32 @@ func ExecWithCol(collection string, fn queryFunc) error {
 	col := session.DB(settings.Database.Name).C(collection)
 	return fn(col)
 }
+
+// Executes the given query function like ExecWithCol, but stops waiting
+// for it once the given context is done, returning ctx.Err()
+// The session's socket timeout is bounded by the context deadline so the
+// abandoned query doesn't hold its connection indefinitely
+func ExecWithColContext(ctx context.Context, collection string, fn queryFunc) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	session := getDbSession()
+	if deadline, ok := ctx.Deadline(); ok {
+		session.SetSocketTimeout(time.Until(deadline))
+	}
+	col := session.DB(settings.Database.Name).C(collection)
+
+	done := make(chan error, 1)
+	go func() {
+		defer session.Close()
+		done <- fn(col)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
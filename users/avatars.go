@@ -0,0 +1,36 @@
+// Fallback avatar colors for users without a profile picture, stable for
+// each user so their avatar doesn't change between pages or servers
+
+package users
+
+import (
+	"hash/fnv"
+)
+
+var (
+	// Colors fallback avatars are drawn in, dark enough for white initials
+	// to meet WCAG AA contrast
+	// Replacing the palette reassigns most users' colors.
+	AvatarPalette = []string{
+		"#B71C1C", "#880E4F", "#4A148C", "#311B92",
+		"#1A237E", "#0D47A1", "#01579B", "#006064",
+		"#004D40", "#1B5E20", "#33691E", "#BF360C",
+		"#3E2723", "#263238", "#AD1457", "#6A1B9A",
+	}
+)
+
+// Returns the user's fallback avatar color, picked from AvatarPalette by
+// the hash of their hex id
+// Returns an empty string if the palette is empty.
+func (user *User) AvatarColor() string {
+	if len(AvatarPalette) == 0 {
+		return ""
+	}
+	var hexID string
+	if user != nil {
+		hexID = user.Id.Hex()
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(hexID))
+	return AvatarPalette[hash.Sum32()%uint32(len(AvatarPalette))]
+}
@@ -0,0 +1,45 @@
+// Tests for fallback avatar colors
+
+package users
+
+import (
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestAvatarColor(t *testing.T) {
+	palette := make(map[string]bool)
+	for _, color := range AvatarPalette {
+		palette[color] = true
+	}
+
+	used := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		user := User{Id: bson.NewObjectId()}
+		color := user.AvatarColor()
+		if !palette[color] {
+			t.Fatal("Expected avatar color from the palette, got: ", color)
+		}
+		same := User{Id: bson.ObjectIdHex(user.Id.Hex())}
+		if same.AvatarColor() != color || user.AvatarColor() != color {
+			t.Fatal("Expected avatar color to be stable for user ", user.Id.Hex())
+		}
+		used[color] = true
+	}
+	if len(used) < 2 {
+		t.Error("Expected users to be spread across the palette")
+	}
+
+	// Colors only depend on the id, so they're the same in every process
+	known := User{Id: bson.ObjectIdHex("5a1f0c7e9d3b4a2c8e6f1d0b")}
+	if color := known.AvatarColor(); color != "#1B5E20" {
+		t.Error("Expected the known id's color to be fixed, got: ", color)
+	}
+
+	defer func(palette []string) { AvatarPalette = palette }(AvatarPalette)
+	AvatarPalette = nil
+	if color := known.AvatarColor(); color != "" {
+		t.Error("Expected no color without a palette, got: ", color)
+	}
+}
@@ -0,0 +1,62 @@
+// Compact binary encoding of users, for external caches such as Redis or
+// groupcache
+//
+// Users are encoded as bson behind a format version byte, so blobs written
+// by an older format are rejected rather than misread. Like stored users,
+// times only keep millisecond precision.
+
+package users
+
+import (
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Version of the binary encoding, bumped on any incompatible change
+const binaryFormatVersion byte = 1
+
+var (
+	// Keeps the password hash, history and fingerprint in the binary
+	// encoding of users, for caches authenticating from it
+	BinaryIncludesPassword = false
+)
+
+// Encodes the user into its binary form, see UnmarshalBinary
+// The password hash, history and fingerprint are left out unless
+// BinaryIncludesPassword is set.
+// Implements encoding.BinaryMarshaler
+func (user *User) MarshalBinary() ([]byte, error) {
+	if user == nil {
+		return nil, ErrNilUser
+	}
+	encoded := *user
+	if !BinaryIncludesPassword {
+		encoded.PasswordHash = ""
+		encoded.PasswordHistory = nil
+		encoded.PasswordFingerprint = ""
+	}
+	data, err := bson.Marshal(&encoded)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{binaryFormatVersion}, data...), nil
+}
+
+// Replaces the user with the one decoded from the given binary form, see
+// MarshalBinary
+// Returns ErrInvalidBinaryUser if the data wasn't written by MarshalBinary
+// of this format version.
+// Implements encoding.BinaryUnmarshaler
+func (user *User) UnmarshalBinary(data []byte) error {
+	if user == nil {
+		return ErrNilUser
+	}
+	if len(data) == 0 || data[0] != binaryFormatVersion {
+		return ErrInvalidBinaryUser
+	}
+	var decoded User
+	if err := bson.Unmarshal(data[1:], &decoded); err != nil {
+		return ErrInvalidBinaryUser
+	}
+	*user = decoded
+	return nil
+}
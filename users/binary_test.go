@@ -0,0 +1,75 @@
+// Tests for the binary encoding of users
+
+package users
+
+import (
+	"bytes"
+	"encoding"
+	"reflect"
+	"testing"
+)
+
+var (
+	_ encoding.BinaryMarshaler   = &User{}
+	_ encoding.BinaryUnmarshaler = &User{}
+)
+
+func TestBinaryRoundTrip(t *testing.T) {
+	var user User
+	populate(reflect.ValueOf(&user).Elem())
+	user.PasswordHash, user.PasswordHistory, user.PasswordFingerprint = "", nil, ""
+
+	data, err := user.MarshalBinary()
+	if err != nil {
+		t.Fatal("Error encountered encoding user: ", err)
+	}
+	var decoded User
+	if err := decoded.UnmarshalBinary(data); err != nil {
+		t.Fatal("Error encountered decoding user: ", err)
+	}
+	if !roundTripEqual(reflect.ValueOf(user), reflect.ValueOf(decoded)) {
+		t.Errorf("Expected user to survive the binary round trip, got: %+v", decoded)
+	}
+
+	// Decoding replaces every field of the receiver
+	stale := User{Firstname: "Stale", Roles: []string{"admin"}}
+	if err := stale.UnmarshalBinary(data); err != nil || !roundTripEqual(reflect.ValueOf(user), reflect.ValueOf(stale)) {
+		t.Error("Expected decoding to replace the receiver's fields, got: ", err)
+	}
+
+	for _, invalid := range [][]byte{nil, {}, append([]byte{binaryFormatVersion + 1}, data[1:]...), data[:len(data)/2]} {
+		if err := decoded.UnmarshalBinary(invalid); err != ErrInvalidBinaryUser {
+			t.Errorf("Expected ErrInvalidBinaryUser for %v, got: %v", invalid, err)
+		}
+	}
+}
+
+func TestBinaryOmitsPassword(t *testing.T) {
+	user := User{Username: "binaryUser", Phonenumber: "+15550320001"}
+	if err := user.SetPassword("correct horse battery"); err != nil {
+		t.Fatal("Error encountered setting password: ", err)
+	}
+	user.PasswordHistory = []string{"$2a$10$previoushash"}
+
+	data, err := user.MarshalBinary()
+	if err != nil {
+		t.Fatal("Error encountered encoding user: ", err)
+	}
+	if bytes.Contains(data, []byte(user.PasswordHash)) || bytes.Contains(data, []byte(user.PasswordHistory[0])) {
+		t.Error("Expected the password hash to be left out of the binary form")
+	}
+	var decoded User
+	if err := decoded.UnmarshalBinary(data); err != nil || decoded.PasswordHash != "" || decoded.Username != user.Username {
+		t.Error("Expected the decoded user to have no password hash, got: ", decoded.ToString(), err)
+	}
+	if user.PasswordHash == "" {
+		t.Error("Expected encoding to leave the user's password hash in place")
+	}
+
+	defer func(include bool) { BinaryIncludesPassword = include }(BinaryIncludesPassword)
+	BinaryIncludesPassword = true
+	data, _ = user.MarshalBinary()
+	if err := decoded.UnmarshalBinary(data); err != nil || !decoded.PasswordsMatch("correct horse battery") {
+		t.Error("Expected the password hash to be kept when configured, got: ", err)
+	}
+}
@@ -0,0 +1,67 @@
+// Birthdates of users, and the age gating of signups for age-restricted
+// products
+//
+// Birthdates are calendar dates: only the year, month and day they hold in
+// UTC count, so they mean the same date wherever they are read.
+
+package users
+
+import (
+	"time"
+)
+
+var (
+	// Youngest age, in years, at which users may sign up, disabled when zero
+	// Users must give their birthdate to sign up when set.
+	MinimumSignupAge = 0
+	// Oldest plausible age, in years, birthdates further back are rejected
+	MaxPlausibleAge = 130
+)
+
+// Returns the user's age in whole years on the date of now, in now's
+// location, and whether it is known
+// The age isn't known if the user has no birthdate or their birthdate is
+// after now. Users born on February 29th turn a year older on March 1st in
+// common years.
+func (user *User) AgeYears(now time.Time) (int, bool) {
+	if user == nil || user.Birthdate == nil || user.Birthdate.IsZero() {
+		return 0, false
+	}
+	birthYear, birthMonth, birthDay := user.Birthdate.UTC().Date()
+	year, month, day := now.Date()
+	born := time.Date(birthYear, birthMonth, birthDay, 0, 0, 0, 0, time.UTC)
+	if born.After(time.Date(year, month, day, 0, 0, 0, 0, time.UTC)) {
+		return 0, false
+	}
+
+	age := year - birthYear
+	if month < birthMonth || (month == birthMonth && day < birthDay) {
+		age--
+	}
+	return age, true
+}
+
+/*
+ * Helper Functions
+ */
+
+// Checks that the user's birthdate, if given, is a plausible past date, and
+// that they are at least MinimumSignupAge
+// Returns ErrInvalidBirthdate for implausible birthdates, or
+// ErrUnderageSignup if the user is too young or gave no birthdate while
+// MinimumSignupAge is set
+func checkBirthdate(user *User, now time.Time) error {
+	if user.Birthdate != nil {
+		age, known := user.AgeYears(now)
+		if !known || age > MaxPlausibleAge {
+			return ErrInvalidBirthdate
+		}
+	}
+	if MinimumSignupAge <= 0 {
+		return nil
+	}
+	if age, known := user.AgeYears(now); !known || age < MinimumSignupAge {
+		return ErrUnderageSignup
+	}
+	return nil
+}
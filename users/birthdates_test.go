@@ -0,0 +1,77 @@
+// Tests for birthdates and the age gating of signups
+
+package users
+
+import (
+	"testing"
+	"time"
+)
+
+// Returns a pointer to midnight UTC on the given date
+func birthdate(year int, month time.Month, day int) *time.Time {
+	date := time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+	return &date
+}
+
+func TestAgeYears(t *testing.T) {
+	user := User{Birthdate: birthdate(2000, time.June, 15)}
+	cases := map[time.Time]int{
+		time.Date(2018, time.June, 14, 23, 59, 0, 0, time.UTC): 17,
+		time.Date(2018, time.June, 15, 0, 0, 0, 0, time.UTC):   18,
+		time.Date(2018, time.June, 16, 0, 0, 0, 0, time.UTC):   18,
+		time.Date(2000, time.June, 15, 12, 0, 0, 0, time.UTC):  0,
+	}
+	for now, expected := range cases {
+		if age, known := user.AgeYears(now); !known || age != expected {
+			t.Errorf("Expected age %d on %v, got %d (known %v)", expected, now, age, known)
+		}
+	}
+
+	// The date of now counts in now's own location
+	tokyo := time.FixedZone("JST", 9*60*60)
+	if age, _ := user.AgeYears(time.Date(2018, time.June, 15, 1, 0, 0, 0, tokyo)); age != 18 {
+		t.Error("Expected the birthday to count in now's location, got age: ", age)
+	}
+
+	leapling := User{Birthdate: birthdate(2004, time.February, 29)}
+	if age, _ := leapling.AgeYears(time.Date(2022, time.February, 28, 0, 0, 0, 0, time.UTC)); age != 17 {
+		t.Error("Expected leapling to be 17 on February 28th, got: ", age)
+	}
+	if age, _ := leapling.AgeYears(time.Date(2022, time.March, 1, 0, 0, 0, 0, time.UTC)); age != 18 {
+		t.Error("Expected leapling to be 18 on March 1st, got: ", age)
+	}
+
+	unknown := []User{{}, {Birthdate: &time.Time{}}, {Birthdate: birthdate(2030, time.January, 1)}}
+	for _, user := range unknown {
+		if _, known := user.AgeYears(time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)); known {
+			t.Error("Expected age to be unknown for birthdate ", user.Birthdate)
+		}
+	}
+}
+
+func TestUnderageSignup(t *testing.T) {
+	defer func(age int) { MinimumSignupAge = age }(MinimumSignupAge)
+	MinimumSignupAge = 18
+
+	now := time.Now()
+	young := User{Username: "tooYoung", Phonenumber: "+15550260001", Birthdate: birthdate(now.Year()-17, now.Month(), now.Day())}
+	undated := User{Username: "noBirthdate", Phonenumber: "+15550260002"}
+	for _, user := range []*User{&young, &undated} {
+		if err := user.Save(); err != ErrUnderageSignup {
+			removeUser(*user)
+			t.Errorf("Expected %s to be rejected as underage, got: %v", user.Username, err)
+		}
+	}
+
+	future := User{Username: "notBornYet", Phonenumber: "+15550260003", Birthdate: birthdate(now.Year()+1, time.January, 1)}
+	if err := future.Save(); err != ErrInvalidBirthdate {
+		removeUser(future)
+		t.Error("Expected a future birthdate to be rejected, got: ", err)
+	}
+
+	adult := User{Username: "oldEnough", Phonenumber: "+15550260004", Birthdate: birthdate(now.Year()-18, now.Month(), now.Day())}
+	if err := adult.Save(); err != nil {
+		t.Fatal("Expected user turning 18 today to sign up, got: ", err)
+	}
+	removeUser(adult)
+}
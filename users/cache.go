@@ -0,0 +1,130 @@
+// Optional in-memory cache of users looked up by id, for high traffic pages
+// re-fetching the same users
+//
+// The cache is a least recently used cache holding copies of users, so
+// callers can't mutate the cached state. Entries are invalidated by every
+// write made through this package: writes to a single user drop its entry,
+// while bulk writes clear the whole cache. Writes made to the collection by
+// other processes are only picked up once entries expire.
+
+package users
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// A least recently used cache of users keyed by id, safe for concurrent use
+type userCache struct {
+	mu         sync.Mutex
+	size       int           // Largest number of cached users, caching is disabled when zero
+	ttl        time.Duration // How long users stay cached, forever when zero
+	entries    map[bson.ObjectId]*list.Element
+	order      *list.List // Most recently used entries first
+	generation int        // Bumped by each invalidation, see get and put
+}
+
+// A user held by the cache
+type cacheEntry struct {
+	user    *User
+	expires time.Time
+}
+
+var cachedUsers = &userCache{}
+
+// Enables caching of up to size users found by FindByID, each for at most
+// ttl, replacing any previously cached users
+// A ttl of zero or less keeps users cached until they are invalidated or
+// evicted, and a size of zero or less disables the cache.
+func WithCache(size int, ttl time.Duration) {
+	cachedUsers.mu.Lock()
+	defer cachedUsers.mu.Unlock()
+	if size < 0 {
+		size = 0
+	}
+	cachedUsers.size, cachedUsers.ttl = size, ttl
+	cachedUsers.clearLocked()
+}
+
+/*
+ * Helper Functions
+ */
+
+// Returns a copy of the cached user with the given id, if any, and the
+// generation to pass to put when caching a freshly loaded user instead
+func (cache *userCache) get(id bson.ObjectId) (*User, int) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	element, ok := cache.entries[id]
+	if !ok {
+		return nil, cache.generation
+	}
+
+	entry := element.Value.(*cacheEntry)
+	if !entry.expires.IsZero() && time.Now().After(entry.expires) {
+		cache.removeLocked(id, element)
+		return nil, cache.generation
+	}
+	cache.order.MoveToFront(element)
+	return entry.user.Clone(), cache.generation
+}
+
+// Caches a copy of the user, loaded when get returned the given generation
+// Users are dropped if an invalidation happened since, as they may predate
+// the write that caused it
+func (cache *userCache) put(user *User, generation int) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if cache.size == 0 || generation != cache.generation {
+		return
+	}
+
+	entry := &cacheEntry{user: user.Clone()}
+	if cache.ttl > 0 {
+		entry.expires = time.Now().Add(cache.ttl)
+	}
+	if element, ok := cache.entries[user.Id]; ok {
+		element.Value = entry
+		cache.order.MoveToFront(element)
+		return
+	}
+
+	cache.entries[user.Id] = cache.order.PushFront(entry)
+	for cache.order.Len() > cache.size {
+		oldest := cache.order.Back()
+		cache.removeLocked(oldest.Value.(*cacheEntry).user.Id, oldest)
+	}
+}
+
+// Drops the cached user with the given id, after a write to it
+func (cache *userCache) invalidate(id bson.ObjectId) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	cache.generation++
+	if element, ok := cache.entries[id]; ok {
+		cache.removeLocked(id, element)
+	}
+}
+
+// Drops every cached user, after a write to many users
+func (cache *userCache) clear() {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	cache.clearLocked()
+}
+
+// Drops every cached user, with the mutex held
+func (cache *userCache) clearLocked() {
+	cache.generation++
+	cache.entries = make(map[bson.ObjectId]*list.Element)
+	cache.order = list.New()
+}
+
+// Drops the given entry, with the mutex held
+func (cache *userCache) removeLocked(id bson.ObjectId, element *list.Element) {
+	cache.order.Remove(element)
+	delete(cache.entries, id)
+}
@@ -0,0 +1,92 @@
+// Tests for the cache of users looked up by id
+
+package users
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/njdup/func/db"
+)
+
+func TestCacheEviction(t *testing.T) {
+	defer WithCache(0, 0)
+	WithCache(2, time.Hour)
+
+	first, second, third := &User{Id: bson.NewObjectId()}, &User{Id: bson.NewObjectId()}, &User{Id: bson.NewObjectId()}
+	for _, user := range []*User{first, second} {
+		_, generation := cachedUsers.get(user.Id)
+		cachedUsers.put(user, generation)
+	}
+	cachedUsers.get(first.Id) // Leaves second as the least recently used
+	_, generation := cachedUsers.get(third.Id)
+	cachedUsers.put(third, generation)
+
+	if cached, _ := cachedUsers.get(second.Id); cached != nil {
+		t.Error("Least recently used user wasn't evicted")
+	}
+	for _, user := range []*User{first, third} {
+		if cached, _ := cachedUsers.get(user.Id); cached == nil || cached == user {
+			t.Error("Expected a copy of the cached user, got: ", cached)
+		}
+	}
+
+	// Users loaded before an invalidation aren't cached
+	_, generation = cachedUsers.get(second.Id)
+	cachedUsers.invalidate(first.Id)
+	cachedUsers.put(second, generation)
+	if cached, _ := cachedUsers.get(second.Id); cached != nil {
+		t.Error("User loaded before an invalidation was cached")
+	}
+
+	WithCache(2, time.Nanosecond)
+	_, generation = cachedUsers.get(first.Id)
+	cachedUsers.put(first, generation)
+	time.Sleep(time.Millisecond)
+	if cached, _ := cachedUsers.get(first.Id); cached != nil {
+		t.Error("Expired user was still cached")
+	}
+}
+
+func TestCachedFindByID(t *testing.T) {
+	defer WithCache(0, 0)
+	WithCache(10, time.Hour)
+
+	user := User{Username: "cachedUser", Firstname: "Before", Phonenumber: "+15550080001"}
+	if err := user.Save(); err != nil {
+		t.Fatal("Failed to save user in the db: ", user.ToString())
+	}
+	defer removeUser(user)
+	if _, err := FindByID(user.Id.Hex()); err != nil {
+		t.Fatal("Error encountered finding user by id: ", err)
+	}
+
+	// Change the stored user behind the cache's back
+	err := db.ExecWithCol(CollectionName, func(col *mgo.Collection) error {
+		return col.UpdateId(user.Id, bson.M{"$set": bson.M{"firstName": "Behind"}})
+	})
+	if err != nil {
+		t.Fatal("Error encountered changing stored user: ", err)
+	}
+	if found, err := FindByID(user.Id.Hex()); err != nil || found.Firstname != "Before" {
+		t.Error("Cache hit still queried the store: ", found.Firstname, err)
+	}
+
+	user.Firstname = "After"
+	if err := user.Update(); err != nil {
+		t.Fatal("Error encountered updating user: ", err)
+	}
+	if found, err := FindByID(user.Id.Hex()); err != nil || found.Firstname != "After" {
+		t.Error("Update didn't invalidate the cached user: ", found.Firstname, err)
+	}
+
+	if err := user.Delete(); err != nil {
+		t.Fatal("Error encountered deleting user: ", err)
+	}
+	if _, err := FindByID(user.Id.Hex()); err == nil {
+		t.Error("Deleted user was still served from the cache")
+	}
+}
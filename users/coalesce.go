@@ -0,0 +1,58 @@
+// Coalescing of concurrent identical user lookups, so a burst of requests
+// for the same popular user is served by a single query
+//
+// Lookups are keyed by the finder and its argument. Callers arriving while
+// an identical lookup is in flight wait for its result instead of querying
+// themselves, and each receives its own copy of the found user.
+
+package users
+
+import (
+	"context"
+
+	"golang.org/x/sync/singleflight"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	lookups singleflight.Group // In flight finder queries, keyed by lookupKey
+
+	// Seam for tests, loading the user matching the query from the store
+	findUser = findMatchingUserContext
+)
+
+/*
+ * Helper Functions
+ */
+
+// Finds the user matching the given query, sharing the query with concurrent
+// callers passing the same key
+// The shared query runs detached from the context of the caller that started
+// it, so one caller giving up doesn't fail the others sharing it. Callers
+// whose own context is done stop waiting and return ctx.Err().
+func findCoalesced(ctx context.Context, key string, query bson.M) (User, error) {
+	find := findUser
+	results := lookups.DoChan(key, func() (interface{}, error) {
+		user, err := find(context.Background(), query)
+		return &user, err
+	})
+
+	select {
+	case <-ctx.Done():
+		return User{}, ctx.Err()
+	case result := <-results:
+		if result.Err != nil {
+			return User{}, result.Err
+		}
+		user := result.Val.(*User)
+		if result.Shared {
+			user = user.Clone() // Callers mustn't share slices and maps
+		}
+		return *user, nil
+	}
+}
+
+// Returns the key identical lookups through the named finder share
+func lookupKey(finder, value string) string {
+	return finder + "|" + value
+}
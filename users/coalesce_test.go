@@ -0,0 +1,121 @@
+// Tests for coalescing concurrent user lookups
+
+package users
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestCoalescedLookups(t *testing.T) {
+	realFind := findUser
+	defer func() { findUser = realFind }()
+
+	var queries int32
+	release := make(chan struct{})
+	id := bson.NewObjectId()
+	findUser = func(ctx context.Context, query bson.M) (User, error) {
+		atomic.AddInt32(&queries, 1)
+		<-release
+		return User{Id: id, Username: "popular", Roles: []string{"member"}}, nil
+	}
+
+	const callers = 50
+	var wg sync.WaitGroup
+	found := make([]User, callers)
+	errs := make([]error, callers)
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			found[i], errs[i] = FindByID(id.Hex())
+		}(i)
+	}
+	time.Sleep(50 * time.Millisecond) // Let every caller join the lookup
+	close(release)
+	wg.Wait()
+
+	if count := atomic.LoadInt32(&queries); count != 1 {
+		t.Error("Expected concurrent identical lookups to share one query, got: ", count)
+	}
+	for i := range found {
+		if errs[i] != nil || found[i].Username != "popular" {
+			t.Fatalf("Expected every caller to find the user, got %v (%v)", found[i], errs[i])
+		}
+	}
+	found[0].Roles[0] = "admin"
+	if found[1].Roles[0] != "member" {
+		t.Error("Expected callers sharing a lookup to receive separate copies")
+	}
+
+	// Lookups once the shared one finished query again
+	if _, err := FindByID(id.Hex()); err != nil {
+		t.Fatal("Expected later lookup to succeed, got: ", err)
+	}
+	if count := atomic.LoadInt32(&queries); count != 2 {
+		t.Error("Expected a later lookup to run its own query, got: ", count)
+	}
+}
+
+func TestCoalescedLookupContext(t *testing.T) {
+	realFind := findUser
+	defer func() { findUser = realFind }()
+
+	release := make(chan struct{})
+	defer close(release)
+	findUser = func(ctx context.Context, query bson.M) (User, error) {
+		<-release
+		return User{}, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := FindByUsernameContext(ctx, "slowLookup"); err != context.DeadlineExceeded {
+		t.Error("Expected waiting caller to give up with its context, got: ", err)
+	}
+}
+
+func TestCoalescedLookupOutlivesCaller(t *testing.T) {
+	realFind := findUser
+	defer func() { findUser = realFind }()
+
+	started, release := make(chan struct{}), make(chan struct{})
+	findUser = func(ctx context.Context, query bson.M) (User, error) {
+		close(started)
+		select {
+		case <-ctx.Done():
+			return User{}, ctx.Err()
+		case <-release:
+			return User{Username: "shared"}, nil
+		}
+	}
+
+	// The caller starting the lookup gives up while another joins it
+	first, cancel := context.WithCancel(context.Background())
+	firstDone := make(chan error, 1)
+	go func() {
+		_, err := FindByUsernameContext(first, "sharedLookup")
+		firstDone <- err
+	}()
+	<-started
+	secondDone := make(chan User, 1)
+	go func() {
+		found, _ := FindByUsernameContext(context.Background(), "sharedLookup")
+		secondDone <- found
+	}()
+	time.Sleep(10 * time.Millisecond) // Let the second caller join the lookup
+	cancel()
+	if err := <-firstDone; err != context.Canceled {
+		t.Error("Expected the cancelled caller to give up, got: ", err)
+	}
+
+	close(release)
+	if found := <-secondDone; found.Username != "shared" {
+		t.Error("Expected the remaining caller to receive the shared result, got: ", found)
+	}
+}
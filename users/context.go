@@ -0,0 +1,87 @@
+// Context aware variants of the user finders, allowing handlers to thread
+// their request context through to the database queries
+
+package users
+
+import (
+	"context"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/njdup/func/db"
+)
+
+// Finds the user of the default tenant that matches the given username,
+// sharing the query with concurrent identical lookups
+// Returns ctx.Err() if the context is done before the query completes
+func FindByUsernameContext(ctx context.Context, username string) (User, error) {
+	return findCoalesced(ctx, lookupKey("userName", username), tenantQuery("", bson.M{"userName": username}))
+}
+
+// Finds the user with the given hex encoded id, served from the cache when
+// enabled, see WithCache, and otherwise sharing the query with concurrent
+// identical lookups
+// Returns ErrInvalidId if the id is malformed, or ctx.Err() if the context
+// is done before the query completes
+func FindByIDContext(ctx context.Context, hexId string) (User, error) {
+	if !bson.IsObjectIdHex(hexId) {
+		return User{}, ErrInvalidId
+	}
+	id := bson.ObjectIdHex(hexId)
+	cached, generation := cachedUsers.get(id)
+	if cached != nil {
+		return *cached, nil
+	}
+
+	user, err := findCoalesced(ctx, lookupKey("id", id.Hex()), bson.M{"_id": id})
+	if err == nil {
+		cachedUsers.put(&user, generation)
+	}
+	return user, err
+}
+
+// Returns up to limit users ordered by id, skipping the first offset users
+// Returns ctx.Err() if the context is done before the query completes
+func ListUsersContext(ctx context.Context, offset, limit int) ([]*User, error) {
+	return listMatchingUsersContext(ctx, bson.M{}, offset, limit, "_id")
+}
+
+/*
+ * Helper Functions
+ */
+
+// Returns the page of users matching the given query, ordered by the given
+// sort fields
+// Soft deleted and erased users are never listed, see listAllMatchingUsersContext
+func listMatchingUsersContext(ctx context.Context, query bson.M, offset, limit int, sort ...string) ([]*User, error) {
+	return listAllMatchingUsersContext(ctx, liveQuery(query), offset, limit, sort...)
+}
+
+// Returns the page of users matching the given query, ordered by the given
+// sort fields, including soft deleted and erased users
+// The page is normalized with NormalizePagination, and each stored document
+// is decoded defensively, see decodeUser and normalizeOnLoad
+func listAllMatchingUsersContext(ctx context.Context, query bson.M, offset, limit int, sort ...string) ([]*User, error) {
+	offset, limit = NormalizePagination(offset, limit)
+	result := make([]*User, 0)
+	listQuery := func(col *mgo.Collection) error {
+		var raw bson.Raw
+		iter := col.Find(query).Sort(sort...).Skip(offset).Limit(limit).Iter()
+		for iter.Next(&raw) {
+			user := new(User)
+			if err := decodeUser(raw, user); err != nil {
+				iter.Close()
+				return err
+			}
+			user.normalizeOnLoad()
+			result = append(result, user)
+		}
+		return iter.Close()
+	}
+
+	if err := db.ExecWithColContext(ctx, CollectionName, listQuery); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
@@ -0,0 +1,57 @@
+// Tests for the context aware user finders
+
+package users
+
+import (
+	"context"
+	"testing"
+)
+
+func TestCancelledContextFinders(t *testing.T) {
+	user := validUsers[0]
+	if err := user.Save(); err != nil {
+		t.Fatal("Failed to save user in the db: ", user.ToString())
+	}
+	defer removeUser(user)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := FindByUsernameContext(ctx, user.Username); err != ctx.Err() {
+		t.Error("Expected cancelled username lookup to return ctx.Err(), got: ", err)
+	}
+	if _, err := FindByIDContext(ctx, user.Id.Hex()); err != ctx.Err() {
+		t.Error("Expected cancelled id lookup to return ctx.Err(), got: ", err)
+	}
+	if _, err := ListUsersContext(ctx, 0, 10); err != ctx.Err() {
+		t.Error("Expected cancelled listing to return ctx.Err(), got: ", err)
+	}
+
+	// A live context behaves like the non-context finders
+	found, err := FindByIDContext(context.Background(), user.Id.Hex())
+	if err != nil || found.Username != user.Username {
+		t.Error("Error encountered finding user by id: ", err)
+	}
+}
+
+func TestListUsers(t *testing.T) {
+	for _, user := range validUsers {
+		if err := user.Save(); err != nil {
+			t.Fatal("Failed to save user in the db: ", user.ToString())
+		}
+		defer removeUser(user)
+	}
+
+	listed, err := ListUsers(0, 0)
+	if err != nil {
+		t.Fatal("Error encountered listing users: ", err)
+	}
+	if len(listed) < len(validUsers) {
+		t.Errorf("Listed %d users, expected at least %d", len(listed), len(validUsers))
+	}
+
+	page, err := ListUsers(1, 1)
+	if err != nil || len(page) != 1 || page[0].Id != listed[1].Id {
+		t.Error("Paging over users returned the wrong page: ", err)
+	}
+}
@@ -0,0 +1,70 @@
+// Fingerprints of the person behind a user, so deduplication analytics can
+// group records of the same person without handling their contact details
+//
+// A fingerprint is an HMAC of the user's normalized email address and
+// phonenumber under a caller-provided key, so it can't be reversed or
+// matched against fingerprints made under another key.
+
+package users
+
+import (
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/njdup/func/db"
+	"github.com/njdup/func/utils/security"
+)
+
+// Returns the fingerprint of the user's email address and phonenumber under
+// the given key
+// Both are normalized first, so differently typed contact details of the
+// same person produce the same fingerprint. Returns an empty string for
+// users with neither.
+func (user *User) Fingerprint(key []byte) string {
+	if user == nil || (user.Email == "" && user.Phonenumber == "") {
+		return ""
+	}
+	phonenumber, err := NormalizePhonenumber(user.Phonenumber)
+	if err != nil {
+		phonenumber = stripPhoneFormatting(user.Phonenumber)
+	}
+	return security.KeyedHash(key, "person|"+normalizedEmail(user.Email)+"|"+phonenumber)
+}
+
+// Returns the hex ids of live users sharing a fingerprint under the given
+// key, grouped by fingerprint, see Fingerprint
+// Only fingerprints shared by more than one user are returned, with their
+// ids in insertion order. Users with an email address, a phonenumber or
+// both are fingerprinted, except for users whose phonenumber is only stored
+// as a hash, see PhonePrivacy, which can't be fingerprinted and are left
+// out. Users with neither have no fingerprint.
+func FindDuplicateFingerprints(key []byte) (map[string][]string, error) {
+	groups := make(map[string][]string)
+	scanQuery := func(col *mgo.Collection) error {
+		var stored User
+		present := bson.M{"$nin": []interface{}{"", nil}}
+		query := liveQuery(bson.M{"$or": []bson.M{{"email": present}, {"phoneNumber": present}}})
+		fields := bson.M{"email": 1, "phoneNumber": 1, "phoneHash": 1}
+		iter := col.Find(query).Select(fields).Sort("_id").Iter()
+		for iter.Next(&stored) {
+			if stored.Phonenumber == "" && stored.PhoneHash != "" {
+				stored = User{}
+				continue // The plaintext number is needed for the fingerprint
+			}
+			fingerprint := stored.Fingerprint(key)
+			groups[fingerprint] = append(groups[fingerprint], stored.Id.Hex())
+			stored = User{}
+		}
+		return iter.Close()
+	}
+
+	if err := db.ExecWithCol(CollectionName, scanQuery); err != nil {
+		return nil, err
+	}
+	for fingerprint, ids := range groups {
+		if len(ids) < 2 {
+			delete(groups, fingerprint)
+		}
+	}
+	return groups, nil
+}
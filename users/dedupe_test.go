@@ -0,0 +1,100 @@
+// Tests for fingerprints of the person behind users
+
+package users
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/njdup/func/db"
+)
+
+func TestFingerprint(t *testing.T) {
+	key := []byte("dedupe test key")
+	person := User{Email: "Jane.Doe@Example.com", Phonenumber: "(555) 038-0001"}
+	samePerson := User{Username: "otherAccount", Email: " jane.doe@example.com", Phonenumber: "+15550380001"}
+	if person.Fingerprint(key) == "" || person.Fingerprint(key) != samePerson.Fingerprint(key) {
+		t.Error("Expected records of the same person to share a fingerprint")
+	}
+
+	distinct := []User{
+		{Email: "john.doe@example.com", Phonenumber: "+15550380001"},
+		{Email: "jane.doe@example.com", Phonenumber: "+15550380002"},
+		{Email: "jane.doe@example.com"},
+	}
+	for _, other := range distinct {
+		if other.Fingerprint(key) == person.Fingerprint(key) {
+			t.Errorf("Expected %s / %s not to share the fingerprint", other.Email, other.Phonenumber)
+		}
+	}
+
+	if person.Fingerprint([]byte("another key")) == person.Fingerprint(key) {
+		t.Error("Expected fingerprints to depend on the key")
+	}
+	if fingerprint := (&User{Username: "noContact"}).Fingerprint(key); fingerprint != "" {
+		t.Error("Expected no fingerprint without contact details, got: ", fingerprint)
+	}
+}
+
+func TestFindDuplicateFingerprints(t *testing.T) {
+	defer func(fields []string) { UniqueFields = fields }(UniqueFields)
+	UniqueFields = []string{"Username"}
+
+	key := []byte("dedupe test key")
+	first := User{Username: "dedupeFirst", Phonenumber: "+15550380003", Email: "sam@example.com"}
+	second := User{Username: "dedupeSecond", Phonenumber: "+15550380003", Email: "Sam@Example.com"}
+	distinct := User{Username: "dedupeDistinct", Phonenumber: "+15550380004", Email: "sam@example.com"}
+	for _, user := range []*User{&first, &second, &distinct} {
+		if err := user.Save(); err != nil {
+			t.Fatal("Failed to save user in the db: ", err)
+		}
+		defer removeUser(*user)
+	}
+
+	groups, err := FindDuplicateFingerprints(key)
+	if err != nil {
+		t.Fatal("Error encountered finding duplicate fingerprints: ", err)
+	}
+	group := groups[first.Fingerprint(key)]
+	if len(group) != 2 || group[0] != first.Id.Hex() || group[1] != second.Id.Hex() {
+		t.Error("Expected the same person's records to be grouped, got: ", group)
+	}
+	if _, ok := groups[distinct.Fingerprint(key)]; ok {
+		t.Error("Expected the distinct person not to be grouped")
+	}
+	for fingerprint, ids := range groups {
+		for _, id := range ids {
+			if id == distinct.Id.Hex() {
+				t.Error("Expected the distinct person in no group, found under ", fingerprint)
+			}
+		}
+	}
+
+	// Records without a phonenumber, such as imported ones, are grouped too
+	emailOnly := []bson.ObjectId{bson.NewObjectId(), bson.NewObjectId()}
+	emails := []string{"robin@example.com", " Robin@Example.com"} // Stored before emails were normalized
+	for i, id := range emailOnly {
+		id := id
+		insert := func(col *mgo.Collection) error {
+			username := fmt.Sprint("dedupeEmailOnly", i)
+			return col.Insert(bson.M{"_id": id, "userName": username, "usernameLower": strings.ToLower(username), "email": emails[i]})
+		}
+		if err := db.ExecWithCol(CollectionName, insert); err != nil {
+			t.Fatal("Failed to insert email-only document: ", err)
+		}
+		defer db.ExecWithCol(CollectionName, func(col *mgo.Collection) error {
+			return col.RemoveId(id)
+		})
+	}
+	if groups, err = FindDuplicateFingerprints(key); err != nil {
+		t.Fatal("Error encountered finding duplicate fingerprints: ", err)
+	}
+	emailUser := User{Email: "robin@example.com"}
+	if group := groups[emailUser.Fingerprint(key)]; len(group) != 2 || group[0] != emailOnly[0].Hex() {
+		t.Error("Expected the email-only records to be grouped, got: ", group)
+	}
+}
@@ -0,0 +1,280 @@
+// Soft deletion of users, and the indexes enforcing uniqueness of the
+// identifiers held by live users
+//
+// Soft deleted users are kept for referential integrity, and by default keep
+// their username and phonenumber from being claimed again. Deployments may
+// set ReuseDeletedIdentifiers to free them instead: rather than a partial
+// unique index (which mgo can't create, and which legacy documents missing
+// the filtered field would escape), SoftDelete then frees the identifiers by
+// appending a tombstone suffix to them, so the unique indexes created by
+// EnsureIndexes only ever see live values.
+
+package users
+
+import (
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/njdup/func/db"
+)
+
+// Separates a freed identifier from the id of the user it belonged to
+const tombstoneSeparator = "~deleted~"
+
+// A single run of EnsureIndexes shared by concurrent EnsureIndexesOnce calls
+type indexRun struct {
+	once sync.Once
+	err  error
+}
+
+var (
+	// Frees the identifiers of users as they are soft deleted, so new users
+	// can claim them, and leaves soft deleted users out of the uniqueness
+	// checks of Save and Update
+	// Users soft deleted while it was unset keep holding their identifiers
+	// in the unique indexes.
+	ReuseDeletedIdentifiers = false
+
+	indexesMu     sync.Mutex
+	indexes       = new(indexRun)
+	ensureIndexes = EnsureIndexes // Replaced in tests to count runs
+)
+
+// Runs EnsureIndexes the first time it is called, and returns immediately
+// once a run succeeded
+// Concurrent callers wait on and share the outcome of a single run. Failed
+// runs aren't memoized, so the next call tries again. Call EnsureIndexes
+// directly to force a re-run.
+func EnsureIndexesOnce() error {
+	indexesMu.Lock()
+	run := indexes
+	indexesMu.Unlock()
+
+	run.once.Do(func() {
+		if run.err = ensureIndexes(); run.err != nil {
+			indexesMu.Lock()
+			if indexes == run {
+				indexes = new(indexRun)
+			}
+			indexesMu.Unlock()
+		}
+	})
+	return run.err
+}
+
+// Creates the indexes the users collection relies on, including the unique
+// indexes backing the uniqueness checks in Save
+// Returns an error if existing documents violate an index
+func EnsureIndexes() error {
+	if err := checkWritable(); err != nil {
+		return err
+	}
+
+	indexes := []mgo.Index{
+		{Key: []string{"tenantId", "usernameLower"}, Unique: true}, // Usernames are unique per tenant
+		{Key: []string{"phoneNumber"}, Unique: true, Sparse: true}, // Absent with PhonePrivacy.OmitPlaintext
+		{Key: []string{"phoneHash"}, Unique: true, Sparse: true},
+		{Key: []string{"email"}, Unique: true, Sparse: true}, // Email addresses are optional
+		{Key: []string{"slug"}, Unique: true, Sparse: true},  // Backs the profile slugs generated by Save
+		// Each provider account is linked to at most one user, see LinkIdentity
+		{Key: []string{"externalIdentities.provider", "externalIdentities.subject"}, Unique: true, Sparse: true},
+		{Key: []string{"deletedAt"}},
+		{Key: []string{"updated", "_id"}},  // Backs ListUpdatedSince
+		{Key: []string{"inserted", "_id"}}, // Backs SignupRate and ListUsersSorted
+		{Key: []string{"usernameLower", "_id"}},
+		{Key: []string{"lastLogin", "_id"}},
+		{Key: []string{"lastName", "_id"}},
+		{Key: []string{"magicLinkHash"}, Sparse: true}, // Backs ConsumeMagicLink, set only while a token is pending
+	}
+
+	indexQuery := func(col *mgo.Collection) error {
+		if err := backfillUsernameLower(col); err != nil {
+			return err
+		}
+		if err := backfillActive(col); err != nil {
+			return err
+		}
+		if err := backfillSearchName(col); err != nil {
+			return err
+		}
+		for _, index := range indexes {
+			if err := col.EnsureIndex(index); err != nil {
+				return err
+			}
+		}
+		// Abandoned username reservations are removed shortly after expiring
+		reservations := mgo.Index{Key: []string{"expires"}, ExpireAfter: time.Second}
+		if err := col.Database.C(ReservationCollectionName).EnsureIndex(reservations); err != nil {
+			return err
+		}
+		if err := col.Database.C(ReservationCollectionName).EnsureIndexKey("tokenHash"); err != nil {
+			return err
+		}
+		// Lapsed phonenumber claims are removed shortly after expiring
+		claims := mgo.Index{Key: []string{"expires"}, ExpireAfter: time.Second}
+		if err := col.Database.C(PhoneClaimCollectionName).EnsureIndex(claims); err != nil {
+			return err
+		}
+		// Expired sessions are removed shortly after expiring
+		sessions := mgo.Index{Key: []string{"expires"}, ExpireAfter: time.Second}
+		if err := col.Database.C(SessionCollectionName).EnsureIndex(sessions); err != nil {
+			return err
+		}
+		if err := col.Database.C(SessionCollectionName).EnsureIndexKey("tokenHash"); err != nil {
+			return err
+		}
+		if err := col.Database.C(SessionCollectionName).EnsureIndexKey("userId", "created"); err != nil {
+			return err
+		}
+		if err := col.Database.C(ImpersonationCollectionName).EnsureIndexKey("tokenHash"); err != nil {
+			return err
+		}
+		return dropLegacyUsernameIndex(col)
+	}
+
+	return db.ExecWithCol(CollectionName, indexQuery)
+}
+
+// Marks the user as deleted without removing the stored document
+// The user no longer appears in finders or listings. When
+// ReuseDeletedIdentifiers is set, the user's identifiers are freed for reuse
+// by appending a tombstone suffix. Returns ErrLastAdmin if the user is the
+// last one holding AdminRole.
+func (user *User) SoftDelete() error {
+	if user == nil || user.Id == "" {
+		return ErrUserNotFound
+	}
+	if err := checkWritable(); err != nil {
+		return err
+	}
+
+	now := time.Now().Truncate(time.Millisecond) // As stored, so the undo can match it
+	deleteQuery := func(col *mgo.Collection) error {
+		// Tombstone the stored identifiers, which the receiver may hold stale copies of
+		stored, err := loadStoredUser(col, user.Id)
+		if err != nil {
+			return err
+		}
+		set := bson.M{"deletedAt": now}
+		revert := bson.M{} // The stored values of the tombstoned identifiers
+		if ReuseDeletedIdentifiers {
+			freed := map[string]string{
+				"userName":      stored.Username,
+				"usernameLower": stored.UsernameLower,
+				"phoneNumber":   stored.Phonenumber,
+				"phoneHash":     stored.PhoneHash,
+				"email":         stored.Email,
+				"slug":          stored.ProfileSlug,
+			}
+			for field, identifier := range freed {
+				if identifier != "" {
+					set[field] = tombstone(identifier, user.Id)
+					revert[field] = identifier
+				}
+			}
+		}
+
+		softDelete := func() error {
+			err := col.Update(liveQuery(bson.M{"_id": user.Id}), touched(bson.M{"$set": set}, now))
+			if err == mgo.ErrNotFound {
+				return ErrUserNotFound
+			}
+			return err
+		}
+		// Undoes only what the soft delete changed, keeping concurrent writes
+		restore := func() error {
+			update := bson.M{"$unset": bson.M{"deletedAt": ""}}
+			if len(revert) != 0 {
+				update["$set"] = revert
+			}
+			return col.Update(bson.M{"_id": user.Id, "deletedAt": now}, touched(update, time.Now()))
+		}
+		return guardLastAdmin(col, []bson.ObjectId{user.Id}, softDelete, restore)
+	}
+
+	if err := db.ExecWithCol(CollectionName, deleteQuery); err != nil {
+		return err
+	}
+	cachedUsers.invalidate(user.Id)
+	user.DeletedAt = now
+	user.Updated = now
+	user.Version++
+	return nil
+}
+
+// Permanently removes the user along with its audit trail and sessions
+// Prefer SoftDelete for users other records may still refer to.
+// Returns ErrUserNotFound if the user isn't stored, or ErrLastAdmin if the
+// user is the last one holding AdminRole.
+func (user *User) Delete() error {
+	if user == nil || user.Id == "" {
+		return ErrUserNotFound
+	}
+	if err := checkWritable(); err != nil {
+		return err
+	}
+
+	removeQuery := func(col *mgo.Collection) error {
+		var snapshot bson.M
+		if err := col.FindId(user.Id).One(&snapshot); err == mgo.ErrNotFound {
+			return ErrUserNotFound
+		} else if err != nil {
+			return err
+		}
+		remove := func() error {
+			err := col.RemoveId(user.Id)
+			if err == mgo.ErrNotFound {
+				return ErrUserNotFound
+			}
+			return err
+		}
+		restore := func() error {
+			return col.Insert(snapshot)
+		}
+		if err := guardLastAdmin(col, []bson.ObjectId{user.Id}, remove, restore); err != nil {
+			return err
+		}
+		if _, err := col.Database.C(AuditCollectionName).RemoveAll(bson.M{"userId": user.Id}); err != nil {
+			return err
+		}
+		_, err := col.Database.C(SessionCollectionName).RemoveAll(bson.M{"userId": user.Id})
+		return err
+	}
+
+	err := db.ExecWithCol(CollectionName, removeQuery)
+	if err != ErrUserNotFound {
+		cachedUsers.invalidate(user.Id) // The user may be gone even if removing its records failed
+	}
+	return err
+}
+
+// Checks whether the user has been soft deleted
+func (user *User) IsDeleted() bool {
+	return user != nil && !user.DeletedAt.IsZero()
+}
+
+/*
+ * Helper Functions
+ */
+
+// Returns a copy of the given query restricted to users that are neither
+// soft deleted nor erased
+// Conditions the query already places on those fields are kept
+func liveQuery(query bson.M) bson.M {
+	result := bson.M{
+		"deletedAt": nil, // Matches both null and missing
+		"erased":    bson.M{"$ne": true},
+	}
+	for key, value := range query {
+		result[key] = value
+	}
+	return result
+}
+
+// Returns the freed form of an identifier held by the deleted user
+func tombstone(identifier string, id bson.ObjectId) string {
+	return identifier + tombstoneSeparator + id.Hex()
+}
@@ -0,0 +1,122 @@
+// Tests for soft deletion of users
+
+package users
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// Ensures identifiers of a soft deleted user can be claimed again when
+// ReuseDeletedIdentifiers is set
+func TestSoftDeleteFreesIdentifiers(t *testing.T) {
+	if err := EnsureIndexes(); err != nil {
+		t.Fatal("Error encountered ensuring indexes: ", err)
+	}
+	defer func(reuse bool) { ReuseDeletedIdentifiers = reuse }(ReuseDeletedIdentifiers)
+	ReuseDeletedIdentifiers = true
+
+	original := User{Username: "alice", Phonenumber: "+15550010001"}
+	if err := original.Save(); err != nil {
+		t.Fatal("Failed to save user in the db: ", original.ToString())
+	}
+	defer removeUser(original)
+
+	if err := original.SoftDelete(); err != nil {
+		t.Fatal("Error encountered soft deleting user: ", err)
+	}
+	if !original.IsDeleted() {
+		t.Error("Soft deleted user isn't flagged as deleted")
+	}
+
+	if _, err := FindByID(original.Id.Hex()); err == nil {
+		t.Error("Soft deleted user was still found by id")
+	}
+	if _, err := FindWithUsername(original.Username); err == nil {
+		t.Error("Soft deleted user was still found by username")
+	}
+
+	reclaimed := User{Username: original.Username, Phonenumber: original.Phonenumber}
+	if err := reclaimed.Save(); err != nil {
+		t.Fatal("Error encountered reclaiming soft deleted identifiers: ", err)
+	}
+	defer removeUser(reclaimed)
+
+	found, err := FindWithUsername(original.Username)
+	if err != nil || found.Id != reclaimed.Id {
+		t.Error("Reclaimed username doesn't resolve to the new user: ", err)
+	}
+
+	if err := original.SoftDelete(); err != ErrUserNotFound {
+		t.Error("Expected deleting an already deleted user to fail, got: ", err)
+	}
+}
+
+// Ensures identifiers of a soft deleted user stay held by default
+func TestSoftDeleteKeepsIdentifiers(t *testing.T) {
+	if err := EnsureIndexes(); err != nil {
+		t.Fatal("Error encountered ensuring indexes: ", err)
+	}
+
+	original := User{Username: "bob", Phonenumber: "+15550010002"}
+	if err := original.Save(); err != nil {
+		t.Fatal("Failed to save user in the db: ", original.ToString())
+	}
+	defer removeUser(original)
+	if err := original.SoftDelete(); err != nil {
+		t.Fatal("Error encountered soft deleting user: ", err)
+	}
+	if _, err := FindWithUsername(original.Username); err == nil {
+		t.Error("Soft deleted user was still found by username")
+	}
+
+	sameUsername := User{Username: original.Username, Phonenumber: "+15550010003"}
+	if err := sameUsername.Save(); err != ErrDuplicateUsername {
+		removeUser(sameUsername)
+		t.Error("Expected the soft deleted user's username to stay held, got: ", err)
+	}
+	samePhone := User{Username: "bobAgain", Phonenumber: original.Phonenumber}
+	if err := samePhone.Save(); err != ErrDuplicatePhone {
+		removeUser(samePhone)
+		t.Error("Expected the soft deleted user's phonenumber to stay held, got: ", err)
+	}
+}
+
+// Ensures concurrent EnsureIndexesOnce calls share a single run, and that
+// failed runs are retried
+func TestEnsureIndexesOnce(t *testing.T) {
+	var runs int32
+	failing := true
+	ensureIndexes = func() error {
+		atomic.AddInt32(&runs, 1)
+		if failing {
+			return errors.New("index creation failed")
+		}
+		return nil
+	}
+	indexes = new(indexRun)
+	defer func() { ensureIndexes, indexes = EnsureIndexes, new(indexRun) }()
+
+	if err := EnsureIndexesOnce(); err == nil {
+		t.Error("Expected failed run to be reported")
+	}
+	failing = false
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := EnsureIndexesOnce(); err != nil {
+				t.Error("Error encountered ensuring indexes once: ", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if runs != 2 {
+		t.Errorf("Expected the failed run to be retried once, got %d runs", runs)
+	}
+}
@@ -0,0 +1,139 @@
+// Reporting of users conflicting on a unique field, whether found by the
+// existence checks run before writes or by a unique index rejecting a write
+// that raced past them
+
+package users
+
+import (
+	"reflect"
+	"regexp"
+	"strings"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/njdup/func/utils/web"
+)
+
+var (
+	// Fields no two live users may share, in the order their conflicts are
+	// reported, checked by Save and by Update when changed
+	// Fields without a query in uniqueFieldQueries are matched exactly on
+	// their stored value, and users leaving a field empty never conflict on
+	// it. Replace the list to configure it for a deployment, though the unique
+	// indexes of EnsureIndexes only back the default fields.
+	UniqueFields = []string{"Username", "Phonenumber", "Email"}
+
+	// Queries matching the users sharing the user's value of a unique field,
+	// for the fields not matched exactly
+	uniqueFieldQueries = map[string]func(user *User) bson.M{
+		"Username":    func(user *User) bson.M { return usernameQuery(user.TenantID, user.Username) },
+		"Phonenumber": func(user *User) bson.M { return phoneQuery(user.Phonenumber) },
+		"Email":       func(user *User) bson.M { return emailQuery(user.Email) },
+	}
+
+	// The error reported for each unique field, keyed by field name
+	duplicateFieldErrors = map[string]*web.InvalidFieldsError{
+		"Username":    ErrDuplicateUsername,
+		"Phonenumber": ErrDuplicatePhone,
+		"Email":       ErrDuplicateEmail,
+
+		"ExternalIdentities": ErrIdentityLinked, // Enforced by its index only, see LinkIdentity
+	}
+
+	// The unique field backed by each indexed key, see EnsureIndexes
+	indexedFields = map[string]string{
+		"usernameLower": "Username",
+		"userName":      "Username", // Index created before usernames were scoped to tenants
+		"phoneNumber":   "Phonenumber",
+		"phoneHash":     "Phonenumber",
+		"email":         "Email",
+		"slug":          "ProfileSlug",
+
+		"externalIdentities.provider": "ExternalIdentities",
+	}
+
+	// Extracts the index name from duplicate key error messages, which
+	// depending on the server version look like
+	//   E11000 duplicate key error collection: func.users index: email_1 dup key: ...
+	//   E11000 duplicate key error index: func.users.$email_1 dup key: ...
+	duplicateIndexPattern = regexp.MustCompile(`index: (?:\S+\.\$)?(\S+)`)
+)
+
+/*
+ * Helper Functions
+ */
+
+// Returns the error reported when a user with the same value for the given
+// field already exists
+func duplicateFieldError(field string) error {
+	if err, ok := duplicateFieldErrors[field]; ok {
+		return err
+	}
+	return &web.InvalidFieldsError{
+		web.GeneralError{"A user with the given " + strings.ToLower(field) + " already exists"},
+		[]string{field},
+	}
+}
+
+// Returns the existence checks for the UniqueFields the user has set, keyed
+// by field name, see checkConflicts
+// Soft deleted users are only matched while ReuseDeletedIdentifiers is unset.
+// Returns ErrUnknownUniqueField if UniqueFields names a field users don't
+// store.
+func uniquenessChecks(user *User) (map[string]bson.M, error) {
+	checks := make(map[string]bson.M)
+	value := reflect.ValueOf(user).Elem()
+	for _, field := range UniqueFields {
+		structField, ok := value.Type().FieldByName(field)
+		key := strings.Split(structField.Tag.Get("bson"), ",")[0]
+		if !ok || key == "" || key == "-" {
+			return nil, ErrUnknownUniqueField
+		}
+		fieldValue := value.FieldByIndex(structField.Index)
+		if fieldValue.IsZero() {
+			continue
+		}
+		query := bson.M{key: fieldValue.Interface()}
+		if fieldQuery, ok := uniqueFieldQueries[field]; ok {
+			query = fieldQuery(user)
+		}
+		if ReuseDeletedIdentifiers {
+			query = liveQuery(query)
+		}
+		checks[field] = query
+	}
+	return checks, nil
+}
+
+// Checks whether the given error reports a conflict on a unique field
+func isDuplicateFieldError(err error) bool {
+	for _, duplicate := range duplicateFieldErrors {
+		if err == duplicate {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the duplicateFieldError for the field whose unique index rejected
+// a write with the given error
+// Errors other than duplicate key errors, or for unknown indexes, are
+// returned as is.
+func duplicateKeyError(err error) error {
+	if !mgo.IsDup(err) {
+		return err
+	}
+	match := duplicateIndexPattern.FindStringSubmatch(err.Error())
+	if match == nil {
+		return err
+	}
+
+	// Index names join each key with its direction, as in tenantId_1_usernameLower_1
+	for _, part := range strings.Split(match[1], "_") {
+		if field, ok := indexedFields[part]; ok {
+			return duplicateFieldError(field)
+		}
+	}
+	return err
+}
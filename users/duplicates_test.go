@@ -0,0 +1,111 @@
+// Tests for reporting users conflicting on a unique field
+
+package users
+
+import (
+	"errors"
+	"testing"
+
+	"gopkg.in/mgo.v2"
+
+	"github.com/njdup/func/utils/web"
+)
+
+func TestDuplicateKeyError(t *testing.T) {
+	cases := map[error]error{
+		&mgo.LastError{Code: 11000, Err: `E11000 duplicate key error collection: func.users index: tenantId_1_usernameLower_1 dup key: { : null, : "alice" }`}: ErrDuplicateUsername,
+		&mgo.LastError{Code: 11000, Err: `E11000 duplicate key error index: func.users.$userName_1 dup key: { : "alice" }`}:                                    ErrDuplicateUsername,
+		&mgo.QueryError{Code: 11000, Message: `E11000 duplicate key error collection: func.users index: phoneNumber_1 dup key: { : "+15550000001" }`}:          ErrDuplicatePhone,
+		&mgo.LastError{Code: 11001, Err: `E11001 duplicate key on update index: func.users.$phoneHash_1 dup key: { : "ab12" }`}:                                ErrDuplicatePhone,
+		&mgo.LastError{Code: 11000, Err: `E11000 duplicate key error collection: func.users index: email_1 dup key: { : "a@example.com" }`}:                    ErrDuplicateEmail,
+	}
+	for err, expected := range cases {
+		if converted := duplicateKeyError(err); converted != expected {
+			t.Errorf("Expected %q to be reported as %v, got: %v", err, expected, converted)
+		}
+	}
+
+	// Other errors are passed through
+	unknownIndex := &mgo.LastError{Code: 11000, Err: `E11000 duplicate key error collection: func.users index: _id_ dup key: { : 1 }`}
+	other := errors.New("connection reset")
+	for _, err := range []error{unknownIndex, other, nil} {
+		if converted := duplicateKeyError(err); converted != err {
+			t.Errorf("Expected %v to be passed through, got: %v", err, converted)
+		}
+	}
+
+	if reason := signupFailureReason(ErrDuplicateEmail); reason != SignupFailureDuplicate {
+		t.Error("Duplicate email reported as: ", reason)
+	}
+}
+
+func TestUniquenessChecks(t *testing.T) {
+	defer func(fields []string) { UniqueFields = fields }(UniqueFields)
+	user := User{Username: "checked", Phonenumber: "+15550280001", ProfileSlug: "checked"}
+
+	checks, err := uniquenessChecks(&user)
+	if err != nil {
+		t.Fatal("Error encountered building checks: ", err)
+	}
+	if len(checks) != 2 || checks["Username"] == nil || checks["Phonenumber"] == nil {
+		t.Error("Expected checks for the set default fields only, got: ", checks)
+	}
+
+	UniqueFields = []string{"Username", "ProfileSlug"}
+	checks, _ = uniquenessChecks(&user)
+	if len(checks) != 2 || checks["Phonenumber"] != nil || checks["ProfileSlug"]["slug"] != "checked" {
+		t.Error("Expected extra fields to be matched on their stored value, got: ", checks)
+	}
+
+	for _, unknown := range []string{"Nickname", "reservationHash"} {
+		UniqueFields = []string{"Username", unknown}
+		if _, err := uniquenessChecks(&user); err != ErrUnknownUniqueField {
+			t.Errorf("Expected ErrUnknownUniqueField for %s, got: %v", unknown, err)
+		}
+	}
+}
+
+func TestConfiguredUniqueFields(t *testing.T) {
+	defer func(fields []string) { UniqueFields = fields }(UniqueFields)
+	UniqueFields = []string{"Username", "Phonenumber"}
+
+	first := User{Username: "uniqueFirst", Phonenumber: "+15550280002", Lastname: "Shared", Email: "shared@example.com"}
+	if err := first.Save(); err != nil {
+		t.Fatal("Failed to save user in the db: ", err)
+	}
+	defer removeUser(first)
+	sameEmail := User{Username: "uniqueSameEmail", Phonenumber: "+15550280003", Email: "shared@example.com"}
+	if err := sameEmail.Save(); err != nil {
+		t.Fatal("Expected emails to be shareable when not unique, got: ", err)
+	}
+	defer removeUser(sameEmail)
+
+	UniqueFields = []string{"Username", "Phonenumber", "Email", "Lastname"}
+	again := User{Username: "uniqueAgain", Phonenumber: "+15550280004", Email: "shared@example.com"}
+	if err := again.Save(); err != ErrDuplicateEmail {
+		removeUser(again)
+		t.Error("Expected ErrDuplicateEmail once email is unique, got: ", err)
+	}
+
+	sameLastname := User{Username: "uniqueSameLastname", Phonenumber: "+15550280005", Lastname: "Shared"}
+	err := sameLastname.Save()
+	if fieldsErr, ok := err.(*web.InvalidFieldsError); !ok || len(fieldsErr.Fields) != 1 || fieldsErr.Fields[0] != "Lastname" {
+		removeUser(sameLastname)
+		t.Error("Expected a conflict on the extra unique field, got: ", err)
+	}
+
+	renamed := User{Username: "uniqueRenamed", Phonenumber: "+15550280006", Lastname: "Other"}
+	if err := renamed.Save(); err != nil {
+		t.Fatal("Failed to save user in the db: ", err)
+	}
+	defer removeUser(renamed)
+	renamed.Lastname = "Shared"
+	if err := renamed.Update(); err == nil {
+		t.Error("Expected Update to detect the conflict on the extra unique field")
+	}
+
+	stored, _ := FindByID(renamed.Id.Hex())
+	if stored.Lastname != "Other" {
+		t.Error("Expected the conflicting update not to be stored, got lastname: ", stored.Lastname)
+	}
+}
@@ -0,0 +1,73 @@
+// Handling of user email addresses, which are optional, and their
+// verification
+
+package users
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Returns the canonical form of the given email address, trimmed and
+// lowercased, so differently typed input for the same address matches
+// Only obviously malformed addresses are rejected, with ErrInvalidEmail:
+// delivering a verification email is the real check.
+func NormalizeEmail(email string) (string, error) {
+	normalized := strings.ToLower(strings.TrimSpace(email))
+	at := strings.LastIndex(normalized, "@")
+	if at <= 0 || at == len(normalized)-1 || strings.ContainsAny(normalized, " \t\r\n") {
+		return "", ErrInvalidEmail
+	}
+	if domain := normalized[at+1:]; !strings.Contains(domain, ".") || strings.HasPrefix(domain, ".") || strings.HasSuffix(domain, ".") {
+		return "", ErrInvalidEmail
+	}
+	return normalized, nil
+}
+
+// Returns up to limit users with an unverified email address inserted more
+// than d ago, oldest first, for jobs reminding or purging them
+// Users without an email address have nothing to verify and are never listed.
+// The page is normalized with NormalizePagination.
+func ListUnverifiedOlderThan(d time.Duration, limit int) ([]*User, error) {
+	query := bson.M{
+		"email":         bson.M{"$exists": true, "$ne": ""},
+		"emailVerified": bson.M{"$ne": true},
+		"inserted":      bson.M{"$lt": time.Now().Add(-d)},
+	}
+	return listMatchingUsersContext(context.Background(), query, 0, limit, "inserted", "_id")
+}
+
+/*
+ * Helper Functions
+ */
+
+// Returns a query matching the user with the given normalized email address
+func emailQuery(email string) bson.M {
+	return bson.M{"email": email}
+}
+
+// Returns the normalized form of the given email address, or the address as
+// given if it can't be normalized
+func normalizedEmail(email string) string {
+	if normalized, err := NormalizeEmail(email); err == nil {
+		return normalized
+	}
+	return email
+}
+
+// Normalizes the user's email address in place, if set
+// Returns ErrInvalidEmail if the address is malformed
+func normalizeUserEmail(user *User) error {
+	if user.Email == "" {
+		return nil
+	}
+	normalized, err := NormalizeEmail(user.Email)
+	if err != nil {
+		return err
+	}
+	user.Email = normalized
+	return nil
+}
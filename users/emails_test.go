@@ -0,0 +1,71 @@
+// Tests for user email addresses
+
+package users
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/njdup/func/db"
+)
+
+func TestNormalizeEmail(t *testing.T) {
+	valid := map[string]string{
+		"alice@example.com":       "alice@example.com",
+		"  Alice@Example.COM ":    "alice@example.com",
+		"first.last+tag@mail.org": "first.last+tag@mail.org",
+	}
+	for email, expected := range valid {
+		if normalized, err := NormalizeEmail(email); err != nil || normalized != expected {
+			t.Errorf("Expected %q to normalize to %q, got %q (%v)", email, expected, normalized, err)
+		}
+	}
+
+	for _, email := range []string{"", "alice", "@example.com", "alice@", "alice@localhost", "al ice@example.com", "alice@.com"} {
+		if _, err := NormalizeEmail(email); err != ErrInvalidEmail {
+			t.Errorf("Expected %q to be rejected, got: %v", email, err)
+		}
+	}
+}
+
+func TestListUnverifiedOlderThan(t *testing.T) {
+	grace := 7 * 24 * time.Hour
+	now := time.Now()
+	seeded := []User{
+		{Username: "staleUnverified", Phonenumber: "+15550090001", Email: "stale@example.com", Inserted: now.Add(-2 * grace)},
+		{Username: "staleVerified", Phonenumber: "+15550090002", Email: "verified@example.com", EmailVerified: true, Inserted: now.Add(-2 * grace)},
+		{Username: "freshUnverified", Phonenumber: "+15550090003", Email: "fresh@example.com", Inserted: now.Add(-time.Hour)},
+		{Username: "staleWithoutEmail", Phonenumber: "+15550090004", Inserted: now.Add(-2 * grace)},
+	}
+	for i := range seeded {
+		seeded[i].Id = bson.NewObjectId()
+		user := seeded[i]
+		err := db.ExecWithCol(CollectionName, func(col *mgo.Collection) error {
+			return col.Insert(&user)
+		})
+		if err != nil {
+			t.Fatal("Error encountered seeding user: ", err)
+		}
+		defer removeUser(user)
+	}
+
+	unverified, err := ListUnverifiedOlderThan(grace, MaxPageSize)
+	if err != nil {
+		t.Fatal("Error encountered listing unverified users: ", err)
+	}
+	found := make(map[bson.ObjectId]bool)
+	for _, user := range unverified {
+		found[user.Id] = true
+	}
+	if !found[seeded[0].Id] {
+		t.Error("Stale unverified user wasn't listed")
+	}
+	for _, user := range seeded[1:] {
+		if found[user.Id] {
+			t.Error("User listed despite being verified, fresh or without email: ", user.ToString())
+		}
+	}
+}
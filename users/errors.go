@@ -0,0 +1,168 @@
+// Defines the errors returned when working with users
+
+package users
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/njdup/func/utils/web"
+)
+
+var (
+	ErrInvalidId = &web.InvalidFieldsError{
+		web.GeneralError{"The given user id is invalid"},
+		[]string{"Id"},
+	}
+	ErrCorruptRecord        = &web.GeneralError{"The stored user record is corrupt"}
+	ErrExistenceCheckFailed = &web.GeneralError{"Unable to check whether the user already exists"}
+	ErrIdentityLinked       = &web.InvalidFieldsError{
+		web.GeneralError{"The given external identity is already linked to another user"},
+		[]string{"ExternalIdentities"},
+	}
+	ErrReservedUsername = &web.InvalidFieldsError{
+		web.GeneralError{"The given username is reserved"},
+		[]string{"Username"},
+	}
+	ErrUserNotFound       = &web.GeneralError{"No matching user exists"}
+	ErrInvalidPhonenumber = &web.InvalidFieldsError{
+		web.GeneralError{"The given phonenumber is invalid"},
+		[]string{"Phonenumber"},
+	}
+	ErrPasswordLikeUsername = &web.InvalidFieldsError{
+		web.GeneralError{"The given password is too similar to the username or email address"},
+		[]string{"Password"},
+	}
+	ErrNilUser               = &web.GeneralError{"No user was given"}
+	ErrInvalidCursor         = &web.GeneralError{"The given sync cursor is invalid"}
+	ErrUsernameIsPhonenumber = &web.InvalidFieldsError{
+		web.GeneralError{"Usernames cannot be the phonenumber"},
+		[]string{"Username"},
+	}
+	ErrPlaceholderUsername = &web.InvalidFieldsError{
+		web.GeneralError{"The given username looks like a placeholder, please choose another"},
+		[]string{"Username"},
+	}
+	ErrInvalidEmail = &web.InvalidFieldsError{
+		web.GeneralError{"The given email address is invalid"},
+		[]string{"Email"},
+	}
+	ErrInvalidCredentials = &web.GeneralError{"The given username or password is incorrect"}
+	ErrInvalidMagicLink   = &web.GeneralError{"The given login link is invalid or has expired"}
+	ErrInvalidTokenTTL    = &web.GeneralError{"Tokens must expire after a positive duration"}
+	ErrDuplicateUsername  = &web.InvalidFieldsError{
+		web.GeneralError{"A user with the given username already exists"},
+		[]string{"Username"},
+	}
+	ErrDuplicatePhone = &web.InvalidFieldsError{
+		web.GeneralError{"A user with the given phonenumber already exists"},
+		[]string{"Phonenumber"},
+	}
+	ErrDuplicateEmail = &web.InvalidFieldsError{
+		web.GeneralError{"A user with the given email already exists"},
+		[]string{"Email"},
+	}
+	ErrNotSupportAgent      = &web.GeneralError{"Only support agents may impersonate users"}
+	ErrInvalidImpersonation = &web.GeneralError{"The given impersonation token is invalid or has expired"}
+	ErrInvalidRole          = &web.InvalidFieldsError{
+		web.GeneralError{"Role names cannot be empty"},
+		[]string{"Roles"},
+	}
+	ErrSignupNotAllowed = &web.GeneralError{"Signups are not allowed with the given email address or phonenumber"}
+	ErrStatusUnchanged  = &web.GeneralError{"The user already has the requested status"}
+	ErrUsernameHeld     = &web.InvalidFieldsError{
+		web.GeneralError{"The given username is reserved by another signup"},
+		[]string{"Username"},
+	}
+	ErrInvalidReservation = &web.GeneralError{"The username reservation is unknown, expired or already claimed"}
+	ErrInvalidPhoneSuffix = &web.InvalidFieldsError{
+		web.GeneralError{"The given phonenumber suffix is too short or holds more than digits"},
+		[]string{"Phonenumber"},
+	}
+	ErrInvalidProfileLink   = &web.GeneralError{"The given profile link is invalid"}
+	ErrProfileLinkExpired   = &web.GeneralError{"The given profile link has expired"}
+	ErrUnacceptablePassword = &web.InvalidFieldsError{
+		web.GeneralError{"Given password is not acceptable"},
+		[]string{"Password"},
+	}
+	ErrPasswordBreached = &web.InvalidFieldsError{
+		web.GeneralError{"The given password appears in a known data breach"},
+		[]string{"Password"},
+	}
+	ErrPasswordReused = &web.InvalidFieldsError{
+		web.GeneralError{"The given password was used recently"},
+		[]string{"Password"},
+	}
+	ErrUnknownProfileField = &web.GeneralError{"IncompleteProfileFields names an unknown profile requirement"}
+	ErrInvalidSession      = &web.GeneralError{"The given session is invalid or has expired"}
+	ErrTooManySessions     = &web.GeneralError{"The user has too many active sessions"}
+	ErrPhoneClaimed        = &web.InvalidFieldsError{
+		web.GeneralError{"The given phonenumber is being verified by another user"},
+		[]string{"Phonenumber"},
+	}
+	ErrReadOnly         = &web.GeneralError{"Users are read-only during maintenance, try again later"}
+	ErrInvalidBirthdate = &web.InvalidFieldsError{
+		web.GeneralError{"The given birthdate is not a plausible past date"},
+		[]string{"Birthdate"},
+	}
+	ErrUnderageSignup = &web.InvalidFieldsError{
+		web.GeneralError{"Users must be old enough to sign up"},
+		[]string{"Birthdate"},
+	}
+	ErrUnknownUniqueField           = &web.GeneralError{"UniqueFields names a field users do not store"}
+	ErrEmptyGeneratedUsername       = &web.GeneralError{"The username generator returned an empty username"}
+	ErrInvalidBinaryUser            = &web.GeneralError{"The given data is not a binary encoded user"}
+	ErrPasswordFingerprintsDisabled = &web.GeneralError{"Password fingerprints are not enabled"}
+	ErrConditionFailed              = &web.GeneralError{"The condition for saving the user no longer holds"}
+	ErrUnknownSortField             = &web.GeneralError{"Users can only be sorted by username, inserted, lastLogin or lastName"}
+	ErrLastAdmin                    = &web.GeneralError{"At least one administrator must remain"}
+)
+
+// CorruptRecordError is returned when a stored document cannot be decoded
+// into a User, identifying the offending document and field
+type CorruptRecordError struct {
+	Id    interface{}
+	Field string
+	Cause error
+}
+
+func (err *CorruptRecordError) Error() string {
+	msg := ErrCorruptRecord.Error()
+	if err.Id != nil {
+		msg += fmt.Sprintf(" (id %v)", err.Id)
+	}
+	if err.Field != "" {
+		msg += ": unexpected value for field " + err.Field
+	}
+	if err.Cause != nil {
+		msg += ": " + err.Cause.Error()
+	}
+	return msg
+}
+
+// Allows errors.Is(err, ErrCorruptRecord) to match any CorruptRecordError
+func (err *CorruptRecordError) Unwrap() error { return ErrCorruptRecord }
+
+// RoundTripError is returned by ValidateBSONRoundTrip when a user doesn't
+// survive being marshalled to bson and back
+type RoundTripError struct {
+	Fields []string // Fields that were lost or renamed
+	Cause  error    // Set if the user couldn't be marshalled or unmarshalled
+}
+
+func (err *RoundTripError) Error() string {
+	if err.Cause != nil {
+		return "User doesn't round-trip through bson: " + err.Cause.Error()
+	}
+	return "User doesn't round-trip through bson, lost fields: " + strings.Join(err.Fields, ", ")
+}
+
+// PhoneCollisionError is returned by NormalizeAllPhones when the normalized
+// phonenumber of users is held by another user, leaving them unchanged
+type PhoneCollisionError struct {
+	Ids []string // Hex ids of the users left unchanged
+}
+
+func (err *PhoneCollisionError) Error() string {
+	return "Normalized phonenumbers collide with other users for: " + strings.Join(err.Ids, ", ")
+}
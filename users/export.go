@@ -0,0 +1,101 @@
+// Bulk exports of users for support teams
+
+package users
+
+import (
+	"encoding/csv"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/njdup/func/db"
+	"github.com/njdup/func/utils/web"
+)
+
+// The non-sensitive fields that may be exported, with how to read each
+// Sensitive fields such as the password hash or phonenumber are never
+// exportable
+var csvFields = map[string]func(*User) string{
+	"username":      func(user *User) string { return user.Username },
+	"firstName":     func(user *User) string { return user.Firstname },
+	"lastName":      func(user *User) string { return user.Lastname },
+	"phoneVerified": func(user *User) string { return strconv.FormatBool(user.PhoneVerified) },
+	"emailVerified": func(user *User) string { return strconv.FormatBool(user.EmailVerified) },
+	"createdAt":     func(user *User) string { return user.Inserted.UTC().Format(time.RFC3339) },
+}
+
+// The fields exported when none are requested, in column order
+var DefaultCSVFields = []string{"username", "firstName", "lastName", "phoneVerified", "emailVerified", "createdAt"}
+
+// Writes all users to w as CSV, with a header row naming the given fields in
+// the given order (DefaultCSVFields if none are given)
+// Users are streamed from the database so memory use stays flat for large
+// collections. Cells spreadsheets would run as formulas are escaped, see
+// spreadsheetSafe. Returns an InvalidFieldsError before writing anything if a
+// requested field isn't exportable.
+func ExportCSV(w io.Writer, fields []string) error {
+	if len(fields) == 0 {
+		fields = DefaultCSVFields
+	}
+	rejected := make([]string, 0)
+	for _, field := range fields {
+		if _, ok := csvFields[field]; !ok {
+			rejected = append(rejected, field)
+		}
+	}
+	if len(rejected) != 0 {
+		return &web.InvalidFieldsError{
+			web.GeneralError{"The requested fields can't be exported"},
+			rejected,
+		}
+	}
+
+	out := csv.NewWriter(w)
+	if err := out.Write(fields); err != nil {
+		return err
+	}
+
+	exportQuery := func(col *mgo.Collection) error {
+		var raw bson.Raw
+		row := make([]string, len(fields))
+		iter := col.Find(liveQuery(bson.M{})).Sort("_id").Iter()
+		for iter.Next(&raw) {
+			user := User{}
+			if err := decodeUser(raw, &user); err != nil {
+				iter.Close()
+				return err
+			}
+			for i, field := range fields {
+				row[i] = spreadsheetSafe(csvFields[field](&user))
+			}
+			if err := out.Write(row); err != nil {
+				iter.Close()
+				return err
+			}
+		}
+		return iter.Close()
+	}
+
+	if err := db.ExecWithCol(CollectionName, exportQuery); err != nil {
+		return err
+	}
+	out.Flush()
+	return out.Error()
+}
+
+/*
+ * Helper Functions
+ */
+
+// Returns the given cell prefixed with a quote if spreadsheets would
+// otherwise run it as a formula, such as a first name of =HYPERLINK(...)
+func spreadsheetSafe(cell string) string {
+	if cell != "" && strings.ContainsRune("=+-@", rune(cell[0])) {
+		return "'" + cell
+	}
+	return cell
+}
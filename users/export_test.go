@@ -0,0 +1,85 @@
+// Tests for bulk exports of users
+
+package users
+
+import (
+	"bytes"
+	"encoding/csv"
+	"strings"
+	"testing"
+
+	"github.com/njdup/func/utils/web"
+)
+
+func TestExportCSV(t *testing.T) {
+	user := User{Username: "csvUser", Firstname: "john", Lastname: "doe", Phonenumber: "+15550012001"}
+	if err := user.SetPassword("supersecure"); err != nil {
+		t.Fatal("Error encountered setting password: ", err)
+	}
+	if err := user.Save(); err != nil {
+		t.Fatal("Failed to save user in the db: ", user.ToString())
+	}
+	defer removeUser(user)
+
+	var out bytes.Buffer
+	if err := ExportCSV(&out, []string{"lastName", "username"}); err != nil {
+		t.Fatal("Error encountered exporting users: ", err)
+	}
+	rows, err := csv.NewReader(&out).ReadAll()
+	if err != nil {
+		t.Fatal("Exported users aren't valid CSV: ", err)
+	}
+	if len(rows) < 2 || strings.Join(rows[0], ",") != "lastName,username" {
+		t.Fatal("Unexpected CSV header: ", rows)
+	}
+
+	found := false
+	for _, row := range rows[1:] {
+		if len(row) != 2 {
+			t.Error("Row has unexpected columns: ", row)
+		}
+		if row[1] == user.Username {
+			found = row[0] == user.Lastname
+		}
+	}
+	if !found {
+		t.Error("Saved user missing from CSV export: ", rows)
+	}
+
+	out.Reset()
+	if err := ExportCSV(&out, nil); err != nil {
+		t.Fatal("Error encountered exporting default fields: ", err)
+	}
+	if header, _ := csv.NewReader(&out).Read(); strings.Join(header, ",") != strings.Join(DefaultCSVFields, ",") {
+		t.Error("Unexpected default CSV header: ", header)
+	}
+	if strings.Contains(out.String(), user.PasswordHash) {
+		t.Error("Password hash included in CSV export")
+	}
+
+	out.Reset()
+	err = ExportCSV(&out, []string{"username", "password"})
+	if fieldsErr, ok := err.(*web.InvalidFieldsError); !ok || len(fieldsErr.Fields) != 1 || fieldsErr.Fields[0] != "password" {
+		t.Error("Expected the password field to be rejected, got: ", err)
+	}
+	if out.Len() != 0 {
+		t.Error("Output written for a rejected export: ", out.String())
+	}
+}
+
+func TestSpreadsheetSafe(t *testing.T) {
+	cells := map[string]string{
+		"john":                 "john",
+		"":                     "",
+		"=HYPERLINK(\"x\")":    "'=HYPERLINK(\"x\")",
+		"+15550012001":         "'+15550012001",
+		"-2+3":                 "'-2+3",
+		"@SUM(A1)":             "'@SUM(A1)",
+		"2026-10-14T00:00:00Z": "2026-10-14T00:00:00Z",
+	}
+	for cell, expected := range cells {
+		if safe := spreadsheetSafe(cell); safe != expected {
+			t.Errorf("Expected cell %q to be exported as %q, got %q", cell, expected, safe)
+		}
+	}
+}
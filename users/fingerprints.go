@@ -0,0 +1,78 @@
+// Keyed fingerprints of user passwords, so security reviews can find
+// clusters of users sharing a password without learning the password
+//
+// Fingerprints are an HMAC of the password under a secret key, stored when
+// enabled alongside the bcrypt hash, which can't be compared across users.
+// They are opt-in: anyone holding both the key and the fingerprints can test
+// guesses against every user at once, far faster than against bcrypt.
+
+package users
+
+import (
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/njdup/func/db"
+	"github.com/njdup/func/utils/security"
+)
+
+// The PasswordFingerprintConfig struct configures storing keyed
+// fingerprints of passwords as they are set
+// Rotating the key makes the stored fingerprints unmatchable, so users only
+// cluster again once they set their password under the new key.
+type PasswordFingerprintConfig struct {
+	Enabled bool
+	Key     []byte // Secret HMAC key, never stored with the users
+}
+
+var (
+	// Configures storing password fingerprints, disabled by default
+	PasswordFingerprints = PasswordFingerprintConfig{}
+)
+
+// Returns the number of live users sharing each password shared by more
+// than one user, keyed by the password's fingerprint
+// Only passwords set while PasswordFingerprints was enabled are counted.
+// Returns ErrPasswordFingerprintsDisabled unless PasswordFingerprints is
+// enabled.
+func CommonPasswordCount() (map[string]int, error) {
+	if !PasswordFingerprints.Enabled {
+		return nil, ErrPasswordFingerprintsDisabled
+	}
+	pipeline := []bson.M{
+		{"$match": liveQuery(bson.M{"passwordFingerprint": bson.M{"$nin": []interface{}{"", nil}}})},
+		{"$group": bson.M{"_id": "$passwordFingerprint", "count": bson.M{"$sum": 1}}},
+		{"$match": bson.M{"count": bson.M{"$gt": 1}}},
+	}
+
+	result := make(map[string]int)
+	countQuery := func(col *mgo.Collection) error {
+		var group struct {
+			Fingerprint string `bson:"_id"`
+			Count       int    `bson:"count"`
+		}
+		iter := col.Pipe(pipeline).Iter()
+		for iter.Next(&group) {
+			result[group.Fingerprint] = group.Count
+		}
+		return iter.Close()
+	}
+
+	if err := db.ExecWithCol(CollectionName, countQuery); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+/*
+ * Helper Functions
+ */
+
+// Returns the fingerprint stored for the given password, empty unless
+// PasswordFingerprints is enabled
+func passwordFingerprint(password string) string {
+	if !PasswordFingerprints.Enabled {
+		return ""
+	}
+	return security.KeyedHash(PasswordFingerprints.Key, password)
+}
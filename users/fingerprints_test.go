@@ -0,0 +1,109 @@
+// Tests for password fingerprints
+
+package users
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/njdup/func/db"
+)
+
+func TestCommonPasswordCount(t *testing.T) {
+	if _, err := CommonPasswordCount(); err != ErrPasswordFingerprintsDisabled {
+		t.Error("Expected ErrPasswordFingerprintsDisabled by default, got: ", err)
+	}
+
+	defer func(config PasswordFingerprintConfig) { PasswordFingerprints = config }(PasswordFingerprints)
+	PasswordFingerprints = PasswordFingerprintConfig{Enabled: true, Key: []byte("fingerprint test key")}
+
+	passwords := map[string]string{
+		"sharedOne":   "summer holidays 2019",
+		"sharedTwo":   "summer holidays 2019",
+		"sharedThree": "summer holidays 2019",
+		"pairOne":     "correct horse battery",
+		"pairTwo":     "correct horse battery",
+		"unique":      "a password nobody else has",
+	}
+	phone := 1
+	for username, password := range passwords {
+		user := User{Username: "fingerprint" + username, Phonenumber: fmt.Sprintf("+155503400%02d", phone)}
+		phone++
+		if err := user.SetPassword(password); err != nil {
+			t.Fatal("Error encountered setting password: ", err)
+		}
+		if err := user.Save(); err != nil {
+			t.Fatal("Failed to save user in the db: ", user.ToString())
+		}
+		defer removeUser(user)
+	}
+
+	counts, err := CommonPasswordCount()
+	if err != nil {
+		t.Fatal("Error encountered counting common passwords: ", err)
+	}
+	expected := map[string]int{
+		"summer holidays 2019":       3,
+		"correct horse battery":      2,
+		"a password nobody else has": 0,
+	}
+	for password, count := range expected {
+		if counts[passwordFingerprint(password)] != count {
+			t.Errorf("Expected %d users sharing %q, got %d", count, password, counts[passwordFingerprint(password)])
+		}
+	}
+	for fingerprint := range counts {
+		if _, isPassword := expected[fingerprint]; isPassword {
+			t.Error("Expected clusters to be keyed by fingerprint, got a password")
+		}
+	}
+}
+
+// Ensures neither the password nor anything but its fingerprint and hash is stored
+func TestPasswordFingerprintStorage(t *testing.T) {
+	defer func(config PasswordFingerprintConfig) { PasswordFingerprints = config }(PasswordFingerprints)
+	PasswordFingerprints = PasswordFingerprintConfig{Enabled: true, Key: []byte("fingerprint test key")}
+
+	const password = "never stored anywhere"
+	user := User{Username: "fingerprintStored", Phonenumber: "+15550349901"}
+	if err := user.SetPassword(password); err != nil {
+		t.Fatal("Error encountered setting password: ", err)
+	}
+	if err := user.Save(); err != nil {
+		t.Fatal("Failed to save user in the db: ", user.ToString())
+	}
+	defer removeUser(user)
+	if err := user.ChangePassword(password, "also never stored"); err != nil {
+		t.Fatal("Error encountered changing password: ", err)
+	}
+
+	var stored bson.M
+	db.ExecWithCol(CollectionName, func(col *mgo.Collection) error {
+		return col.FindId(user.Id).One(&stored)
+	})
+	storedText := fmt.Sprint(stored)
+	for _, raw := range []string{password, "also never stored"} {
+		if strings.Contains(storedText, raw) {
+			t.Errorf("Stored user holds the raw password %q: %v", raw, stored)
+		}
+	}
+	if stored["passwordFingerprint"] != passwordFingerprint("also never stored") {
+		t.Error("Expected the fingerprint of the changed password to be stored, got: ", stored["passwordFingerprint"])
+	}
+
+	PasswordFingerprints.Enabled = false
+	if err := user.AdminSetPassword("set while disabled", false); err != nil {
+		t.Fatal("Error encountered resetting password: ", err)
+	}
+	stored = nil
+	db.ExecWithCol(CollectionName, func(col *mgo.Collection) error {
+		return col.FindId(user.Id).One(&stored)
+	})
+	if _, ok := stored["passwordFingerprint"]; ok {
+		t.Error("Expected the fingerprint to be dropped once disabled")
+	}
+}
@@ -0,0 +1,110 @@
+// Lifecycle hooks run after user operations, such as sending the
+// verification email for a new user
+//
+// Hooks run once the operation has been stored, so a failing hook never
+// undoes it. Transient failures are retried according to HookPolicy.
+
+package users
+
+import (
+	"strings"
+	"time"
+)
+
+// A Hook is run with the user an operation was applied to
+type Hook func(user *User) error
+
+// Configures how lifecycle hooks are run
+type HookConfig struct {
+	Attempts int           // Number of times a failing hook is run, at least once
+	Backoff  time.Duration // Wait before the first retry, doubled before each further retry
+	// Returns the failures of hooks from the operation when set, as a
+	// HookError, although the operation itself succeeded. Callers enabling
+	// it must tell HookErrors apart from failures of the operation, with
+	// errors.As. Failures are dropped otherwise.
+	ReportErrors bool
+}
+
+// The HookError type aggregates the failures of the hooks run after an
+// operation, which itself succeeded
+type HookError struct {
+	Errors []error // The last error of each failed hook
+	// Set if revoking the user's sessions after their password changed
+	// failed, see ChangePassword
+	RevokeError error
+}
+
+var (
+	HookPolicy = HookConfig{Attempts: 1}
+
+	createdHooks         []Hook // Hooks run after a user is saved
+	passwordChangedHooks []Hook // Hooks run after a stored user's password is changed
+
+	// Waits between attempts, stored in a variable so tests don't have to
+	sleep = time.Sleep
+)
+
+// Registers a hook run after each new user is saved
+// Hooks should be registered during initialization, before users are saved
+func OnUserCreated(hook Hook) {
+	createdHooks = append(createdHooks, hook)
+}
+
+// Registers a hook run after the password of a stored user is changed, by
+// ChangePassword or AdminSetPassword, such as to alert the user
+// Hooks should be registered during initialization, before passwords change
+func OnPasswordChanged(hook Hook) {
+	passwordChangedHooks = append(passwordChangedHooks, hook)
+}
+
+// Returns the messages of the aggregated hook failures
+func (err *HookError) Error() string {
+	messages := make([]string, 0, len(err.Errors))
+	for _, hookErr := range err.Errors {
+		messages = append(messages, hookErr.Error())
+	}
+	message := "Lifecycle hooks failed: " + strings.Join(messages, "; ")
+	if err.RevokeError == nil {
+		return message
+	}
+	revoked := "Revoking sessions failed: " + err.RevokeError.Error()
+	if len(messages) == 0 {
+		return revoked
+	}
+	return revoked + "; " + message
+}
+
+/*
+ * Helper Functions
+ */
+
+// Runs each of the given hooks with the user, retrying failures according
+// to HookPolicy
+// Returns a HookError if any hook failed every attempt and HookPolicy
+// reports errors, otherwise nil
+func runHooks(hooks []Hook, user *User) error {
+	var failures []error
+	for _, hook := range hooks {
+		if err := runHook(hook, user); err != nil {
+			failures = append(failures, err)
+		}
+	}
+
+	if len(failures) == 0 || !HookPolicy.ReportErrors {
+		return nil
+	}
+	return &HookError{Errors: failures}
+}
+
+// Runs the hook until it succeeds or HookPolicy.Attempts is reached
+// Returns the error of the last attempt
+func runHook(hook Hook, user *User) error {
+	backoff := HookPolicy.Backoff
+	err := hook(user)
+	for attempt := 1; err != nil && attempt < HookPolicy.Attempts; attempt++ {
+		sleep(backoff)
+		backoff *= 2
+		err = hook(user)
+	}
+	return err
+}
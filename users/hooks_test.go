@@ -0,0 +1,78 @@
+// Tests for lifecycle hooks
+
+package users
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// Returns a hook failing the given number of times before succeeding, along
+// with the count of calls made to it
+func flakyHook(failures int) (Hook, *int) {
+	calls := 0
+	hook := func(user *User) error {
+		calls++
+		if calls <= failures {
+			return errors.New("transient failure")
+		}
+		return nil
+	}
+	return hook, &calls
+}
+
+func TestHookRetries(t *testing.T) {
+	defer func(policy HookConfig) { HookPolicy, sleep = policy, time.Sleep }(HookPolicy)
+	var waits []time.Duration
+	sleep = func(d time.Duration) { waits = append(waits, d) }
+
+	HookPolicy = HookConfig{Attempts: 3, Backoff: time.Second, ReportErrors: true}
+	hook, calls := flakyHook(2)
+	if err := runHooks([]Hook{hook}, &User{}); err != nil {
+		t.Error("Hook succeeding within the attempts reported an error: ", err)
+	}
+	if *calls != 3 {
+		t.Error("Expected hook to be run 3 times, got: ", *calls)
+	}
+	if len(waits) != 2 || waits[0] != time.Second || waits[1] != 2*time.Second {
+		t.Error("Unexpected backoff between attempts: ", waits)
+	}
+
+	// Hooks still failing after every attempt are aggregated
+	HookPolicy.Attempts = 2
+	failing, _ := flakyHook(2)
+	succeeding, _ := flakyHook(0)
+	err := runHooks([]Hook{failing, succeeding}, &User{})
+	hookErr, ok := err.(*HookError)
+	if !ok || len(hookErr.Errors) != 1 {
+		t.Error("Expected a HookError with one failure, got: ", err)
+	}
+
+	// Unless errors aren't reported
+	HookPolicy.ReportErrors = false
+	failing, _ = flakyHook(2)
+	if err := runHooks([]Hook{failing}, &User{}); err != nil {
+		t.Error("Hook failure reported with ReportErrors disabled: ", err)
+	}
+}
+
+// Ensures a failing hook doesn't undo saving the user
+func TestCreatedHookFailure(t *testing.T) {
+	defer func(hooks []Hook) { createdHooks = hooks }(createdHooks)
+	hook, calls := flakyHook(1)
+	OnUserCreated(hook)
+
+	user := User{Username: "hookedUser", Phonenumber: "+15550050001"}
+	err := user.Save()
+	defer removeUser(user)
+	if err != nil {
+		t.Error("Expected the failing hook not to fail the save by default, got: ", err)
+	}
+	if *calls != 1 {
+		t.Error("Expected hook to be run once, got: ", *calls)
+	}
+	if _, err := FindByID(user.Id.Hex()); err != nil {
+		t.Error("User wasn't stored despite the hook failure: ", err)
+	}
+}
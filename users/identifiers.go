@@ -0,0 +1,69 @@
+// Lookup of users by whichever identifier they typed, for login forms with a
+// single "username, email or phone" box
+
+package users
+
+import (
+	"context"
+	"strings"
+
+	"gopkg.in/mgo.v2"
+)
+
+// Finds the user of the default tenant identified by the given username,
+// email address or phonenumber
+// Identifiers containing an @ are looked up as email addresses, those made
+// of digits (with an optional leading + and the usual formatting) as
+// phonenumbers, and any other as usernames, each normalized first. Returns
+// ErrUserNotFound if no user matches, including for identifiers that can't
+// be normalized.
+func FindByIdentifier(identifier string) (*User, error) {
+	identifier = strings.TrimSpace(identifier)
+	var user User
+	var err error
+	switch {
+	case identifier == "":
+		return nil, ErrUserNotFound
+	case strings.Contains(identifier, "@"):
+		var email string
+		if email, err = NormalizeEmail(identifier); err != nil {
+			return nil, ErrUserNotFound
+		}
+		user, err = findCoalesced(context.Background(), lookupKey("email", email), emailQuery(email))
+	case looksLikePhonenumber(identifier):
+		var phonenumber string
+		if phonenumber, err = NormalizePhonenumber(identifier); err != nil {
+			return nil, ErrUserNotFound
+		}
+		user, err = FindWithPhonenumber(phonenumber)
+	default:
+		user, err = FindWithUsername(identifier)
+	}
+
+	if err == mgo.ErrNotFound {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+/*
+ * Helper Functions
+ */
+
+// Checks whether the given identifier is made of digits, once stripped of
+// phone formatting and an international prefix
+func looksLikePhonenumber(identifier string) bool {
+	digits := strings.TrimPrefix(stripPhoneFormatting(identifier), "+")
+	if digits == "" {
+		return false
+	}
+	for _, r := range digits {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
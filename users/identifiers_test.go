@@ -0,0 +1,57 @@
+// Tests for looking up users by any identifier
+
+package users
+
+import (
+	"testing"
+)
+
+func TestLooksLikePhonenumber(t *testing.T) {
+	cases := map[string]bool{
+		"+15550290001":    true,
+		"(555) 029-0001":  true,
+		"555.029.0001":    true,
+		"0044 20 7946 01": true,
+		"alice":           false,
+		"alice99":         false,
+		"+":               false,
+		"":                false,
+	}
+	for identifier, expected := range cases {
+		if looksLikePhonenumber(identifier) != expected {
+			t.Errorf("Expected %q to look like a phonenumber: %v", identifier, expected)
+		}
+	}
+}
+
+func TestFindByIdentifier(t *testing.T) {
+	user := User{Username: "identified", Phonenumber: "+15550290001", Email: "identified@example.com"}
+	if err := user.Save(); err != nil {
+		t.Fatal("Failed to save user in the db: ", err)
+	}
+	defer removeUser(user)
+
+	identifiers := []string{
+		"identified",
+		" identified ",
+		"identified@example.com",
+		"Identified@Example.com",
+		"+15550290001",
+		"(555) 029-0001",
+	}
+	for _, identifier := range identifiers {
+		found, err := FindByIdentifier(identifier)
+		if err != nil {
+			t.Errorf("Error encountered finding user by %q: %v", identifier, err)
+		} else if found.Id != user.Id {
+			t.Errorf("Expected %q to identify the user, found: %v", identifier, found.ToString())
+		}
+	}
+
+	unknown := []string{"", "nobody", "nobody@example.com", "not@valid", "+15550290099", "123"}
+	for _, identifier := range unknown {
+		if _, err := FindByIdentifier(identifier); err != ErrUserNotFound {
+			t.Errorf("Expected ErrUserNotFound for %q, got: %v", identifier, err)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+// Handling of external (OAuth) identities linked to users, such as
+// "Sign in with Google/GitHub" accounts
+
+package users
+
+import (
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/njdup/func/db"
+)
+
+// The ExternalIdentity struct identifies an account with an external provider
+// Each (Provider, Subject) pair may be linked to at most one user
+type ExternalIdentity struct {
+	Provider string `bson:"provider" json:"provider"`
+	Subject  string `bson:"subject" json:"subject"`
+}
+
+// Finds the user linked to the given provider account
+// Returns an error if no such user exists
+func FindByExternalIdentity(provider, subject string) (*User, error) {
+	user, err := findMatchingUser(identityQuery(provider, subject))
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// Links the given provider account to the user
+// Returns ErrIdentityLinked if the identity already belongs to another user,
+// which the unique index created by EnsureIndexes enforces against
+// concurrent links, or ErrUserNotFound if the user is no longer stored.
+// Linking an identity the user already holds is a no-op.
+func (user *User) LinkIdentity(provider, subject string) error {
+	if user == nil {
+		return ErrNilUser
+	}
+	identity := ExternalIdentity{Provider: provider, Subject: subject}
+	for _, linked := range user.ExternalIdentities {
+		if linked == identity {
+			return nil
+		}
+	}
+
+	now := time.Now()
+	linkQuery := func(col *mgo.Collection) error {
+		query := identityQuery(provider, subject)
+		if user.Id != "" {
+			query["_id"] = bson.M{"$ne": user.Id}
+		}
+		if count, err := col.Find(query).Limit(1).Count(); err != nil {
+			return err
+		} else if count != 0 {
+			return ErrIdentityLinked
+		}
+
+		// Unsaved users have the identity stored once they are saved
+		if user.Id == "" {
+			return nil
+		}
+		if err := checkWritable(); err != nil {
+			return err
+		}
+		update := bson.M{"$addToSet": bson.M{"externalIdentities": identity}}
+		err := col.Update(liveQuery(bson.M{"_id": user.Id}), touched(update, now))
+		if err == mgo.ErrNotFound {
+			return ErrUserNotFound
+		} else if err != nil {
+			return duplicateKeyError(err)
+		}
+		cachedUsers.invalidate(user.Id)
+		user.Updated = now
+		user.Version++
+		return nil
+	}
+
+	if err := db.ExecWithCol(CollectionName, linkQuery); err != nil {
+		return err
+	}
+	user.ExternalIdentities = append(user.ExternalIdentities, identity)
+	return nil
+}
+
+/*
+ * Helper Functions
+ */
+
+// Returns a query matching users linked to the given provider account
+func identityQuery(provider, subject string) bson.M {
+	return bson.M{"externalIdentities": bson.M{
+		"$elemMatch": bson.M{"provider": provider, "subject": subject},
+	}}
+}
@@ -0,0 +1,75 @@
+// Tests for linking external identities to users
+
+package users
+
+import (
+	"testing"
+)
+
+func TestExternalIdentities(t *testing.T) {
+	if err := EnsureIndexes(); err != nil {
+		t.Fatal("Error encountered ensuring indexes: ", err)
+	}
+	owner := User{Username: "oauthOwner", Phonenumber: "+15550001001"}
+	other := User{Username: "oauthOther", Phonenumber: "+15550001002"}
+	for _, user := range []*User{&owner, &other} {
+		if err := user.Save(); err != nil {
+			t.Fatal("Failed to save user in the db: ", user.ToString())
+		}
+		defer removeUser(*user)
+	}
+
+	if err := owner.LinkIdentity("github", "12345"); err != nil {
+		t.Fatal("Error encountered linking identity: ", err)
+	}
+	if err := owner.LinkIdentity("github", "12345"); err != nil {
+		t.Error("Relinking an owned identity should be a no-op, got: ", err)
+	}
+
+	// The same identity can't be bound to a second user
+	if err := other.LinkIdentity("github", "12345"); err != ErrIdentityLinked {
+		t.Error("Expected duplicate link to be rejected, got: ", err)
+	}
+	// But the same subject with a different provider is distinct
+	if err := other.LinkIdentity("google", "12345"); err != nil {
+		t.Error("Error encountered linking identity with another provider: ", err)
+	}
+
+	found, err := FindByExternalIdentity("github", "12345")
+	if err != nil {
+		t.Fatal("Error encountered finding user by identity: ", err)
+	}
+	if found.Id != owner.Id {
+		t.Error("Wrong user found for identity: ", found.ToString())
+	}
+
+	found, err = FindByExternalIdentity("google", "12345")
+	if err != nil || found.Id != other.Id {
+		t.Error("Wrong user found for identity with another provider: ", err)
+	}
+
+	if _, err := FindByExternalIdentity("github", "99999"); err == nil {
+		t.Error("No error encountered finding nonexistent identity")
+	}
+
+	// The unique index rejects links racing past the existence check
+	racing := User{Username: "oauthRacing", Phonenumber: "+15550001003"}
+	if err := racing.LinkIdentity("gitlab", "777"); err != nil {
+		t.Fatal("Error encountered linking identity to unsaved user: ", err)
+	}
+	if err := owner.LinkIdentity("gitlab", "777"); err != nil {
+		t.Fatal("Error encountered linking identity: ", err)
+	}
+	if err := racing.Save(); err != ErrIdentityLinked {
+		t.Error("Expected saving a user with a linked identity to be rejected, got: ", err)
+		removeUser(racing)
+	}
+
+	// Soft deleted users can't be linked
+	if err := other.SoftDelete(); err != nil {
+		t.Fatal("Error encountered soft deleting user: ", err)
+	}
+	if err := other.LinkIdentity("gitlab", "888"); err != ErrUserNotFound {
+		t.Error("Expected linking a soft deleted user to be rejected, got: ", err)
+	}
+}
@@ -0,0 +1,140 @@
+// Impersonation of users by support agents, who sometimes need to act as a
+// user to reproduce their issue
+//
+// Every impersonation is recorded with the agent, the impersonated user and
+// when it happened. The record doubles as the store of the token, of which
+// only the hash is kept.
+
+package users
+
+import (
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/njdup/func/db"
+	"github.com/njdup/func/utils/security"
+)
+
+var (
+	ImpersonationCollectionName = "userImpersonations" // Name of the collection holding impersonation records
+	SupportRole                 = "support"            // Role required to impersonate users
+)
+
+// The ImpersonationRecord struct records an agent impersonating a user
+type ImpersonationRecord struct {
+	Id        bson.ObjectId `bson:"_id,omitempty" json:"-"`
+	AgentId   bson.ObjectId `bson:"agentId" json:"agentId"`
+	TargetId  bson.ObjectId `bson:"targetId" json:"targetId"`
+	At        time.Time     `bson:"at" json:"at"`
+	Expires   time.Time     `bson:"expires" json:"expires"`
+	TokenHash string        `bson:"tokenHash" json:"-"`
+}
+
+// Returns a token letting the agent act as the target user for ttl,
+// recording the impersonation
+// The agent must hold SupportRole in the stored user, so roles granted to the
+// receiver alone aren't enough.
+// Returns ErrNotSupportAgent if the agent isn't a support agent,
+// ErrInvalidTokenTTL if ttl isn't positive, or ErrUserNotFound if either user
+// isn't stored.
+func (agent *User) CreateImpersonationToken(target *User, ttl time.Duration) (string, error) {
+	if agent == nil || agent.Id == "" || target == nil || target.Id == "" {
+		return "", ErrUserNotFound
+	}
+	if err := checkWritable(); err != nil {
+		return "", err
+	}
+	if ttl <= 0 {
+		return "", ErrInvalidTokenTTL
+	}
+	token, err := security.NewToken()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	createQuery := func(col *mgo.Collection) error {
+		storedAgent, err := loadStoredUser(col, agent.Id)
+		if err != nil {
+			return err
+		}
+		if !storedAgent.HasRole(SupportRole) {
+			return ErrNotSupportAgent
+		}
+		if _, err := loadStoredUser(col, target.Id); err != nil {
+			return err
+		}
+
+		record := ImpersonationRecord{
+			AgentId:   agent.Id,
+			TargetId:  target.Id,
+			At:        now,
+			Expires:   now.Add(ttl),
+			TokenHash: security.HashToken(token),
+		}
+		return col.Database.C(ImpersonationCollectionName).Insert(&record)
+	}
+
+	if err := db.ExecWithCol(CollectionName, createQuery); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Returns the agent and the user they impersonate with the given token
+// The agent must still be an active support agent, so revoking SupportRole
+// or disabling the agent ends the agent's impersonations.
+// Returns ErrInvalidImpersonation if the token is unknown or expired, or if
+// either user is no longer stored or the agent lost SupportRole or was
+// disabled.
+func ResolveImpersonation(token string) (agent, target *User, err error) {
+	if token == "" {
+		return nil, nil, ErrInvalidImpersonation
+	}
+
+	resolveQuery := func(col *mgo.Collection) error {
+		var record ImpersonationRecord
+		query := bson.M{"tokenHash": security.HashToken(token), "expires": bson.M{"$gt": time.Now()}}
+		if err := col.Database.C(ImpersonationCollectionName).Find(query).One(&record); err == mgo.ErrNotFound {
+			return ErrInvalidImpersonation
+		} else if err != nil {
+			return err
+		}
+
+		var err error
+		if agent, err = loadStoredUser(col, record.AgentId); err != nil {
+			return err
+		}
+		if !agent.Active || !agent.HasRole(SupportRole) {
+			return ErrInvalidImpersonation
+		}
+		target, err = loadStoredUser(col, record.TargetId)
+		return err
+	}
+
+	err = db.ExecWithCol(CollectionName, resolveQuery)
+	if err == ErrUserNotFound {
+		err = ErrInvalidImpersonation
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return agent, target, nil
+}
+
+// Returns the impersonations of the user by support agents, oldest first
+func (user *User) Impersonations() ([]ImpersonationRecord, error) {
+	if user == nil {
+		return nil, ErrNilUser
+	}
+	result := make([]ImpersonationRecord, 0)
+	recordQuery := func(col *mgo.Collection) error {
+		query := bson.M{"targetId": user.Id}
+		return col.Database.C(ImpersonationCollectionName).Find(query).Sort("at").All(&result)
+	}
+
+	err := db.ExecWithCol(CollectionName, recordQuery)
+	return result, err
+}
@@ -0,0 +1,72 @@
+// Tests for the impersonation of users by support agents
+
+package users
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/njdup/func/db"
+)
+
+func TestImpersonation(t *testing.T) {
+	agent := User{Username: "supportAgent", Phonenumber: "+15550130001", Roles: []string{SupportRole}}
+	member := User{Username: "plainMember", Phonenumber: "+15550130002", Roles: []string{"member"}}
+	target := User{Username: "impersonated", Phonenumber: "+15550130003"}
+	for _, user := range []*User{&agent, &member, &target} {
+		if err := user.Save(); err != nil {
+			t.Fatal("Failed to save user in the db: ", user.ToString())
+		}
+		defer removeUser(*user)
+	}
+	defer db.ExecWithCol(ImpersonationCollectionName, func(col *mgo.Collection) error {
+		_, err := col.RemoveAll(bson.M{"targetId": target.Id})
+		return err
+	})
+
+	// Roles must be held by the stored user
+	member.Roles = append(member.Roles, SupportRole)
+	if _, err := member.CreateImpersonationToken(&target, time.Hour); err != ErrNotSupportAgent {
+		t.Error("Expected non-support agent to be rejected, got: ", err)
+	}
+
+	token, err := agent.CreateImpersonationToken(&target, time.Hour)
+	if err != nil {
+		t.Fatal("Error encountered creating impersonation token: ", err)
+	}
+	resolvedAgent, resolvedTarget, err := ResolveImpersonation(token)
+	if err != nil {
+		t.Fatal("Error encountered resolving impersonation token: ", err)
+	}
+	if resolvedAgent.Id != agent.Id || resolvedTarget.Id != target.Id {
+		t.Error("Impersonation token resolved to the wrong users")
+	}
+
+	records, err := target.Impersonations()
+	if err != nil || len(records) != 1 || records[0].AgentId != agent.Id {
+		t.Error("Impersonation wasn't recorded: ", records, err)
+	}
+
+	expiring, err := agent.CreateImpersonationToken(&target, time.Millisecond)
+	if err != nil {
+		t.Fatal("Error encountered creating impersonation token: ", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if _, _, err := ResolveImpersonation(expiring); err != ErrInvalidImpersonation {
+		t.Error("Expected expired impersonation token to be rejected, got: ", err)
+	}
+	if _, _, err := ResolveImpersonation("not-a-token"); err != ErrInvalidImpersonation {
+		t.Error("Expected unknown impersonation token to be rejected, got: ", err)
+	}
+
+	// Disabling the agent ends their impersonations
+	if err := agent.Disable("admin", "left the support team"); err != nil {
+		t.Fatal("Error encountered disabling agent: ", err)
+	}
+	if _, _, err := ResolveImpersonation(token); err != ErrInvalidImpersonation {
+		t.Error("Expected disabled agent's impersonation token to be rejected, got: ", err)
+	}
+}
@@ -0,0 +1,28 @@
+// Listing of invited users who never completed their signup, for batches
+// resending their invites
+
+package users
+
+import (
+	"context"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// A query matching pending users who haven't completed their signup
+// Signup is complete once the user has set a password or verified their
+// email address, so Pending needn't be cleared for them to drop out.
+var pendingInviteQuery = bson.M{
+	"pending":       true,
+	"active":        bson.M{"$ne": false},
+	"password":      bson.M{"$in": []interface{}{"", nil}},
+	"emailVerified": bson.M{"$ne": true},
+}
+
+// Returns up to limit pending users, created on their behalf, who haven't
+// set a password or verified their email address yet, ordered by id
+// Soft deleted, erased and disabled users are excluded, and the limit is
+// normalized with NormalizePagination.
+func ListPendingInvites(limit int) ([]*User, error) {
+	return listMatchingUsersContext(context.Background(), pendingInviteQuery, 0, limit, "_id")
+}
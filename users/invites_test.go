@@ -0,0 +1,49 @@
+// Tests for listing pending invites
+
+package users
+
+import (
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestListPendingInvites(t *testing.T) {
+	invited := User{Username: "inviteOpen", Phonenumber: "+15550270001", Email: "open@example.com", Pending: true}
+	withPassword := User{Username: "inviteWithPassword", Phonenumber: "+15550270002", Pending: true}
+	if err := withPassword.SetPassword("correct horse battery"); err != nil {
+		t.Fatal("Failed to set password: ", err)
+	}
+	verified := User{Username: "inviteVerified", Phonenumber: "+15550270003", Email: "verified@example.com", EmailVerified: true, Pending: true}
+	signedUp := User{Username: "inviteSelfSignup", Phonenumber: "+15550270004"}
+	for _, user := range []*User{&invited, &withPassword, &verified, &signedUp} {
+		if err := user.Save(); err != nil {
+			t.Fatal("Failed to save user in the db: ", user.ToString())
+		}
+		defer removeUser(*user)
+	}
+
+	listed := func() map[bson.ObjectId]bool {
+		found, err := ListPendingInvites(MaxPageSize)
+		if err != nil {
+			t.Fatal("Error encountered listing pending invites: ", err)
+		}
+		ids := make(map[bson.ObjectId]bool)
+		for _, user := range found {
+			ids[user.Id] = true
+		}
+		return ids
+	}
+
+	ids := listed()
+	if !ids[invited.Id] || ids[withPassword.Id] || ids[verified.Id] || ids[signedUp.Id] {
+		t.Error("Expected only the pending invite to be listed")
+	}
+
+	if err := invited.Disable("admin", "invite revoked"); err != nil {
+		t.Fatal("Failed to disable user: ", err)
+	}
+	if listed()[invited.Id] {
+		t.Error("Expected disabled invites not to be listed")
+	}
+}
@@ -0,0 +1,70 @@
+// Authentication of users signing in with their username and password
+
+package users
+
+import (
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/njdup/func/db"
+	"github.com/njdup/func/utils/security"
+)
+
+// Returns the user of the default tenant with the given username if the
+// password matches theirs, recording the login time
+// Passwords flagged by MarkRehashNeeded, or whose hash predates the
+// configured pepper or algorithm, are transparently rehashed.
+// Returns ErrInvalidCredentials for unknown usernames, wrong passwords and
+// disabled users alike, so callers can't reveal which usernames exist. The
+// outcome is reported to Instrumentation.
+func Authenticate(username, password string) (User, error) {
+	user, err := FindWithUsername(username)
+	if err == mgo.ErrNotFound || (err == nil && (!user.PasswordsMatch(password) || !user.Active)) {
+		err = ErrInvalidCredentials
+	}
+	if err == nil {
+		err = user.recordLogin(time.Now(), password)
+	}
+	Instrumentation.IncLogin(err == nil)
+	if err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
+
+/*
+ * Helper Functions
+ */
+
+// Stores the given time as the user's last login, rehashing the verified
+// password if its hash needs upgrading
+// The password isn't changed by rehashing, so PasswordChangedAt is kept.
+func (user *User) recordLogin(now time.Time, password string) error {
+	if IsReadOnly() {
+		return nil // Logins aren't recorded during maintenance
+	}
+	set := bson.M{"lastLogin": now}
+	if user.RehashNeeded || security.NeedsUpgrade(user.PasswordHash) {
+		// Logins still succeed if rehashing fails, and retry on the next one
+		if hash, err := security.HashPassword(password); err == nil {
+			set["password"], set["rehashNeeded"] = hash, false
+		}
+	}
+	loginQuery := func(col *mgo.Collection) error {
+		return col.UpdateId(user.Id, touched(bson.M{"$set": set}, now))
+	}
+
+	if err := db.ExecWithCol(CollectionName, loginQuery); err != nil {
+		return err
+	}
+	cachedUsers.invalidate(user.Id)
+	if hash, ok := set["password"].(string); ok {
+		user.PasswordHash, user.RehashNeeded = hash, false
+	}
+	user.LastLogin = now
+	user.Updated = now
+	user.Version++
+	return nil
+}
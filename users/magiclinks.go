@@ -0,0 +1,107 @@
+// Passwordless login through one-time tokens sent to the user, typically
+// embedded in a "magic link"
+//
+// Only the hash of a token is stored, so a leaked users collection can't be
+// used to log in. Each user holds at most one pending token, which is
+// cleared as it is consumed.
+
+package users
+
+import (
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/njdup/func/db"
+	"github.com/njdup/func/utils/security"
+)
+
+// Returns a new login token for the user, valid for ttl and usable once
+// Generating a token replaces any token still pending for the user.
+// Returns ErrInvalidTokenTTL if ttl isn't positive, or ErrUserNotFound if the
+// user isn't stored.
+func (user *User) GenerateMagicLinkToken(ttl time.Duration) (string, error) {
+	if user == nil || user.Id == "" {
+		return "", ErrUserNotFound
+	}
+	if err := checkWritable(); err != nil {
+		return "", err
+	}
+	if ttl <= 0 {
+		return "", ErrInvalidTokenTTL
+	}
+	token, err := security.NewToken()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	set := bson.M{
+		"magicLinkHash":    security.HashToken(token),
+		"magicLinkExpires": now.Add(ttl),
+	}
+	storeQuery := func(col *mgo.Collection) error {
+		err := col.Update(liveQuery(bson.M{"_id": user.Id}), touched(bson.M{"$set": set}, now))
+		if err == mgo.ErrNotFound {
+			return ErrUserNotFound
+		}
+		return err
+	}
+
+	if err := db.ExecWithCol(CollectionName, storeQuery); err != nil {
+		return "", err
+	}
+	cachedUsers.invalidate(user.Id)
+	user.MagicLinkHash = set["magicLinkHash"].(string)
+	user.MagicLinkExpires = set["magicLinkExpires"].(time.Time)
+	user.Updated = now
+	user.Version++
+	return token, nil
+}
+
+// Logs in the user holding the given login token, consuming the token and
+// recording the login time
+// The token is cleared in the same operation that matches it, so concurrent
+// attempts to use it can't both succeed.
+// Returns ErrInvalidMagicLink if the token is unknown, used or expired, or
+// if its user was disabled.
+func ConsumeMagicLink(token string) (*User, error) {
+	if err := checkWritable(); err != nil {
+		return nil, err
+	}
+	if token == "" {
+		return nil, ErrInvalidMagicLink
+	}
+
+	now := time.Now()
+	user := new(User)
+	consumeQuery := func(col *mgo.Collection) error {
+		query := liveQuery(bson.M{
+			"magicLinkHash":    security.HashToken(token),
+			"magicLinkExpires": bson.M{"$gt": now},
+			"active":           bson.M{"$ne": false}, // Disabled users can't log in, see Disable
+		})
+		update := bson.M{
+			"$set":   bson.M{"lastLogin": now},
+			"$unset": bson.M{"magicLinkHash": "", "magicLinkExpires": ""},
+		}
+
+		var raw bson.Raw
+		change := mgo.Change{Update: touched(update, now), ReturnNew: true}
+		if _, err := col.Find(query).Apply(change, &raw); err == mgo.ErrNotFound {
+			return ErrInvalidMagicLink
+		} else if err != nil {
+			return err
+		}
+		return decodeUser(raw, user)
+	}
+
+	err := db.ExecWithCol(CollectionName, consumeQuery)
+	Instrumentation.IncLogin(err == nil)
+	if err != nil {
+		return nil, err
+	}
+	cachedUsers.invalidate(user.Id)
+	return user, nil
+}
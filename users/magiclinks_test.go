@@ -0,0 +1,58 @@
+// Tests for passwordless login tokens
+
+package users
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMagicLinks(t *testing.T) {
+	user := User{Username: "magicUser", Phonenumber: "+15550110001"}
+	if err := user.Save(); err != nil {
+		t.Fatal("Failed to save user in the db: ", user.ToString())
+	}
+	defer removeUser(user)
+
+	if _, err := user.GenerateMagicLinkToken(0); err != ErrInvalidTokenTTL {
+		t.Error("Expected ErrInvalidTokenTTL for a zero ttl, got: ", err)
+	}
+	token, err := user.GenerateMagicLinkToken(time.Hour)
+	if err != nil {
+		t.Fatal("Error encountered generating login token: ", err)
+	}
+
+	found, err := ConsumeMagicLink(token)
+	if err != nil {
+		t.Fatal("Error encountered consuming login token: ", err)
+	}
+	if found.Id != user.Id || found.LastLogin.IsZero() || found.MagicLinkHash != "" {
+		t.Error("Consuming login token didn't log in the user: ", found.ToString())
+	}
+
+	if _, err := ConsumeMagicLink(token); err != ErrInvalidMagicLink {
+		t.Error("Expected reused login token to be rejected, got: ", err)
+	}
+	if _, err := ConsumeMagicLink("not-a-token"); err != ErrInvalidMagicLink {
+		t.Error("Expected unknown login token to be rejected, got: ", err)
+	}
+
+	expiring, err := user.GenerateMagicLinkToken(time.Millisecond)
+	if err != nil {
+		t.Fatal("Error encountered generating login token: ", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if _, err := ConsumeMagicLink(expiring); err != ErrInvalidMagicLink {
+		t.Error("Expected expired login token to be rejected, got: ", err)
+	}
+
+	// Generating a token replaces the pending one
+	first, _ := user.GenerateMagicLinkToken(time.Hour)
+	second, _ := user.GenerateMagicLinkToken(time.Hour)
+	if _, err := ConsumeMagicLink(first); err != ErrInvalidMagicLink {
+		t.Error("Expected replaced login token to be rejected, got: ", err)
+	}
+	if _, err := ConsumeMagicLink(second); err != nil {
+		t.Error("Error encountered consuming latest login token: ", err)
+	}
+}
@@ -0,0 +1,79 @@
+// Minimal representations of users for @-mentions in chat and comments, so
+// those features never handle full user documents
+
+package users
+
+import (
+	"strings"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/njdup/func/db"
+)
+
+// The MentionView struct holds just what's needed to render a mention
+type MentionView struct {
+	Id          string `json:"id"` // Hex id of the user
+	Username    string `json:"userName"`
+	DisplayName string `json:"displayName"`
+}
+
+// The fields read to build mentions of stored users
+var mentionFields = bson.M{"userName": 1, "firstName": 1, "lastName": 1}
+
+// Returns the mention representation of the user
+// The display name is the user's full name, or their username if they have
+// no name set.
+func (user *User) Mention() MentionView {
+	if user == nil {
+		return MentionView{}
+	}
+	displayName := strings.TrimSpace(user.Firstname + " " + user.Lastname)
+	if displayName == "" {
+		displayName = user.Username
+	}
+	return MentionView{Id: user.Id.Hex(), Username: user.Username, DisplayName: displayName}
+}
+
+// Returns the mentions of the users with the given hex ids, in the order
+// their ids were given
+// Only the fields needed for mentions are read. Ids of users that aren't
+// stored are skipped, as are repeated ids. Returns ErrInvalidId if any id
+// isn't a valid hex id.
+func MentionsForIDs(hexIDs []string) ([]MentionView, error) {
+	ids := make([]bson.ObjectId, 0, len(hexIDs))
+	for _, hexID := range hexIDs {
+		if !bson.IsObjectIdHex(hexID) {
+			return nil, ErrInvalidId
+		}
+		ids = append(ids, bson.ObjectIdHex(hexID))
+	}
+
+	found := make(map[bson.ObjectId]*User, len(ids))
+	mentionQuery := func(col *mgo.Collection) error {
+		var raw bson.Raw
+		iter := col.Find(liveQuery(bson.M{"_id": bson.M{"$in": ids}})).Select(mentionFields).Iter()
+		for iter.Next(&raw) {
+			user := new(User)
+			if err := decodeUser(raw, user); err != nil {
+				iter.Close()
+				return err
+			}
+			found[user.Id] = user
+		}
+		return iter.Close()
+	}
+
+	if err := db.ExecWithCol(CollectionName, mentionQuery); err != nil {
+		return nil, err
+	}
+	result := make([]MentionView, 0, len(found))
+	for _, id := range ids {
+		if user, ok := found[id]; ok {
+			result = append(result, user.Mention())
+			delete(found, id)
+		}
+	}
+	return result, nil
+}
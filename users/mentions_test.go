@@ -0,0 +1,56 @@
+// Tests for the mention representation of users
+
+package users
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestMention(t *testing.T) {
+	user := User{Id: bson.NewObjectId(), Username: "mentioned", Firstname: "Ada", Lastname: "Lovelace", Phonenumber: "+15550230001", PasswordHash: "secret"}
+	mention := user.Mention()
+	expected := MentionView{Id: user.Id.Hex(), Username: "mentioned", DisplayName: "Ada Lovelace"}
+	if mention != expected {
+		t.Errorf("Expected mention %+v, got %+v", expected, mention)
+	}
+
+	encoded, _ := json.Marshal(mention)
+	var fields map[string]interface{}
+	json.Unmarshal(encoded, &fields)
+	if len(fields) != 3 {
+		t.Error("Expected mentions to hold only the id, username and display name: ", string(encoded))
+	}
+
+	if name := (&User{Username: "nameless"}).Mention().DisplayName; name != "nameless" {
+		t.Error("Expected users without a name to be displayed by username, got: ", name)
+	}
+}
+
+func TestMentionsForIDs(t *testing.T) {
+	first := User{Username: "mentionFirst", Phonenumber: "+15550230002", Firstname: "Grace", Lastname: "Hopper"}
+	second := User{Username: "mentionSecond", Phonenumber: "+15550230003"}
+	for _, user := range []*User{&first, &second} {
+		if err := user.Save(); err != nil {
+			t.Fatal("Failed to save user in the db: ", user.ToString())
+		}
+		defer removeUser(*user)
+	}
+
+	ids := []string{second.Id.Hex(), bson.NewObjectId().Hex(), first.Id.Hex(), second.Id.Hex()}
+	mentions, err := MentionsForIDs(ids)
+	if err != nil {
+		t.Fatal("Error encountered resolving mentions: ", err)
+	}
+	expected := []MentionView{second.Mention(), first.Mention()}
+	if !reflect.DeepEqual(mentions, expected) {
+		t.Errorf("Expected mentions %+v, got %+v", expected, mentions)
+	}
+
+	if _, err := MentionsForIDs([]string{"not-an-id"}); err != ErrInvalidId {
+		t.Error("Expected ErrInvalidId for an invalid id, got: ", err)
+	}
+}
@@ -0,0 +1,156 @@
+// Arbitrary key/value metadata stored on users, for small per-user flags
+// that don't warrant a schema change
+
+package users
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/njdup/func/db"
+	"github.com/njdup/func/utils/web"
+)
+
+var (
+	MaxMetadataEntries     = 32  // Largest number of metadata entries a user may hold
+	MaxMetadataKeyLength   = 64  // Longest metadata key, in bytes
+	MaxMetadataValueLength = 512 // Longest metadata value, in bytes
+)
+
+// Stores the given metadata entry for the user, replacing any previous value
+// Stored users have just that key updated, while unsaved users have their
+// metadata stored once they are saved. The cap on entries is enforced
+// against the stored metadata, so stale receivers and concurrent calls can't
+// exceed it.
+// Returns an InvalidFieldsError if the entry breaks the metadata limits, or
+// ErrUserNotFound if the user is no longer stored.
+func (user *User) SetMeta(key, value string) error {
+	if user == nil {
+		return ErrNilUser
+	}
+	if err := validateMetaEntry(key, value); err != nil {
+		return err
+	}
+	if _, ok := user.Metadata[key]; !ok && len(user.Metadata) >= MaxMetadataEntries {
+		return errTooManyMetadataEntries()
+	}
+
+	now := time.Now()
+	if user.Id != "" {
+		if err := checkWritable(); err != nil {
+			return err
+		}
+		setQuery := func(col *mgo.Collection) error {
+			// Replacing an entry always fits, adding one only below the cap
+			belowCap := bson.M{"$lt": []interface{}{
+				bson.M{"$size": bson.M{"$objectToArray": bson.M{"$ifNull": []interface{}{"$metadata", bson.M{}}}}},
+				MaxMetadataEntries,
+			}}
+			query := liveQuery(bson.M{
+				"_id": user.Id,
+				"$or": []bson.M{{"metadata." + key: bson.M{"$exists": true}}, {"$expr": belowCap}},
+			})
+			update := bson.M{"$set": bson.M{"metadata." + key: value}}
+			err := col.Update(query, touched(update, now))
+			if err != mgo.ErrNotFound {
+				return err
+			}
+			if count, err := col.Find(liveQuery(bson.M{"_id": user.Id})).Count(); err != nil {
+				return err
+			} else if count == 0 {
+				return ErrUserNotFound
+			}
+			return errTooManyMetadataEntries()
+		}
+		if err := db.ExecWithCol(CollectionName, setQuery); err != nil {
+			return err
+		}
+		cachedUsers.invalidate(user.Id)
+		user.Updated = now
+		user.Version++
+	}
+
+	if user.Metadata == nil {
+		user.Metadata = make(map[string]string)
+	}
+	user.Metadata[key] = value
+	return nil
+}
+
+// Returns the value of the given metadata entry for the user, and whether
+// the entry is set
+// Stored users have just that key read from the database, so the value is
+// current even if the receiver is stale. false is also returned if the value
+// can't be read.
+func (user *User) GetMeta(key string) (string, bool) {
+	if user == nil {
+		return "", false
+	}
+	if user.Id == "" {
+		value, ok := user.Metadata[key]
+		return value, ok
+	}
+
+	var stored struct {
+		Metadata map[string]string `bson:"metadata"`
+	}
+	getQuery := func(col *mgo.Collection) error {
+		return col.Find(liveQuery(bson.M{"_id": user.Id})).Select(bson.M{"metadata." + key: 1}).One(&stored)
+	}
+
+	if err := db.ExecWithCol(CollectionName, getQuery); err != nil {
+		return "", false
+	}
+	value, ok := stored.Metadata[key]
+	return value, ok
+}
+
+/*
+ * Helper Functions
+ */
+
+// Checks that the given metadata respects the limits on metadata entries
+// Returns an InvalidFieldsError for the first limit broken
+func validateMetadata(metadata map[string]string) error {
+	if len(metadata) > MaxMetadataEntries {
+		return errTooManyMetadataEntries()
+	}
+	for key, value := range metadata {
+		if err := validateMetaEntry(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Checks that the given metadata entry respects the length limits, and that
+// the key is usable as a mongo field name
+func validateMetaEntry(key, value string) error {
+	if key == "" || strings.ContainsAny(key, ".$") {
+		return metadataError("Metadata keys must be non-empty and cannot contain '.' or '$'")
+	}
+	if len(key) > MaxMetadataKeyLength {
+		return metadataError(fmt.Sprintf("Metadata keys cannot be longer than %d bytes", MaxMetadataKeyLength))
+	}
+	if len(value) > MaxMetadataValueLength {
+		return metadataError(fmt.Sprintf("Metadata values cannot be longer than %d bytes", MaxMetadataValueLength))
+	}
+	return nil
+}
+
+// Returns the error reported for users holding more than MaxMetadataEntries
+func errTooManyMetadataEntries() error {
+	return metadataError(fmt.Sprintf("Users may hold at most %d metadata entries", MaxMetadataEntries))
+}
+
+// Returns the error reported for metadata breaking the given rule
+func metadataError(message string) error {
+	return &web.InvalidFieldsError{
+		web.GeneralError{message},
+		[]string{"Metadata"},
+	}
+}
@@ -0,0 +1,107 @@
+// Tests for user metadata
+
+package users
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestMetadataLimits(t *testing.T) {
+	user := User{Username: "metaLimits", Phonenumber: "+15550030001"}
+
+	invalid := map[string]string{
+		"":           "empty key",
+		"dotted.key": "value",
+		"$key":       "value",
+		strings.Repeat("k", MaxMetadataKeyLength+1): "value",
+		"key": strings.Repeat("v", MaxMetadataValueLength+1),
+	}
+	for key, value := range invalid {
+		if err := user.SetMeta(key, value); err == nil {
+			t.Errorf("Metadata entry %q was accepted", key)
+		}
+	}
+	if len(user.Metadata) != 0 {
+		t.Error("Rejected metadata entries were stored: ", user.Metadata)
+	}
+
+	for i := 0; i < MaxMetadataEntries; i++ {
+		if err := user.SetMeta("flag"+strconv.Itoa(i), "on"); err != nil {
+			t.Fatal("Error encountered setting metadata: ", err)
+		}
+	}
+	if err := user.SetMeta("oneTooMany", "on"); err == nil {
+		t.Error("Metadata entry past the max number of entries was accepted")
+	}
+	if err := user.SetMeta("flag0", "off"); err != nil {
+		t.Error("Error encountered replacing metadata entry at the max number of entries: ", err)
+	}
+
+	// The cap holds against the stored entries, whatever the receiver holds
+	stored := User{Username: "metaStoredLimits", Phonenumber: "+15550030003"}
+	if err := stored.Save(); err != nil {
+		t.Fatal("Failed to save user in the db: ", stored.ToString())
+	}
+	defer removeUser(stored)
+	stale, err := FindWithUsername(stored.Username)
+	if err != nil {
+		t.Fatal("Failed to find user in the db: ", err)
+	}
+	for i := 0; i < MaxMetadataEntries; i++ {
+		if err := stored.SetMeta("flag"+strconv.Itoa(i), "on"); err != nil {
+			t.Fatal("Error encountered setting metadata: ", err)
+		}
+	}
+	if err := stale.SetMeta("oneTooMany", "on"); err == nil {
+		t.Error("Metadata entry past the stored max number of entries was accepted")
+	}
+	if _, ok := stored.GetMeta("oneTooMany"); ok {
+		t.Error("Metadata entry past the stored max number of entries was stored")
+	}
+	if err := stale.SetMeta("flag1", "off"); err != nil {
+		t.Error("Error encountered replacing stored metadata entry at the max number of entries: ", err)
+	}
+
+	// Save enforces the limits on metadata set directly
+	user.Metadata["oneTooMany"] = "on"
+	if err := user.Save(); err == nil {
+		removeUser(user)
+		t.Error("User with too many metadata entries was saved")
+	}
+}
+
+func TestMetadataRoundTrip(t *testing.T) {
+	user := User{Username: "metaRoundTrip", Phonenumber: "+15550030002"}
+	if err := user.SetMeta("beta", "enabled"); err != nil {
+		t.Fatal("Error encountered setting metadata on unsaved user: ", err)
+	}
+	if err := user.Save(); err != nil {
+		t.Fatal("Failed to save user in the db: ", user.ToString())
+	}
+	defer removeUser(user)
+
+	if err := user.SetMeta("theme", "dark"); err != nil {
+		t.Fatal("Error encountered setting metadata: ", err)
+	}
+
+	// Read through a stale copy, so values come from the database
+	stale, err := FindByID(user.Id.Hex())
+	if err != nil {
+		t.Fatal("Error encountered querying for user ", user.ToString())
+	}
+	if err := user.SetMeta("theme", "light"); err != nil {
+		t.Fatal("Error encountered replacing metadata: ", err)
+	}
+
+	expected := map[string]string{"beta": "enabled", "theme": "light"}
+	for key, value := range expected {
+		if found, ok := stale.GetMeta(key); !ok || found != value {
+			t.Errorf("Metadata %q read as %q, expected %q", key, found, value)
+		}
+	}
+	if _, ok := stale.GetMeta("missing"); ok {
+		t.Error("Unset metadata entry was found")
+	}
+}
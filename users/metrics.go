@@ -0,0 +1,66 @@
+// Instrumentation of user operations, reported through a pluggable Metrics
+// implementation so the package doesn't depend on a metrics library
+
+package users
+
+import (
+	"gopkg.in/mgo.v2"
+
+	"github.com/njdup/func/utils/web"
+)
+
+// Reasons passed to Metrics.IncSignupFailure
+const (
+	SignupFailureValidation = "validation" // The user's fields were rejected
+	SignupFailureDuplicate  = "duplicate"  // A unique field is held by another user
+	SignupFailureDatabase   = "database"   // The database couldn't be queried or written
+)
+
+// The Metrics interface receives counts of user operations, typically to
+// expose them as Prometheus style counters
+// Implementations must be safe for concurrent use.
+type Metrics interface {
+	IncSignup()                     // A new user was saved
+	IncSignupFailure(reason string) // Saving a new user failed, see the SignupFailure reasons
+	IncLogin(success bool)          // A login was attempted through Authenticate
+}
+
+// Receives the counts of user operations, which are dropped by default
+var Instrumentation Metrics = noopMetrics{}
+
+// The default Metrics implementation, dropping all counts
+type noopMetrics struct{}
+
+func (noopMetrics) IncSignup()              {}
+func (noopMetrics) IncSignupFailure(string) {}
+func (noopMetrics) IncLogin(bool)           {}
+
+/*
+ * Helper Functions
+ */
+
+// Reports the outcome of saving a new user with the given error
+// Failing hooks don't fail the signup, as the user is stored regardless
+func recordSignup(err error) {
+	if _, hookFailed := err.(*HookError); err == nil || hookFailed {
+		Instrumentation.IncSignup()
+		return
+	}
+	Instrumentation.IncSignupFailure(signupFailureReason(err))
+}
+
+// Returns the SignupFailure reason describing the given error from Save
+func signupFailureReason(err error) string {
+	if mgo.IsDup(err) || isDuplicateFieldError(err) {
+		return SignupFailureDuplicate
+	}
+	switch err := err.(type) {
+	case *web.InvalidFieldsError:
+		return SignupFailureValidation
+	case *web.GeneralError:
+		if err != ErrExistenceCheckFailed {
+			return SignupFailureValidation
+		}
+	}
+	return SignupFailureDatabase
+}
@@ -0,0 +1,98 @@
+// Tests for the instrumentation of user operations
+
+package users
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// Records the counts reported to it
+type spyMetrics struct {
+	mu             sync.Mutex
+	signups        int
+	signupFailures map[string]int
+	logins         map[bool]int
+}
+
+func newSpyMetrics() *spyMetrics {
+	return &spyMetrics{signupFailures: make(map[string]int), logins: make(map[bool]int)}
+}
+
+func (spy *spyMetrics) IncSignup() {
+	spy.mu.Lock()
+	defer spy.mu.Unlock()
+	spy.signups++
+}
+
+func (spy *spyMetrics) IncSignupFailure(reason string) {
+	spy.mu.Lock()
+	defer spy.mu.Unlock()
+	spy.signupFailures[reason]++
+}
+
+func (spy *spyMetrics) IncLogin(success bool) {
+	spy.mu.Lock()
+	defer spy.mu.Unlock()
+	spy.logins[success]++
+}
+
+func TestSignupMetrics(t *testing.T) {
+	spy := newSpyMetrics()
+	defer func(metrics Metrics) { Instrumentation = metrics }(Instrumentation)
+	Instrumentation = spy
+
+	user := User{Username: "metricsUser", Phonenumber: "+15550100001"}
+	if err := user.Save(); err != nil {
+		t.Fatal("Failed to save user in the db: ", user.ToString())
+	}
+	defer removeUser(user)
+
+	invalid := User{Username: "metricsInvalid"} // Missing phonenumber
+	invalid.Save()
+	duplicate := User{Username: "metricsUser", Phonenumber: "+15550100002"}
+	if err := duplicate.Save(); err == nil {
+		removeUser(duplicate)
+	}
+
+	if spy.signups != 1 {
+		t.Error("Expected one signup, got: ", spy.signups)
+	}
+	expected := map[string]int{SignupFailureValidation: 1, SignupFailureDuplicate: 1}
+	if !reflect.DeepEqual(spy.signupFailures, expected) {
+		t.Error("Unexpected signup failures: ", spy.signupFailures)
+	}
+	if reason := signupFailureReason(ErrExistenceCheckFailed); reason != SignupFailureDatabase {
+		t.Error("Failed existence check reported as: ", reason)
+	}
+}
+
+func TestLoginMetrics(t *testing.T) {
+	spy := newSpyMetrics()
+	defer func(metrics Metrics) { Instrumentation = metrics }(Instrumentation)
+	Instrumentation = spy
+
+	user := User{Username: "metricsLogin", Phonenumber: "+15550100003"}
+	if err := user.SetPassword("correct horse battery"); err != nil {
+		t.Fatal("Error encountered setting password: ", err)
+	}
+	if err := user.Save(); err != nil {
+		t.Fatal("Failed to save user in the db: ", user.ToString())
+	}
+	defer removeUser(user)
+
+	if found, err := Authenticate("metricsLogin", "correct horse battery"); err != nil || found.Id != user.Id {
+		t.Error("Error encountered authenticating user: ", err)
+	}
+	if _, err := Authenticate("metricsLogin", "wrong password"); err != ErrInvalidCredentials {
+		t.Error("Expected ErrInvalidCredentials for a wrong password, got: ", err)
+	}
+	if _, err := Authenticate("metricsNobody", "correct horse battery"); err != ErrInvalidCredentials {
+		t.Error("Expected ErrInvalidCredentials for an unknown user, got: ", err)
+	}
+
+	if expected := map[bool]int{true: 1, false: 2}; !reflect.DeepEqual(spy.logins, expected) {
+		t.Error("Unexpected logins: ", spy.logins)
+	}
+}
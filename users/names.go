@@ -0,0 +1,75 @@
+// Normalization of the case of user names, for deployments wanting names
+// stored consistently
+
+package users
+
+import (
+	"strings"
+	"unicode"
+)
+
+var (
+	// Title-cases first and last names in Save and Update when set, see
+	// NormalizeName
+	TitleCaseNames = false
+	// Name particles kept lowercase after the first word, as in "Ludwig van Beethoven"
+	// Add to or replace the set to configure it for a deployment
+	NameParticles = NewUsernameSet("van", "von", "der", "den", "de", "da", "del", "della", "di", "du", "la", "le")
+)
+
+// Returns the given name title-cased, so "mcdonald" becomes "McDonald" and
+// "mary-kate o'neil" becomes "Mary-Kate O'Neil"
+// Names mixing upper and lower case are returned as is, as their case was
+// likely chosen on purpose ("DeShawn"), and extra whitespace is dropped.
+func NormalizeName(name string) string {
+	words := strings.Fields(name)
+	joined := strings.Join(words, " ")
+	if joined != strings.ToLower(joined) && joined != strings.ToUpper(joined) {
+		return joined
+	}
+
+	for i, word := range words {
+		word = strings.ToLower(word)
+		if i > 0 && NameParticles.Contains(word) {
+			words[i] = word
+			continue
+		}
+		words[i] = titleCaseWord(word)
+	}
+	return strings.Join(words, " ")
+}
+
+/*
+ * Helper Functions
+ */
+
+// Title-cases the first and last names of the user in place, if
+// TitleCaseNames is set
+func normalizeUserNames(user *User) {
+	if !TitleCaseNames {
+		return
+	}
+	user.Firstname = NormalizeName(user.Firstname)
+	user.Lastname = NormalizeName(user.Lastname)
+}
+
+// Title-cases the given lowercase word, capitalizing each part separated by
+// a hyphen or apostrophe, and the letter following a "Mc" prefix
+func titleCaseWord(word string) string {
+	runes := []rune(word)
+	capitalizeNext := true
+	for i, r := range runes {
+		if capitalizeNext && unicode.IsLetter(r) {
+			runes[i] = unicode.ToUpper(r)
+			capitalizeNext = false
+		}
+		if r == '-' || r == '\'' || r == '’' {
+			capitalizeNext = true
+		}
+	}
+
+	if len(runes) > 2 && runes[0] == 'M' && runes[1] == 'c' && unicode.IsLetter(runes[2]) {
+		runes[2] = unicode.ToUpper(runes[2])
+	}
+	return string(runes)
+}
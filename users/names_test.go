@@ -0,0 +1,43 @@
+// Tests for the normalization of user names
+
+package users
+
+import (
+	"testing"
+)
+
+func TestNormalizeName(t *testing.T) {
+	names := map[string]string{
+		"mcdonald":             "McDonald",
+		"MCDONALD":             "McDonald",
+		"o'neil":               "O'Neil",
+		"smith-jones":          "Smith-Jones",
+		"mary-kate o'brien":    "Mary-Kate O'Brien",
+		"  mary   ann  ":       "Mary Ann",
+		"ludwig van beethoven": "Ludwig van Beethoven",
+		"van halen":            "Van Halen",
+		"DeShawn":              "DeShawn", // Mixed case is kept
+		"mack":                 "Mack",
+		"":                     "",
+	}
+	for name, expected := range names {
+		if normalized := NormalizeName(name); normalized != expected {
+			t.Errorf("Expected %q to normalize to %q, got %q", name, expected, normalized)
+		}
+	}
+}
+
+func TestNameNormalizationOption(t *testing.T) {
+	user := User{Firstname: "jean-luc", Lastname: "o'connor"}
+	normalizeUserNames(&user)
+	if user.Firstname != "jean-luc" || user.Lastname != "o'connor" {
+		t.Error("Names changed with the option off: ", user.ToString())
+	}
+
+	defer func(enabled bool) { TitleCaseNames = enabled }(TitleCaseNames)
+	TitleCaseNames = true
+	normalizeUserNames(&user)
+	if user.Firstname != "Jean-Luc" || user.Lastname != "O'Connor" {
+		t.Error("Names not title-cased with the option on: ", user.ToString())
+	}
+}
@@ -0,0 +1,58 @@
+// Pagination shared by the functions listing users
+
+package users
+
+import (
+	"context"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	DefaultPageSize = 50  // Number of users listed when no limit is given
+	MaxPageSize     = 500 // Largest number of users listed at once
+
+	// The fields users may be sorted by, mapped to the indexed keys they
+	// sort on, see ListUsersSorted
+	sortFields = map[string]string{
+		"username":  "usernameLower",
+		"inserted":  "inserted",
+		"lastLogin": "lastLogin",
+		"lastName":  "lastName",
+	}
+)
+
+// Returns the given offset and limit clamped to usable values
+// Negative offsets are treated as 0, non-positive limits are replaced with
+// DefaultPageSize and limits above MaxPageSize are capped
+func NormalizePagination(offset, limit int) (int, int) {
+	if offset < 0 {
+		offset = 0
+	}
+	if limit <= 0 {
+		limit = DefaultPageSize
+	}
+	if limit > MaxPageSize {
+		limit = MaxPageSize
+	}
+	return offset, limit
+}
+
+// Returns up to limit users sorted by the given field, skipping the first
+// offset users
+// The field must be one of username (ignoring case), inserted, lastLogin or
+// lastName, each backed by an index, see EnsureIndexes. Users sharing a
+// value are ordered by id, so pages are stable across calls. The page is
+// normalized with NormalizePagination. Returns ErrUnknownSortField for any
+// other field.
+func ListUsersSorted(sortField string, ascending bool, offset, limit int) ([]*User, error) {
+	key, ok := sortFields[sortField]
+	if !ok {
+		return nil, ErrUnknownSortField
+	}
+	sort := []string{key, "_id"}
+	if !ascending {
+		sort = []string{"-" + key, "-_id"}
+	}
+	return listMatchingUsersContext(context.Background(), bson.M{}, offset, limit, sort...)
+}
@@ -0,0 +1,93 @@
+// Tests for pagination of user listings
+
+package users
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestNormalizePagination(t *testing.T) {
+	cases := []struct {
+		offset, limit                 int
+		expectedOffset, expectedLimit int
+	}{
+		{-5, 10, 0, 10},
+		{0, -1, 0, DefaultPageSize},
+		{0, 0, 0, DefaultPageSize},
+		{20, 10, 20, 10},
+		{0, MaxPageSize, 0, MaxPageSize},
+		{3, MaxPageSize + 1, 3, MaxPageSize},
+		{-1, 0, 0, DefaultPageSize},
+	}
+
+	for _, c := range cases {
+		offset, limit := NormalizePagination(c.offset, c.limit)
+		if offset != c.expectedOffset || limit != c.expectedLimit {
+			t.Errorf("NormalizePagination(%d, %d) = (%d, %d), expected (%d, %d)",
+				c.offset, c.limit, offset, limit, c.expectedOffset, c.expectedLimit)
+		}
+	}
+}
+
+func TestListUsersSorted(t *testing.T) {
+	now := time.Now()
+	seeded := []*User{
+		{Username: "sortCharlie", Phonenumber: "+15550370001", Lastname: "Adams", LastLogin: now.Add(-time.Hour)},
+		{Username: "sortAlpha", Phonenumber: "+15550370002", Lastname: "Carter", LastLogin: now.Add(-3 * time.Hour)},
+		{Username: "SORTBRAVO", Phonenumber: "+15550370003", Lastname: "Baker", LastLogin: now.Add(-2 * time.Hour)},
+	}
+	for _, user := range seeded {
+		if err := user.Save(); err != nil {
+			t.Fatal("Failed to save user in the db: ", user.ToString())
+		}
+		defer removeUser(*user)
+	}
+	charlie, alpha, bravo := seeded[0].Id, seeded[1].Id, seeded[2].Id
+
+	// Returns the order the seeded users were listed in
+	listed := func(field string, ascending bool) []bson.ObjectId {
+		found, err := ListUsersSorted(field, ascending, 0, MaxPageSize)
+		if err != nil {
+			t.Fatalf("Error encountered listing users by %s: %v", field, err)
+		}
+		order := make([]bson.ObjectId, 0, len(seeded))
+		for _, user := range found {
+			for _, seededUser := range seeded {
+				if user.Id == seededUser.Id {
+					order = append(order, user.Id)
+				}
+			}
+		}
+		return order
+	}
+
+	expected := map[string][]bson.ObjectId{
+		"username":  {alpha, bravo, charlie},
+		"inserted":  {charlie, alpha, bravo},
+		"lastLogin": {alpha, bravo, charlie},
+		"lastName":  {charlie, bravo, alpha},
+	}
+	for field, order := range expected {
+		ascending := listed(field, true)
+		descending := listed(field, false)
+		for i := range order {
+			if len(ascending) != len(order) || ascending[i] != order[i] {
+				t.Errorf("Expected users sorted by %s to be %v, got %v", field, order, ascending)
+				break
+			}
+			if len(descending) != len(order) || descending[len(order)-1-i] != order[i] {
+				t.Errorf("Expected users sorted by %s descending to be reversed, got %v", field, descending)
+				break
+			}
+		}
+	}
+
+	for _, field := range []string{"password", "userName", "lastName; drop", ""} {
+		if _, err := ListUsersSorted(field, true, 0, 10); err != ErrUnknownSortField {
+			t.Errorf("Expected ErrUnknownSortField sorting by %q, got: %v", field, err)
+		}
+	}
+}
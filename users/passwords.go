@@ -0,0 +1,342 @@
+// Management of stored user passwords, such as migrating hashes
+// to a stronger bcrypt cost
+
+package users
+
+import (
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/njdup/func/db"
+	"github.com/njdup/func/utils/security"
+)
+
+// Counts the users whose stored password hash uses a bcrypt cost
+// below targetCost, or predates the configured password pepper or algorithm
+func CountUsersNeedingRehash(targetCost int) (int, error) {
+	count := 0
+	countBatch := func(col *mgo.Collection, ids []bson.ObjectId) error {
+		count += len(ids)
+		return nil
+	}
+
+	err := db.ExecWithCol(CollectionName, func(col *mgo.Collection) error {
+		return eachRehashBatch(col, targetCost, countBatch)
+	})
+	return count, err
+}
+
+// Flags every user whose password hash uses a bcrypt cost below targetCost,
+// or predates the configured password pepper or algorithm, so their password
+// is rehashed on their next login, see Authenticate
+// Returns the number of users newly flagged
+func MarkRehashNeeded(targetCost int) (int, error) {
+	if err := checkWritable(); err != nil {
+		return 0, err
+	}
+	marked := 0
+	markBatch := func(col *mgo.Collection, ids []bson.ObjectId) error {
+		info, err := col.UpdateAll(
+			bson.M{"_id": bson.M{"$in": ids}, "rehashNeeded": bson.M{"$ne": true}},
+			touched(bson.M{"$set": bson.M{"rehashNeeded": true}}, time.Now()),
+		)
+		if err != nil {
+			return err
+		}
+		marked += info.Updated
+		return nil
+	}
+
+	err := db.ExecWithCol(CollectionName, func(col *mgo.Collection) error {
+		return eachRehashBatch(col, targetCost, markBatch)
+	})
+	if marked != 0 {
+		cachedUsers.clear() // Earlier batches were flagged even if a later one failed
+	}
+	return marked, err
+}
+
+var (
+	// Number of previous passwords, besides the current one, users can't
+	// reuse when setting a password, disabled when zero
+	PasswordHistorySize = 0
+
+	// Reports whether the given password appears in known data breaches, such
+	// as by querying a breach corpus, disabled when nil
+	// Errors are returned by the password checks rather than accepting the
+	// password unchecked.
+	PasswordBreached func(password string) (bool, error)
+
+	// Rejects passwords containing or closely matching the username, or the
+	// local part of the email address, when set
+	RejectPasswordsLikeUsername = false
+	// Largest edit distance between a password and username considered too close
+	MaxUsernameSimilarity = 2
+	// Usernames and email local parts shorter than this are too generic to
+	// compare passwords against
+	minSimilarityUsernameLength = 3
+
+	// Number of users flagged per update by MarkRehashNeeded
+	rehashBatchSize = 1000
+
+	// Seam for tests, ending every session of the user once their password
+	// changed
+	revokeSessions = (*User).RevokeAllSessions
+)
+
+// Checks whether the given password would be accepted as the user's new
+// password, without setting it, so forms can give feedback as it is typed
+// The checks run in order: the password policy, similarity to the username
+// and email address, PasswordBreached and the user's password history.
+// Returns the error of the first check failed, such as
+// ErrUnacceptablePassword, ErrPasswordLikeUsername, ErrPasswordBreached or
+// ErrPasswordReused.
+func (user *User) WouldAcceptPassword(password string) error {
+	if user == nil {
+		return ErrNilUser
+	}
+	if !security.PasswordPolicy.PasswordValid(password) {
+		return ErrUnacceptablePassword
+	}
+	if err := user.checkPasswordSimilarity(password); err != nil {
+		return err
+	}
+	if PasswordBreached != nil {
+		breached, err := PasswordBreached(password)
+		if err != nil {
+			return err
+		}
+		if breached {
+			return ErrPasswordBreached
+		}
+	}
+	return user.checkPasswordHistory(password)
+}
+
+// Checks whether the given password is too similar to the user's username
+// or the local part of their email address, such as "alice123" for the user
+// alice or alice@example.com
+// Returns ErrPasswordLikeUsername if RejectPasswordsLikeUsername is set and
+// the password contains, is contained in, or closely matches either of them
+func (user *User) checkPasswordSimilarity(password string) error {
+	if !RejectPasswordsLikeUsername {
+		return nil
+	}
+
+	identifiers := []string{user.Username}
+	if at := strings.LastIndex(user.Email, "@"); at > 0 {
+		identifiers = append(identifiers, user.Email[:at])
+	}
+	loweredPassword := strings.ToLower(password)
+	for _, identifier := range identifiers {
+		if len(identifier) < minSimilarityUsernameLength {
+			continue
+		}
+		lowered := strings.ToLower(identifier)
+		if strings.Contains(loweredPassword, lowered) ||
+			strings.Contains(lowered, loweredPassword) ||
+			editDistance(loweredPassword, lowered) <= MaxUsernameSimilarity {
+			return ErrPasswordLikeUsername
+		}
+	}
+	return nil
+}
+
+// Replaces the stored user's password, once their current password is
+// confirmed
+// The new password must pass every check of SetPassword, and a pending
+// MustChangePassword flag is cleared. Once the password is stored, every
+// session of the user is revoked and the OnPasswordChanged hooks are run,
+// even if revoking the sessions failed. A failed revocation is returned as
+// a HookError, in its RevokeError, as are the hooks' failures if HookPolicy
+// reports them. Returns ErrInvalidCredentials if the current password
+// doesn't match, or ErrUserNotFound if the user isn't stored.
+func (user *User) ChangePassword(currentPassword, newPassword string) error {
+	if user == nil || user.Id == "" {
+		return ErrUserNotFound
+	}
+	if err := checkWritable(); err != nil {
+		return err
+	}
+	if !user.PasswordsMatch(currentPassword) {
+		return ErrInvalidCredentials
+	}
+	if err := user.SetPassword(newPassword); err != nil {
+		return err
+	}
+	if err := user.storePassword(); err != nil {
+		return err
+	}
+	return user.passwordStored()
+}
+
+// Sets a password for the user on behalf of an administrator, such as a
+// temporary password handed out by support staff
+// The password policy is enforced as in SetPassword, but the user's current
+// password isn't needed. When mustChange is set the user is flagged to change
+// the password on their next login. Stored users are updated in place, have
+// their sessions revoked and the OnPasswordChanged hooks run, see
+// ChangePassword, while unsaved users have the password stored once they
+// are saved.
+// Returns ErrUserNotFound if the user is no longer stored.
+func (user *User) AdminSetPassword(newPassword string, mustChange bool) error {
+	if user != nil && user.Id != "" {
+		if err := checkWritable(); err != nil {
+			return err
+		}
+	}
+	if err := user.SetPassword(newPassword); err != nil {
+		return err
+	}
+	user.MustChangePassword = mustChange
+	if user.Id == "" {
+		return nil
+	}
+	if err := user.storePassword(); err != nil {
+		return err
+	}
+	return user.passwordStored()
+}
+
+// Checks whether the user's password is older than the given max age, so
+// auth flows can force the user to change it
+// Passwords set before PasswordChangedAt was tracked are of unknown age and
+// count as expired. A max age of zero or less never expires passwords, and
+// users without a password have nothing to expire.
+func (user *User) PasswordExpired(maxAge time.Duration) bool {
+	if user == nil || user.PasswordHash == "" || maxAge <= 0 {
+		return false
+	}
+	if user.PasswordChangedAt.IsZero() {
+		return true
+	}
+	return time.Since(user.PasswordChangedAt) > maxAge
+}
+
+/*
+ * Helper Functions
+ */
+
+// Revokes every session of the user and runs the OnPasswordChanged hooks,
+// once their new password is stored
+// The hooks run even if revoking the sessions failed, as the password did
+// change. Returns a HookError holding the failures of the hooks and, in
+// RevokeError, of revoking the sessions, which is reported regardless of
+// HookPolicy.
+func (user *User) passwordStored() error {
+	revokeErr := revokeSessions(user)
+	err := runHooks(passwordChangedHooks, user)
+	if revokeErr == nil {
+		return err
+	}
+	hookErr, ok := err.(*HookError)
+	if !ok {
+		hookErr = &HookError{}
+	}
+	hookErr.RevokeError = revokeErr
+	return hookErr
+}
+
+// Stores the user's password fields, as set by SetPassword, in place
+// Returns ErrUserNotFound if the user is no longer stored.
+func (user *User) storePassword() error {
+	now := time.Now()
+	set := bson.M{
+		"password":           user.PasswordHash,
+		"rehashNeeded":       false,
+		"passwordChangedAt":  user.PasswordChangedAt,
+		"mustChangePassword": user.MustChangePassword,
+		"passwordHistory":    user.PasswordHistory,
+	}
+	update := bson.M{"$set": set}
+	if user.PasswordFingerprint != "" {
+		set["passwordFingerprint"] = user.PasswordFingerprint
+	} else {
+		update["$unset"] = bson.M{"passwordFingerprint": ""}
+	}
+	storeQuery := func(col *mgo.Collection) error {
+		err := col.Update(liveQuery(bson.M{"_id": user.Id}), touched(update, now))
+		if err == mgo.ErrNotFound {
+			return ErrUserNotFound
+		}
+		return err
+	}
+
+	if err := db.ExecWithCol(CollectionName, storeQuery); err != nil {
+		return err
+	}
+	cachedUsers.invalidate(user.Id)
+	user.Updated = now
+	user.Version++
+	return nil
+}
+
+// Checks whether the given password is the user's current password or one
+// of the previous passwords kept in their history
+// Returns ErrPasswordReused if PasswordHistorySize is set and it is
+func (user *User) checkPasswordHistory(password string) error {
+	if PasswordHistorySize <= 0 {
+		return nil
+	}
+	hashes := append([]string{user.PasswordHash}, user.PasswordHistory...)
+	if len(hashes) > PasswordHistorySize+1 {
+		hashes = hashes[:PasswordHistorySize+1]
+	}
+	for _, hash := range hashes {
+		if hash != "" && security.ConfirmPassword(hash, password) {
+			return ErrPasswordReused
+		}
+	}
+	return nil
+}
+
+// Returns the given password history with the replaced password hash added,
+// trimmed to PasswordHistorySize
+func pushPasswordHistory(history []string, replaced string) []string {
+	if PasswordHistorySize <= 0 || replaced == "" {
+		return history
+	}
+	history = append([]string{replaced}, history...)
+	if len(history) > PasswordHistorySize {
+		history = history[:PasswordHistorySize]
+	}
+	return history
+}
+
+// Streams the ids of users with a password hash weaker than targetCost, or
+// predating the configured password pepper or algorithm, to handle in
+// batches of up to rehashBatchSize ids, so memory use stays flat and
+// updates stay within the BSON document size limit
+// Users without a password, or with an unreadable hash, are skipped.
+func eachRehashBatch(col *mgo.Collection, targetCost int, handle func(*mgo.Collection, []bson.ObjectId) error) error {
+	var stored struct {
+		Id           bson.ObjectId `bson:"_id"`
+		PasswordHash string        `bson:"password"`
+	}
+	query := bson.M{"password": bson.M{"$exists": true, "$ne": ""}}
+	iter := col.Find(query).Select(bson.M{"password": 1}).Iter()
+	batch := make([]bson.ObjectId, 0, rehashBatchSize)
+	for iter.Next(&stored) {
+		cost, err := security.HashCost(stored.PasswordHash)
+		if !security.NeedsUpgrade(stored.PasswordHash) && (err != nil || cost >= targetCost) {
+			continue
+		}
+		if batch = append(batch, stored.Id); len(batch) == rehashBatchSize {
+			if err := handle(col, batch); err != nil {
+				iter.Close()
+				return err
+			}
+			batch = batch[:0]
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+	if len(batch) == 0 {
+		return nil
+	}
+	return handle(col, batch)
+}
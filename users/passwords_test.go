@@ -0,0 +1,335 @@
+// Tests for the management of stored user passwords
+
+package users
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/njdup/func/utils/security"
+)
+
+func TestPasswordRehashMigration(t *testing.T) {
+	targetCost := bcrypt.MinCost + 2
+	baseline, err := CountUsersNeedingRehash(targetCost)
+	if err != nil {
+		t.Fatal("Error encountered counting users needing rehash: ", err)
+	}
+
+	seeded := []struct {
+		user User
+		cost int
+	}{
+		{User{Username: "rehashWeak", Phonenumber: "+15550004001"}, bcrypt.MinCost},
+		{User{Username: "rehashWeaker", Phonenumber: "+15550004002"}, bcrypt.MinCost + 1},
+		{User{Username: "rehashStrong", Phonenumber: "+15550004003"}, targetCost},
+	}
+	for _, seed := range seeded {
+		hash, err := bcrypt.GenerateFromPassword([]byte("password"), seed.cost)
+		if err != nil {
+			t.Fatal("Error encountered hashing password: ", err)
+		}
+		user := seed.user
+		user.PasswordHash = string(hash)
+		if err := user.Save(); err != nil {
+			t.Fatal("Failed to save user in the db: ", user.ToString())
+		}
+		defer removeUser(user)
+	}
+
+	if count, err := CountUsersNeedingRehash(targetCost); err != nil || count-baseline != 2 {
+		t.Errorf("Expected 2 seeded users needing rehash, got %d (err %v)", count-baseline, err)
+	}
+
+	// Flag the weak users across several batches
+	defer func(size int) { rehashBatchSize = size }(rehashBatchSize)
+	rehashBatchSize = 1
+	marked, err := MarkRehashNeeded(targetCost)
+	if err != nil {
+		t.Fatal("Error encountered marking users for rehash: ", err)
+	}
+	if marked < 2 {
+		t.Error("Expected the weak users to be marked, marked: ", marked)
+	}
+	if again, _ := MarkRehashNeeded(targetCost); again != 0 {
+		t.Error("Already flagged users were marked again: ", again)
+	}
+
+	for _, seed := range seeded {
+		found, err := FindWithUsername(seed.user.Username)
+		if err != nil {
+			t.Fatal("Error encountered querying for user ", seed.user.ToString())
+		}
+		if expected := seed.cost < targetCost; found.RehashNeeded != expected {
+			t.Errorf("User %s has rehashNeeded %v, expected %v", found.Username, found.RehashNeeded, expected)
+		}
+	}
+}
+
+func TestPasswordUsernameSimilarity(t *testing.T) {
+	user := User{Username: "Alice"}
+
+	// The check is off by default
+	if err := user.SetPassword("alice123"); err != nil {
+		t.Error("Password rejected with the similarity check disabled: ", err)
+	}
+
+	defer func(enabled bool) { RejectPasswordsLikeUsername = enabled }(RejectPasswordsLikeUsername)
+	RejectPasswordsLikeUsername = true
+
+	for _, password := range []string{"alice123", "ALICE!", "xalicex", "alicf1", "ecila-alice"} {
+		if err := user.SetPassword(password); err != ErrPasswordLikeUsername {
+			t.Errorf("Expected password %q to be rejected for %s, got: %v", password, user.Username, err)
+		}
+	}
+
+	if err := user.SetPassword("correct horse battery"); err != nil {
+		t.Error("Unrelated password was rejected: ", err)
+	}
+	if !user.PasswordsMatch("correct horse battery") {
+		t.Error("Accepted password wasn't stored")
+	}
+
+	// The local part of the email address is compared as well
+	user.Email = "bobsmith@example.com"
+	for _, password := range []string{"bobsmith99", "BOBSMITH", "bobsmitty"} {
+		if err := user.SetPassword(password); err != ErrPasswordLikeUsername {
+			t.Errorf("Expected password %q to be rejected for %s, got: %v", password, user.Email, err)
+		}
+	}
+	if err := user.WouldAcceptPassword("bobsmith!"); err != ErrPasswordLikeUsername {
+		t.Error("Expected password like the email address to be rejected, got: ", err)
+	}
+	if err := user.SetPassword("example staple battery"); err != nil {
+		t.Error("Password containing the email domain was rejected: ", err)
+	}
+}
+
+func TestPasswordExpired(t *testing.T) {
+	maxAge := 90 * 24 * time.Hour
+	user := User{Username: "expiring"}
+	if user.PasswordExpired(maxAge) {
+		t.Error("User without a password reported an expired password")
+	}
+
+	if err := user.SetPassword("correct horse battery"); err != nil {
+		t.Fatal("Error encountered setting password: ", err)
+	}
+	if user.PasswordExpired(maxAge) {
+		t.Error("Recently changed password reported as expired")
+	}
+
+	user.PasswordChangedAt = time.Now().Add(-maxAge - time.Hour)
+	if !user.PasswordExpired(maxAge) {
+		t.Error("Stale password not reported as expired")
+	}
+	if user.PasswordExpired(0) {
+		t.Error("Password expired without a max age")
+	}
+
+	user.PasswordChangedAt = time.Time{}
+	if !user.PasswordExpired(maxAge) {
+		t.Error("Password of unknown age not reported as expired")
+	}
+}
+
+func TestAdminSetPassword(t *testing.T) {
+	user := User{Username: "adminReset", Phonenumber: "+15550004101"}
+	if err := user.SetPassword("original password"); err != nil {
+		t.Fatal("Error encountered setting password: ", err)
+	}
+	if err := user.Save(); err != nil {
+		t.Fatal("Failed to save user in the db: ", user.ToString())
+	}
+	defer removeUser(user)
+
+	if err := user.AdminSetPassword("short", true); err == nil {
+		t.Error("Temporary password bypassed the password policy")
+	}
+	if err := user.AdminSetPassword("temporary password", true); err != nil {
+		t.Fatal("Error encountered resetting password: ", err)
+	}
+
+	found, err := FindByID(user.Id.Hex())
+	if err != nil {
+		t.Fatal("Error encountered querying for user ", user.ToString())
+	}
+	if !found.MustChangePassword {
+		t.Error("Reset user isn't required to change their password")
+	}
+	if !found.PasswordsMatch("temporary password") || found.PasswordsMatch("original password") {
+		t.Error("Temporary password wasn't stored")
+	}
+
+	// Changing the password clears the flag
+	if err := found.SetPassword("chosen password"); err != nil {
+		t.Fatal("Error encountered setting password: ", err)
+	}
+	if found.MustChangePassword {
+		t.Error("Changed password still required to be changed")
+	}
+}
+
+func TestPasswordChangedHooks(t *testing.T) {
+	defer func(hooks []Hook) { passwordChangedHooks = hooks }(passwordChangedHooks)
+	var notified []bson.ObjectId
+	OnPasswordChanged(func(changed *User) error {
+		notified = append(notified, changed.Id)
+		return nil
+	})
+
+	user := User{Username: "passwordNotified", Phonenumber: "+15550004102"}
+	if err := user.SetPassword("original password"); err != nil {
+		t.Fatal("Error encountered setting password: ", err)
+	}
+	if err := user.Save(); err != nil {
+		t.Fatal("Failed to save user in the db: ", user.ToString())
+	}
+	defer removeUser(user)
+	if len(notified) != 0 {
+		t.Error("Expected no notification for the password of a new user")
+	}
+
+	// Rejected changes aren't notified
+	if err := user.ChangePassword("wrong password", "chosen password"); err != ErrInvalidCredentials {
+		t.Error("Expected ErrInvalidCredentials for a wrong current password, got: ", err)
+	}
+	if err := user.ChangePassword("original password", "short"); err == nil {
+		t.Error("New password bypassed the password policy")
+	}
+	if err := user.AdminSetPassword("short", true); err == nil {
+		t.Error("Temporary password bypassed the password policy")
+	}
+	if len(notified) != 0 {
+		t.Error("Expected no notification for rejected changes, got: ", len(notified))
+	}
+
+	if err := user.ChangePassword("original password", "chosen password"); err != nil {
+		t.Fatal("Error encountered changing password: ", err)
+	}
+	if len(notified) != 1 || notified[0] != user.Id {
+		t.Error("Expected one notification for the changed password, got: ", notified)
+	}
+	found, _ := FindByID(user.Id.Hex())
+	if !found.PasswordsMatch("chosen password") {
+		t.Error("Changed password wasn't stored")
+	}
+
+	if err := user.AdminSetPassword("temporary password", true); err != nil {
+		t.Fatal("Error encountered resetting password: ", err)
+	}
+	if len(notified) != 2 {
+		t.Error("Expected one notification for the reset password, got: ", len(notified)-1)
+	}
+
+	// Failing to revoke sessions doesn't hide the stored change from hooks
+	defer func(revoke func(*User) error) { revokeSessions = revoke }(revokeSessions)
+	revokeFailure := errors.New("sessions unavailable")
+	revokeSessions = func(*User) error { return revokeFailure }
+	err := user.ChangePassword("temporary password", "another password")
+	if hookErr, ok := err.(*HookError); !ok || hookErr.RevokeError != revokeFailure || len(hookErr.Errors) != 0 {
+		t.Error("Expected a HookError holding the revocation failure, got: ", err)
+	}
+	if len(notified) != 3 {
+		t.Error("Expected hooks to run despite the revocation failure, got: ", len(notified)-2)
+	}
+	if found, _ := FindByID(user.Id.Hex()); !found.PasswordsMatch("another password") {
+		t.Error("Changed password wasn't stored")
+	}
+}
+
+// Ensures logging in upgrades hashes of another algorithm than the configured one
+func TestPasswordAlgorithmUpgrade(t *testing.T) {
+	defer func(algorithm string) { security.PasswordAlgorithm = algorithm }(security.PasswordAlgorithm)
+	security.PasswordAlgorithm = security.AlgorithmBcrypt
+
+	user := User{Username: "upgradedUser", Phonenumber: "+15550004201"}
+	if err := user.SetPassword("correct horse battery"); err != nil {
+		t.Fatal("Error encountered setting password: ", err)
+	}
+	if err := user.Save(); err != nil {
+		t.Fatal("Failed to save user in the db: ", user.ToString())
+	}
+	defer removeUser(user)
+
+	security.PasswordAlgorithm = security.AlgorithmArgon2id
+	if _, err := Authenticate("upgradedUser", "wrong password"); err != ErrInvalidCredentials {
+		t.Error("Expected ErrInvalidCredentials for a wrong password, got: ", err)
+	}
+	if found, _ := FindByID(user.Id.Hex()); security.HashAlgorithm(found.PasswordHash) != security.AlgorithmBcrypt {
+		t.Error("Failed login upgraded the password hash")
+	}
+
+	if _, err := Authenticate("upgradedUser", "correct horse battery"); err != nil {
+		t.Fatal("Error encountered authenticating with a bcrypt hash: ", err)
+	}
+	found, err := FindByID(user.Id.Hex())
+	if err != nil {
+		t.Fatal("Error encountered querying for user ", user.ToString())
+	}
+	if security.HashAlgorithm(found.PasswordHash) != security.AlgorithmArgon2id {
+		t.Error("Login didn't upgrade the password hash: ", found.PasswordHash)
+	}
+	if !found.PasswordChangedAt.Equal(user.PasswordChangedAt.Truncate(time.Millisecond)) {
+		t.Error("Upgrading the hash changed the password change time")
+	}
+	if _, err := Authenticate("upgradedUser", "correct horse battery"); err != nil {
+		t.Error("Error encountered authenticating with the upgraded hash: ", err)
+	}
+}
+
+func TestWouldAcceptPassword(t *testing.T) {
+	PasswordHistorySize, RejectPasswordsLikeUsername = 2, true
+	PasswordBreached = func(password string) (bool, error) {
+		return password == "breached123", nil
+	}
+	defer func() {
+		PasswordHistorySize, RejectPasswordsLikeUsername, PasswordBreached = 0, false, nil
+	}()
+
+	user := User{Username: "charlotte", Phonenumber: "+15550180001"}
+	for _, password := range []string{"firstSecret1", "secondSecret2", "thirdSecret3"} {
+		if err := user.SetPassword(password); err != nil {
+			t.Fatal("Error encountered setting password: ", err)
+		}
+	}
+	if len(user.PasswordHistory) != 2 {
+		t.Error("Expected history to hold the two replaced passwords, got: ", len(user.PasswordHistory))
+	}
+
+	rejected := map[string]error{
+		"abc":           ErrUnacceptablePassword,
+		"charlotte42":   ErrPasswordLikeUsername,
+		"breached123":   ErrPasswordBreached,
+		"thirdSecret3":  ErrPasswordReused, // Current password
+		"secondSecret2": ErrPasswordReused,
+		"firstSecret1":  ErrPasswordReused,
+	}
+	hash := user.PasswordHash
+	for password, expected := range rejected {
+		if err := user.WouldAcceptPassword(password); err != expected {
+			t.Errorf("Expected %q to be rejected with %v, got: %v", password, expected, err)
+		}
+	}
+	if err := user.WouldAcceptPassword("freshSecret4"); err != nil {
+		t.Error("Expected unused password to be accepted, got: ", err)
+	}
+	if user.PasswordHash != hash {
+		t.Error("Checking passwords changed the user's password")
+	}
+
+	// Passwords older than the history may be reused
+	if err := user.SetPassword("fourthSecret4"); err != nil {
+		t.Fatal("Error encountered setting password: ", err)
+	}
+	if err := user.WouldAcceptPassword("firstSecret1"); err != nil {
+		t.Error("Expected password older than the history to be accepted, got: ", err)
+	}
+	if err := user.SetPassword("secondSecret2"); err != ErrPasswordReused {
+		t.Error("Expected SetPassword to reject a reused password, got: ", err)
+	}
+}
@@ -0,0 +1,85 @@
+// Claims on phonenumbers held while a user verifies them with an external
+// provider, so two verification flows for the same number can't both succeed
+//
+// Claims are held in their own collection, keyed by the normalized number
+// (or its hash when PhonePrivacy is enabled), so the unique _id index
+// decides races between simultaneous claims. Claims lapse after
+// PhoneClaimTTL, and are then removed through a TTL index, see EnsureIndexes.
+
+package users
+
+import (
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/njdup/func/db"
+)
+
+var (
+	PhoneClaimCollectionName = "phoneClaims"    // Name of the collection holding phonenumber claims
+	PhoneClaimTTL            = 15 * time.Minute // How long a claim holds its phonenumber
+)
+
+// Claims the given phonenumber for the user, for PhoneClaimTTL
+// The claim is a single conditional upsert, which takes over expired claims
+// and renews the user's own claim, but fails against another user's live
+// claim. Returns ErrInvalidPhonenumber if the number can't be normalized,
+// ErrDuplicatePhone if another stored user has the number, or
+// ErrPhoneClaimed if another user claimed it first.
+func ClaimPhone(phone string, user *User) error {
+	if user == nil {
+		return ErrNilUser
+	}
+	if user.Id == "" {
+		return ErrUserNotFound
+	}
+	if err := checkWritable(); err != nil {
+		return err
+	}
+	normalized, err := NormalizePhonenumber(phone)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	claimQuery := func(col *mgo.Collection) error {
+		query := phoneQuery(normalized)
+		query["_id"] = bson.M{"$ne": user.Id}
+		if count, err := col.Find(liveQuery(query)).Count(); err != nil {
+			return err
+		} else if count != 0 {
+			return ErrDuplicatePhone
+		}
+
+		claim := bson.M{
+			"_id": phoneClaimKey(normalized),
+			"$or": []bson.M{
+				{"userId": user.Id},
+				{"expires": bson.M{"$lte": now}},
+			},
+		}
+		update := bson.M{"$set": bson.M{"userId": user.Id, "claimed": now, "expires": now.Add(PhoneClaimTTL)}}
+		_, err := col.Database.C(PhoneClaimCollectionName).Upsert(claim, update)
+		if mgo.IsDup(err) {
+			return ErrPhoneClaimed // The live claim of another user didn't match
+		}
+		return err
+	}
+
+	return db.ExecWithCol(CollectionName, claimQuery)
+}
+
+/*
+ * Helper Functions
+ */
+
+// Returns the key claims on the given normalized phonenumber are stored
+// under, its hash when PhonePrivacy is enabled
+func phoneClaimKey(normalized string) string {
+	if PhonePrivacy.Enabled {
+		return hashPhonenumber(normalized)
+	}
+	return normalized
+}
@@ -0,0 +1,63 @@
+// Tests for claims on phonenumbers held during verification
+
+package users
+
+import (
+	"sync"
+	"testing"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/njdup/func/db"
+)
+
+func TestConcurrentPhoneClaims(t *testing.T) {
+	defer db.ExecWithCol(PhoneClaimCollectionName, func(col *mgo.Collection) error {
+		_, err := col.RemoveAll(bson.M{"_id": "+15550220001"})
+		return err
+	})
+
+	claimants := []*User{{Id: bson.NewObjectId()}, {Id: bson.NewObjectId()}}
+	errs := make([]error, len(claimants))
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i, user := range claimants {
+		wg.Add(1)
+		go func(i int, user *User) {
+			defer wg.Done()
+			<-start
+			errs[i] = ClaimPhone("(555) 022-0001", user)
+		}(i, user)
+	}
+	close(start)
+	wg.Wait()
+
+	winner := -1
+	for i, err := range errs {
+		switch err {
+		case nil:
+			if winner >= 0 {
+				t.Fatal("Both concurrent claims succeeded")
+			}
+			winner = i
+		case ErrPhoneClaimed:
+		default:
+			t.Fatal("Error encountered claiming phonenumber: ", err)
+		}
+	}
+	if winner < 0 {
+		t.Fatal("Neither concurrent claim succeeded")
+	}
+
+	// The winner may renew their claim, while the loser stays locked out
+	if err := ClaimPhone("+15550220001", claimants[winner]); err != nil {
+		t.Error("Expected the winner to renew their claim, got: ", err)
+	}
+	if err := ClaimPhone("+15550220001", claimants[1-winner]); err != ErrPhoneClaimed {
+		t.Error("Expected the loser's claim to be rejected, got: ", err)
+	}
+	if err := ClaimPhone("not a number", claimants[0]); err != ErrInvalidPhonenumber {
+		t.Error("Expected ErrInvalidPhonenumber for an invalid number, got: ", err)
+	}
+}
@@ -0,0 +1,353 @@
+// Handling of user phone numbers, including normalization into E.164 form
+// (e.g. +18889991234) and verification
+
+package users
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/njdup/func/db"
+	"github.com/njdup/func/utils/security"
+)
+
+var (
+	// Country calling code assumed for numbers given without one
+	DefaultCountryCode = "1"
+
+	// Configures storing phonenumbers as keyed hashes, disabled by default
+	PhonePrivacy = PhonePrivacyConfig{}
+
+	MinPhoneSuffixLength  = 4  // Fewest digits FindByPhoneSuffix matches on
+	MaxPhoneSuffixMatches = 50 // Largest number of users FindByPhoneSuffix returns
+)
+
+// The PhonePrivacyConfig struct configures storing phonenumbers as keyed
+// hashes (HMAC) used for uniqueness checks and lookups
+// Enabling it on a deployment with existing users requires backfilling their
+// phoneHash field. With OmitPlaintext set, stored users can no longer have
+// their phonenumber displayed, so only enable it where that is acceptable.
+type PhonePrivacyConfig struct {
+	Enabled       bool
+	Key           []byte // Secret HMAC key, must stay stable for lookups to work
+	OmitPlaintext bool   // Don't persist the plaintext phonenumber at all
+}
+
+// Converts the given phone number into E.164 form
+// Common formatting characters (spaces, dashes, dots, parentheses) are
+// ignored, and numbers without a country code are assumed to be in
+// DefaultCountryCode. Returns ErrInvalidPhonenumber if the number can't be
+// converted.
+func NormalizePhonenumber(phonenumber string) (string, error) {
+	digits := stripPhoneFormatting(phonenumber)
+
+	international := false
+	if strings.HasPrefix(digits, "+") {
+		digits, international = digits[1:], true
+	} else if strings.HasPrefix(digits, "00") {
+		digits, international = digits[2:], true
+	}
+
+	for _, r := range digits {
+		if r < '0' || r > '9' {
+			return "", ErrInvalidPhonenumber
+		}
+	}
+
+	if !international {
+		// Local numbers are ten digits in the default (North American) plan
+		switch {
+		case len(digits) == 10:
+			digits = DefaultCountryCode + digits
+		case len(digits) == 10+len(DefaultCountryCode) && strings.HasPrefix(digits, DefaultCountryCode):
+		default:
+			return "", ErrInvalidPhonenumber
+		}
+	}
+
+	// E.164 allows at most 15 digits, and no country has numbers shorter than 8
+	if len(digits) < 8 || len(digits) > 15 || digits[0] == '0' {
+		return "", ErrInvalidPhonenumber
+	}
+	return "+" + digits, nil
+}
+
+// Flags the user owning the given phone number as having verified it,
+// typically after a callback from the SMS provider
+// The number is normalized first, so formatted input still matches
+// Returns ErrUserNotFound if no user owns the number
+func MarkPhoneVerified(phonenumber string) error {
+	if err := checkWritable(); err != nil {
+		return err
+	}
+	normalized, err := NormalizePhonenumber(phonenumber)
+	if err != nil {
+		return err
+	}
+
+	verifyQuery := func(col *mgo.Collection) error {
+		update := bson.M{"$set": bson.M{"phoneVerified": true}}
+		return col.Update(phoneQuery(normalized), touched(update, time.Now()))
+	}
+
+	err = db.ExecWithCol(CollectionName, verifyQuery)
+	if err == mgo.ErrNotFound {
+		return ErrUserNotFound
+	} else if err == nil {
+		cachedUsers.clear() // The verified user's id isn't known
+	}
+	return err
+}
+
+// Finds the users whose phonenumber ends in the given digits, for support
+// agents who only know the last few digits of a user's number
+// Stored numbers are matched on their digits alone, so formatting in either
+// the stored number or the suffix doesn't interfere, as it wouldn't in their
+// E.164 form. At most MaxPhoneSuffixMatches users are returned. Users whose
+// plaintext number isn't stored, see PhonePrivacy, are never matched.
+// Returns ErrInvalidPhoneSuffix if the suffix has fewer than
+// MinPhoneSuffixLength digits or holds anything but digits and formatting.
+func FindByPhoneSuffix(suffix string) ([]*User, error) {
+	digits, err := phoneSuffixDigits(suffix)
+	if err != nil {
+		return nil, err
+	}
+	query := bson.M{"phoneNumber": bson.RegEx{Pattern: phoneSuffixPattern(digits)}}
+	return listMatchingUsersContext(context.Background(), query, 0, MaxPhoneSuffixMatches, "_id")
+}
+
+// Rewrites the stored phonenumbers of live users into E.164 form, for
+// numbers stored before they were normalized
+// Returns the number of users updated, and the hex ids of users left
+// unchanged because their number couldn't be normalized or because the
+// normalized number is held by another user. Such collisions are also
+// reported as a PhoneCollisionError, once every other user was processed.
+// Users whose plaintext number isn't stored, see PhonePrivacy, are left
+// unchanged.
+func NormalizeAllPhones() (updated int, skipped []string, err error) {
+	if err := checkWritable(); err != nil {
+		return 0, nil, err
+	}
+	skipped = make([]string, 0)
+	var collisions []string
+	normalizeQuery := func(col *mgo.Collection) error {
+		var stored struct {
+			Id          bson.ObjectId `bson:"_id"`
+			Phonenumber string        `bson:"phoneNumber"`
+		}
+		query := liveQuery(bson.M{"phoneNumber": bson.M{"$nin": []interface{}{"", nil}}})
+		iter := col.Find(query).Select(bson.M{"phoneNumber": 1}).Iter()
+		for iter.Next(&stored) {
+			normalized, err := NormalizePhonenumber(stored.Phonenumber)
+			if err != nil {
+				skipped = append(skipped, stored.Id.Hex())
+				continue
+			}
+			if normalized == stored.Phonenumber {
+				continue
+			}
+
+			changed, err := setNormalizedPhone(col, stored.Id, stored.Phonenumber, normalized)
+			if err == ErrDuplicatePhone {
+				skipped = append(skipped, stored.Id.Hex())
+				collisions = append(collisions, stored.Id.Hex())
+				continue
+			} else if err != nil {
+				iter.Close()
+				return err
+			}
+			if changed {
+				updated++
+			}
+		}
+		return iter.Close()
+	}
+
+	err = db.ExecWithCol(CollectionName, normalizeQuery)
+	if updated != 0 {
+		cachedUsers.clear()
+	}
+	if err == nil && len(collisions) != 0 {
+		err = &PhoneCollisionError{Ids: collisions}
+	}
+	return updated, skipped, err
+}
+
+// Replaces the usernames of live users that hold a phonenumber, as stored
+// by old signups, with one made by the given generator
+// Generated usernames already taken in the user's tenant, or failing
+// ValidateUsername, get a numeric suffix until they are free, so they never
+// collide. Returns the number of users renamed, or ErrEmptyGeneratedUsername
+// if the generator returned an empty username.
+func FixPhoneInUsername(generate func(*User) string) (int, error) {
+	if err := checkWritable(); err != nil {
+		return 0, err
+	}
+	renamed := 0
+	fixQuery := func(col *mgo.Collection) error {
+		var legacy []*User
+		var raw bson.Raw
+		query := liveQuery(bson.M{"userName": bson.RegEx{Pattern: `^[+0-9 ().\t-]+$`}})
+		iter := col.Find(query).Iter()
+		for iter.Next(&raw) {
+			user := new(User)
+			if err := decodeUser(raw, user); err != nil {
+				iter.Close()
+				return err
+			}
+			if _, err := NormalizePhonenumber(user.Username); err == nil && looksLikePhonenumber(user.Username) {
+				legacy = append(legacy, user)
+			}
+		}
+		if err := iter.Close(); err != nil {
+			return err
+		}
+
+		for _, user := range legacy {
+			base := strings.TrimSpace(generate(user.Clone()))
+			if base == "" {
+				return ErrEmptyGeneratedUsername
+			}
+			username, err := uniqueUsername(col, user.TenantID, base)
+			if err != nil {
+				return err
+			}
+
+			previous := user.Username
+			user.Username = username
+			set := bson.M{
+				"userName":      username,
+				"usernameLower": strings.ToLower(username),
+				"searchName":    searchNameFor(user),
+			}
+			err = col.Update(bson.M{"_id": user.Id, "userName": previous}, touched(bson.M{"$set": set}, time.Now()))
+			if err == mgo.ErrNotFound {
+				continue // Renamed since it was read
+			} else if err != nil {
+				return duplicateKeyError(err)
+			}
+			renamed++
+		}
+		return nil
+	}
+
+	err := db.ExecWithCol(CollectionName, fixQuery)
+	if renamed != 0 {
+		cachedUsers.clear()
+	}
+	return renamed, err
+}
+
+/*
+ * Helper Functions
+ */
+
+// Returns the given username, or the first of it with a numeric suffix
+// appended, that is valid and not taken in the tenant
+func uniqueUsername(col *mgo.Collection, tenantID, base string) (string, error) {
+	candidate := base
+	for suffix := 2; ; suffix++ {
+		if ValidateUsername(candidate) == nil {
+			count, err := countMatches(col, usernameQuery(tenantID, candidate))
+			if err != nil {
+				return "", err
+			}
+			if count == 0 {
+				return candidate, nil
+			}
+		}
+		candidate = base + strconv.Itoa(suffix)
+	}
+}
+
+// Replaces the stored phonenumber of the user with its normalized form,
+// unless the number changed since it was read
+// Returns whether the user was updated, or ErrDuplicatePhone if another user
+// holds the normalized number
+func setNormalizedPhone(col *mgo.Collection, id bson.ObjectId, phonenumber, normalized string) (bool, error) {
+	count, err := col.Find(bson.M{"phoneNumber": normalized, "_id": bson.M{"$ne": id}}).Count()
+	if err != nil {
+		return false, err
+	}
+	if count != 0 {
+		return false, ErrDuplicatePhone
+	}
+
+	update := bson.M{"$set": bson.M{"phoneNumber": normalized}}
+	err = col.Update(bson.M{"_id": id, "phoneNumber": phonenumber}, touched(update, time.Now()))
+	if err == mgo.ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, duplicateKeyError(err)
+	}
+	return true, nil
+}
+
+// Returns the digits of the given phonenumber suffix, dropping formatting
+func phoneSuffixDigits(suffix string) (string, error) {
+	digits := stripPhoneFormatting(suffix)
+
+	for _, r := range digits {
+		if r < '0' || r > '9' {
+			return "", ErrInvalidPhoneSuffix
+		}
+	}
+	if len(digits) < MinPhoneSuffixLength {
+		return "", ErrInvalidPhoneSuffix
+	}
+	return digits, nil
+}
+
+// Normalizes the user's phonenumber in place to E.164 form, so numbers are
+// stored as MarkPhoneVerified and ClaimPhone look them up
+// Numbers that can't be normalized are kept as given, as are the stored
+// numbers of users saved before they were normalized, see NormalizeAllPhones.
+func normalizeUserPhone(user *User) {
+	if normalized, err := NormalizePhonenumber(user.Phonenumber); err == nil {
+		user.Phonenumber = normalized
+	}
+}
+
+// Drops the common formatting characters (spaces, dashes, dots, parentheses)
+// from the given phonenumber
+func stripPhoneFormatting(phonenumber string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '-', '.', '(', ')', '\t':
+			return -1
+		}
+		return r
+	}, strings.TrimSpace(phonenumber))
+}
+
+// Returns a pattern matching stored phonenumbers whose digits end in the
+// given digits, whatever formatting the number was stored with
+func phoneSuffixPattern(digits string) string {
+	parts := strings.Split(digits, "")
+	return strings.Join(parts, "[^0-9]*") + "[^0-9]*$"
+}
+
+// Returns a query matching the user with the given phonenumber, by its hash
+// when PhonePrivacy is enabled
+func phoneQuery(phonenumber string) bson.M {
+	if PhonePrivacy.Enabled {
+		return bson.M{"phoneHash": hashPhonenumber(phonenumber)}
+	}
+	return bson.M{"phoneNumber": phonenumber}
+}
+
+// Returns the keyed hash stored for the given phonenumber
+// Numbers are normalized first where possible, so differently formatted
+// input for the same number hashes identically
+func hashPhonenumber(phonenumber string) string {
+	if normalized, err := NormalizePhonenumber(phonenumber); err == nil {
+		phonenumber = normalized
+	}
+	return security.KeyedHash(PhonePrivacy.Key, phonenumber)
+}
@@ -0,0 +1,276 @@
+// Tests for phone number handling
+
+package users
+
+import (
+	"strings"
+	"testing"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/njdup/func/db"
+)
+
+func TestNormalizePhonenumber(t *testing.T) {
+	valid := map[string]string{
+		"+18889991234":      "+18889991234",
+		"(888) 999-1234":    "+18889991234",
+		"888.999.1234":      "+18889991234",
+		"1 888 999 1234":    "+18889991234",
+		"+44 20 7946 0958":  "+442079460958",
+		"0044 20 7946 0958": "+442079460958",
+	}
+	for raw, expected := range valid {
+		normalized, err := NormalizePhonenumber(raw)
+		if err != nil || normalized != expected {
+			t.Errorf("Normalizing %q gave %q (err %v), expected %q", raw, normalized, err, expected)
+		}
+	}
+
+	for _, raw := range []string{"", "12345", "+1800OLDDUDE", "999-1234", "+1234567890123456"} {
+		if _, err := NormalizePhonenumber(raw); err != ErrInvalidPhonenumber {
+			t.Errorf("Expected %q to be rejected, got: %v", raw, err)
+		}
+	}
+}
+
+func TestMarkPhoneVerified(t *testing.T) {
+	user := User{Username: "verifyPhoneUser", Phonenumber: "+15550006001"}
+	other := User{Username: "unverifiedPhoneUser", Phonenumber: "+15550006002"}
+	for _, u := range []*User{&user, &other} {
+		if err := u.Save(); err != nil {
+			t.Fatal("Failed to save user in the db: ", u.ToString())
+		}
+		defer removeUser(*u)
+	}
+
+	// The provider may report the number in a different format
+	if err := MarkPhoneVerified("(555) 000-6001"); err != nil {
+		t.Fatal("Error encountered marking phone verified: ", err)
+	}
+
+	if found, _ := FindWithUsername(user.Username); !found.PhoneVerified {
+		t.Error("Phone wasn't flagged as verified for ", user.ToString())
+	}
+	if found, _ := FindWithUsername(other.Username); found.PhoneVerified {
+		t.Error("Phone was flagged as verified for the wrong user ", other.ToString())
+	}
+
+	if err := MarkPhoneVerified("+15550006999"); err != ErrUserNotFound {
+		t.Error("Expected unknown number to return ErrUserNotFound, got: ", err)
+	}
+}
+
+func TestHashedPhonenumbers(t *testing.T) {
+	defer func(config PhonePrivacyConfig) { PhonePrivacy = config }(PhonePrivacy)
+	PhonePrivacy = PhonePrivacyConfig{Enabled: true, Key: []byte("test-key"), OmitPlaintext: true}
+
+	user := User{Username: "hashedPhoneUser", Phonenumber: "+15550008001"}
+	if err := user.Save(); err != nil {
+		t.Fatal("Failed to save user in the db: ", user.ToString())
+	}
+	defer db.ExecWithCol(CollectionName, func(col *mgo.Collection) error {
+		return col.RemoveId(user.Id)
+	})
+
+	var stored bson.M
+	db.ExecWithCol(CollectionName, func(col *mgo.Collection) error {
+		return col.FindId(user.Id).One(&stored)
+	})
+	if _, ok := stored["phoneNumber"]; ok {
+		t.Error("Plaintext phonenumber was persisted in hashed mode: ", stored)
+	}
+	if stored["phoneHash"] != hashPhonenumber(user.Phonenumber) {
+		t.Error("Phonenumber hash wasn't persisted: ", stored)
+	}
+
+	found, err := FindWithPhonenumber("(555) 000-8001")
+	if err != nil || found.Id != user.Id {
+		t.Error("Error encountered finding user by hashed phonenumber: ", err)
+	}
+
+	dupPhone := User{Username: "hashedPhoneDup", Phonenumber: user.Phonenumber}
+	if err := dupPhone.Save(); err == nil {
+		db.ExecWithCol(CollectionName, func(col *mgo.Collection) error {
+			return col.RemoveId(dupPhone.Id)
+		})
+		t.Error("Error not encountered saving duplicate hashed phonenumber")
+	}
+}
+
+func TestFindByPhoneSuffix(t *testing.T) {
+	matching := []*User{
+		{Username: "suffixFormatted", Phonenumber: "(555) 016-8642"},
+		{Username: "suffixSpaced", Phonenumber: "+1 556 016 8642"},
+		{Username: "suffixE164", Phonenumber: "+15570168642"},
+	}
+	other := &User{Username: "suffixOther", Phonenumber: "+15550168643"}
+	for _, user := range append(matching, other) {
+		if err := user.Save(); err != nil {
+			t.Fatal("Failed to save user in the db: ", user.ToString())
+		}
+		defer removeUser(*user)
+	}
+
+	for _, suffix := range []string{"8642", "016-8642", " 0168642"} {
+		found, err := FindByPhoneSuffix(suffix)
+		if err != nil {
+			t.Fatal("Error encountered finding users by phone suffix: ", err)
+		}
+		ids := make(map[bson.ObjectId]bool)
+		for _, user := range found {
+			ids[user.Id] = true
+		}
+		for _, user := range matching {
+			if !ids[user.Id] {
+				t.Errorf("Suffix %q didn't match %q", suffix, user.Phonenumber)
+			}
+		}
+		if ids[other.Id] {
+			t.Errorf("Suffix %q matched %q", suffix, other.Phonenumber)
+		}
+	}
+
+	for _, suffix := range []string{"", "642", "86a2"} {
+		if _, err := FindByPhoneSuffix(suffix); err != ErrInvalidPhoneSuffix {
+			t.Errorf("Expected ErrInvalidPhoneSuffix for %q, got: %v", suffix, err)
+		}
+	}
+}
+
+func TestNormalizeAllPhones(t *testing.T) {
+	normalized := User{Username: "phoneNormalized", Phonenumber: "+15550170001"}
+	normalizable := User{Username: "phoneFormatted", Phonenumber: "(555) 017-0002"}
+	unparseable := User{Username: "phoneBroken", Phonenumber: "call me maybe"}
+	holder := User{Username: "phoneHolder", Phonenumber: "+15550170003"}
+	colliding := User{Username: "phoneColliding", Phonenumber: "555.017.0003"}
+	for _, user := range []*User{&normalized, &unparseable, &holder} {
+		if err := user.Save(); err != nil {
+			t.Fatal("Failed to save user in the db: ", user.ToString())
+		}
+		defer removeUser(*user)
+	}
+	// Save normalizes numbers, so formatted ones are only held by older users
+	for _, user := range []*User{&normalizable, &colliding} {
+		user.Id = bson.NewObjectId()
+		legacy := bson.M{
+			"_id":           user.Id,
+			"userName":      user.Username,
+			"usernameLower": strings.ToLower(user.Username),
+			"phoneNumber":   user.Phonenumber,
+		}
+		if err := db.ExecWithCol(CollectionName, func(col *mgo.Collection) error { return col.Insert(legacy) }); err != nil {
+			t.Fatal("Failed to insert legacy document: ", err)
+		}
+		defer removeUser(*user)
+	}
+
+	updated, skipped, err := NormalizeAllPhones()
+	collision, ok := err.(*PhoneCollisionError)
+	if !ok {
+		t.Fatal("Expected the colliding number to be reported, got: ", err)
+	}
+	if !containsString(collision.Ids, colliding.Id.Hex()) || containsString(collision.Ids, unparseable.Id.Hex()) {
+		t.Error("Collision reported for the wrong users: ", collision.Ids)
+	}
+	if updated < 1 {
+		t.Error("Expected the formatted number to be updated, got: ", updated)
+	}
+	if !containsString(skipped, unparseable.Id.Hex()) || !containsString(skipped, colliding.Id.Hex()) {
+		t.Error("Expected unparseable and colliding users to be skipped, got: ", skipped)
+	}
+
+	expected := map[*User]string{
+		&normalized:   "+15550170001",
+		&normalizable: "+15550170002",
+		&unparseable:  "call me maybe",
+		&colliding:    "555.017.0003",
+	}
+	for user, phonenumber := range expected {
+		stored, err := FindByID(user.Id.Hex())
+		if err != nil || stored.Phonenumber != phonenumber {
+			t.Errorf("Expected %s to hold %q, got %q (err %v)", user.Username, phonenumber, stored.Phonenumber, err)
+		}
+	}
+}
+
+// Ensures Save stores numbers as the phonenumber lookups expect them
+func TestSaveNormalizesPhone(t *testing.T) {
+	user := User{Username: "phoneSaveFormatted", Phonenumber: "(555) 123-4567"}
+	if err := user.Save(); err != nil {
+		t.Fatal("Failed to save user in the db: ", user.ToString())
+	}
+	defer removeUser(user)
+	if user.Phonenumber != "+15551234567" {
+		t.Error("Expected the saved number to be normalized, got: ", user.Phonenumber)
+	}
+
+	if err := MarkPhoneVerified("555-123-4567"); err != nil {
+		t.Fatal("Error encountered verifying the saved number: ", err)
+	}
+	found, err := FindWithPhonenumber("(555) 123 4567")
+	if err != nil || found.Id != user.Id || !found.PhoneVerified {
+		t.Errorf("Expected formatted lookup to find the verified user, got %v (err %v)", found.ToString(), err)
+	}
+}
+
+func TestFixPhoneInUsername(t *testing.T) {
+	defer func(enabled bool) { RejectPlaceholderSignups = enabled }(RejectPlaceholderSignups)
+	RejectPlaceholderSignups = false
+
+	taken := User{Username: "legacyMember", Phonenumber: "+15550310001"}
+	first := User{Username: "+15550310002", Phonenumber: "+15550310002"}
+	second := User{Username: "(555) 031-0003", Phonenumber: "+15550310003"}
+	digits := User{Username: "31003", Phonenumber: "+15550310004"}
+	regular := User{Username: "legacy99", Phonenumber: "+15550310005"}
+	for _, user := range []*User{&taken, &first, &second, &digits, &regular} {
+		if err := user.Save(); err != nil {
+			t.Fatal("Failed to save user in the db: ", user.ToString())
+		}
+		defer removeUser(*user)
+	}
+
+	var generated []bson.ObjectId
+	renamed, err := FixPhoneInUsername(func(user *User) string {
+		generated = append(generated, user.Id)
+		return "legacyMember"
+	})
+	if err != nil {
+		t.Fatal("Error encountered fixing usernames: ", err)
+	}
+	if renamed < 2 || len(generated) != renamed {
+		t.Errorf("Expected both legacy users to be renamed once, got %d renamed and %d generated", renamed, len(generated))
+	}
+
+	usernames := make(map[string]bool)
+	for _, user := range []User{first, second} {
+		stored, err := FindByID(user.Id.Hex())
+		if err != nil {
+			t.Fatal("Error encountered querying for user ", user.ToString())
+		}
+		if stored.Username == "legacyMember" || !strings.HasPrefix(stored.Username, "legacyMember") || usernames[stored.Username] {
+			t.Error("Expected a new unique username, got: ", stored.Username)
+		}
+		usernames[stored.Username] = true
+	}
+	for _, user := range []User{taken, digits, regular} {
+		if stored, _ := FindByID(user.Id.Hex()); stored.Username != user.Username {
+			t.Errorf("Expected %s to keep their username, got %s", user.Username, stored.Username)
+		}
+	}
+
+	if _, err := FixPhoneInUsername(func(*User) string { return "" }); err != nil {
+		t.Error("Expected no legacy users to be left, got: ", err)
+	}
+}
+
+// Checks whether the list holds the given value
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,213 @@
+// Handling of users' personal data for privacy requests, such as GDPR
+// subject-access requests
+
+package users
+
+import (
+	"encoding/json"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/njdup/func/db"
+)
+
+// Version of the PersonalDataExport schema, bumped on any incompatible change
+const PersonalDataSchemaVersion = 1
+
+// The PersonalDataExport struct defines the document handed to a user
+// requesting all data held on them
+// Schema (version 1):
+//
+//	schemaVersion       number, see PersonalDataSchemaVersion
+//	id                  hex encoded user id
+//	tenantId            string, empty for the default tenant
+//	createdAt/updatedAt RFC 3339 timestamps
+//	lastLogin           RFC 3339 timestamp, null before the first login
+//	userName, firstName, lastName, phoneNumber, email, profileSlug   strings
+//	phoneVerified, emailVerified, active, pending   booleans
+//	birthdate           RFC 3339 timestamp, null when not given
+//	statusHistory       list of {by, reason, at, newStatus} changes to active
+//	roles               list of role names granted to the user
+//	metadata            object of the user's flags, see SetMeta
+//	externalIdentities  list of {provider, subject} linked accounts
+//	programs            list of hex encoded ids of programs owned by the user
+//
+// Authentication material such as the password hash is never included,
+// nor are fields derived from the ones above or internal to storage.
+type PersonalDataExport struct {
+	SchemaVersion      int                `json:"schemaVersion"`
+	Id                 string             `json:"id"`
+	TenantID           string             `json:"tenantId"`
+	CreatedAt          time.Time          `json:"createdAt"`
+	UpdatedAt          time.Time          `json:"updatedAt"`
+	LastLogin          *time.Time         `json:"lastLogin"`
+	Username           string             `json:"userName"`
+	Firstname          string             `json:"firstName"`
+	Lastname           string             `json:"lastName"`
+	Phonenumber        string             `json:"phoneNumber"`
+	PhoneVerified      bool               `json:"phoneVerified"`
+	Email              string             `json:"email"`
+	EmailVerified      bool               `json:"emailVerified"`
+	Birthdate          *time.Time         `json:"birthdate"`
+	ProfileSlug        string             `json:"profileSlug"`
+	Active             bool               `json:"active"`
+	StatusHistory      []StatusChange     `json:"statusHistory"`
+	Pending            bool               `json:"pending"`
+	Roles              []string           `json:"roles"`
+	Metadata           map[string]string  `json:"metadata"`
+	ExternalIdentities []ExternalIdentity `json:"externalIdentities"`
+	Programs           []string           `json:"programs"`
+}
+
+// Returns a JSON document holding all personal data stored for the user,
+// in the schema described by PersonalDataExport
+func (user *User) ExportPersonalData() ([]byte, error) {
+	if user == nil {
+		return nil, ErrNilUser
+	}
+	export := PersonalDataExport{
+		SchemaVersion:      PersonalDataSchemaVersion,
+		Id:                 user.Id.Hex(),
+		TenantID:           user.TenantID,
+		CreatedAt:          user.Inserted,
+		UpdatedAt:          user.Updated,
+		Username:           user.Username,
+		Firstname:          user.Firstname,
+		Lastname:           user.Lastname,
+		Phonenumber:        user.Phonenumber,
+		PhoneVerified:      user.PhoneVerified,
+		Email:              user.Email,
+		EmailVerified:      user.EmailVerified,
+		Birthdate:          user.Birthdate,
+		ProfileSlug:        user.ProfileSlug,
+		Active:             user.Active,
+		StatusHistory:      make([]StatusChange, 0, len(user.StatusHistory)),
+		Pending:            user.Pending,
+		Roles:              make([]string, 0, len(user.Roles)),
+		Metadata:           make(map[string]string, len(user.Metadata)),
+		ExternalIdentities: make([]ExternalIdentity, 0, len(user.ExternalIdentities)),
+		Programs:           make([]string, 0, len(user.Programs)),
+	}
+	if !user.LastLogin.IsZero() {
+		lastLogin := user.LastLogin
+		export.LastLogin = &lastLogin
+	}
+	export.StatusHistory = append(export.StatusHistory, user.StatusHistory...)
+	export.Roles = append(export.Roles, user.Roles...)
+	for key, value := range user.Metadata {
+		export.Metadata[key] = value
+	}
+	export.ExternalIdentities = append(export.ExternalIdentities, user.ExternalIdentities...)
+	for _, program := range user.Programs {
+		export.Programs = append(export.Programs, program.Hex())
+	}
+
+	return json.MarshalIndent(export, "", " ")
+}
+
+// Erases the user's personal data to honour a right-to-erasure request
+// Rather than deleting the document, which related records refer to by id,
+// the user's names and identifiers are overwritten with anonymized
+// placeholders, all authentication material is cleared and the user's audit
+// trail is removed. Erased users no longer appear in finders or listings.
+// Returns ErrLastAdmin if the user is the last one holding AdminRole.
+func (user *User) Erase() error {
+	if user == nil || user.Id == "" {
+		return ErrUserNotFound
+	}
+	if err := checkWritable(); err != nil {
+		return err
+	}
+
+	now := time.Now().Truncate(time.Millisecond) // As stored, so the undo can match it
+	placeholder := "erased-" + user.Id.Hex()
+	set := bson.M{
+		"erased":             true,
+		"userName":           placeholder,
+		"usernameLower":      placeholder,
+		"searchName":         placeholder,
+		"firstName":          "",
+		"lastName":           "",
+		"slug":               placeholder,
+		"password":           "",
+		"rehashNeeded":       false,
+		"mustChangePassword": false,
+		"phoneVerified":      false,
+		"emailVerified":      false,
+		"externalIdentities": []ExternalIdentity{},
+		"roles":              []string{},
+	}
+	unset := bson.M{"phoneNumber": "", "phoneHash": "", "email": "", "birthdate": "", "passwordChangedAt": "", "passwordHistory": "", "passwordFingerprint": "", "magicLinkHash": "", "magicLinkExpires": "", "metadata": ""}
+
+	eraseQuery := func(col *mgo.Collection) error {
+		// The stored values of the erased fields, restored if the guard trips
+		fields := bson.M{}
+		for field := range set {
+			fields[field] = 1
+		}
+		for field := range unset {
+			fields[field] = 1
+		}
+		var stored bson.M
+		err := col.Find(bson.M{"_id": user.Id, "erased": bson.M{"$ne": true}}).Select(fields).One(&stored)
+		if err == mgo.ErrNotFound {
+			return ErrUserNotFound
+		} else if err != nil {
+			return err
+		}
+
+		erase := func() error {
+			update := touched(bson.M{"$set": set, "$unset": unset}, now)
+			err := col.Update(bson.M{"_id": user.Id, "erased": bson.M{"$ne": true}}, update)
+			if err == mgo.ErrNotFound {
+				return ErrUserNotFound
+			}
+			return err
+		}
+		// Undoes only what the erasure changed, keeping concurrent writes
+		restore := func() error {
+			revert, clear := bson.M{}, bson.M{}
+			for field := range fields {
+				if value, ok := stored[field]; ok {
+					revert[field] = value
+				} else {
+					clear[field] = ""
+				}
+			}
+			update := bson.M{}
+			if len(revert) != 0 {
+				update["$set"] = revert
+			}
+			if len(clear) != 0 {
+				update["$unset"] = clear
+			}
+			return col.Update(bson.M{"_id": user.Id, "erased": true, "updated": now}, touched(update, time.Now()))
+		}
+		if err := guardLastAdmin(col, []bson.ObjectId{user.Id}, erase, restore); err != nil {
+			return err
+		}
+
+		// Audit records hold old and new values of the erased fields
+		_, err = col.Database.C(AuditCollectionName).RemoveAll(bson.M{"userId": user.Id})
+		return err
+	}
+
+	if err := db.ExecWithCol(CollectionName, eraseQuery); err != nil {
+		return err
+	}
+	cachedUsers.invalidate(user.Id)
+	*user = User{
+		Id:          user.Id,
+		Inserted:    user.Inserted,
+		Updated:     now,
+		Version:     user.Version + 1,
+		DeletedAt:   user.DeletedAt,
+		Erased:      true,
+		Username:    placeholder,
+		ProfileSlug: placeholder,
+		Programs:    user.Programs,
+	}
+	return nil
+}
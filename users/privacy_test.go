@@ -0,0 +1,183 @@
+// Tests for handling of users' personal data
+
+package users
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/njdup/func/db"
+)
+
+func TestExportPersonalData(t *testing.T) {
+	user := User{
+		Id:            bson.NewObjectId(),
+		Username:      "exportUser",
+		Firstname:     "john",
+		Lastname:      "doe",
+		Phonenumber:   "+15550011001",
+		PhoneVerified: true,
+		PasswordHash:  "$2a$10$secrethashvalue",
+		Programs:      []bson.ObjectId{bson.NewObjectId()},
+		ExternalIdentities: []ExternalIdentity{
+			{Provider: "github", Subject: "42"},
+		},
+	}
+
+	exported, err := user.ExportPersonalData()
+	if err != nil {
+		t.Fatal("Error encountered exporting personal data: ", err)
+	}
+
+	var document map[string]interface{}
+	if err := json.Unmarshal(exported, &document); err != nil {
+		t.Fatal("Exported personal data isn't valid JSON: ", err)
+	}
+
+	expectedKeys := []string{
+		"schemaVersion", "id", "tenantId", "createdAt", "updatedAt", "lastLogin", "userName", "firstName", "lastName",
+		"phoneNumber", "phoneVerified", "email", "emailVerified", "birthdate", "profileSlug", "active", "statusHistory",
+		"pending", "roles", "metadata", "externalIdentities", "programs",
+	}
+	for _, key := range expectedKeys {
+		if _, ok := document[key]; !ok {
+			t.Error("Exported personal data is missing key ", key)
+		}
+	}
+	if len(document) != len(expectedKeys) {
+		t.Error("Exported personal data has unexpected keys: ", document)
+	}
+
+	if document["phoneVerified"] != true || document["id"] != user.Id.Hex() {
+		t.Error("Exported personal data has wrong values: ", document)
+	}
+	if identities, _ := document["externalIdentities"].([]interface{}); len(identities) != 1 {
+		t.Error("Linked identities missing from export: ", document["externalIdentities"])
+	}
+	if strings.Contains(string(exported), user.PasswordHash) {
+		t.Error("Password hash included in personal data export")
+	}
+}
+
+// Ensures every stored field of users is either exported as personal data
+// or deliberately left out
+func TestPersonalDataCoverage(t *testing.T) {
+	// The export key of each stored field, empty for fields left out
+	coverage := map[string]string{
+		"_id":                 "id",
+		"inserted":            "createdAt",
+		"updated":             "updatedAt",
+		"version":             "",
+		"deletedAt":           "",
+		"erased":              "",
+		"tenantId":            "tenantId",
+		"userName":            "userName",
+		"firstName":           "firstName",
+		"lastName":            "lastName",
+		"phoneNumber":         "phoneNumber",
+		"email":               "email",
+		"password":            "", // Authentication material
+		"rehashNeeded":        "",
+		"passwordChangedAt":   "",
+		"passwordHistory":     "",
+		"passwordFingerprint": "",
+		"mustChangePassword":  "",
+		"lastLogin":           "lastLogin",
+		"magicLinkHash":       "",
+		"magicLinkExpires":    "",
+		"usernameLower":       "", // Derived from the username
+		"searchName":          "", // Derived from the names and username
+		"slug":                "profileSlug",
+		"phoneVerified":       "phoneVerified",
+		"phoneHash":           "", // Derived from the phonenumber
+		"emailVerified":       "emailVerified",
+		"birthdate":           "birthdate",
+		"active":              "active",
+		"statusHistory":       "statusHistory",
+		"pending":             "pending",
+		"roles":               "roles",
+		"programs":            "programs",
+		"metadata":            "metadata",
+		"externalIdentities":  "externalIdentities",
+	}
+
+	stored := bsonFieldTypes(reflect.TypeOf(User{}))
+	for field := range stored {
+		if _, ok := coverage[field]; !ok {
+			t.Errorf("Stored field %s is neither exported as personal data nor left out", field)
+		}
+	}
+	for field := range coverage {
+		if _, ok := stored[field]; !ok {
+			t.Errorf("Personal data coverage lists %s, which users don't store", field)
+		}
+	}
+
+	var user User
+	populate(reflect.ValueOf(&user).Elem())
+	exported, err := user.ExportPersonalData()
+	if err != nil {
+		t.Fatal("Error encountered exporting personal data: ", err)
+	}
+	var document map[string]interface{}
+	if err := json.Unmarshal(exported, &document); err != nil {
+		t.Fatal("Exported personal data isn't valid JSON: ", err)
+	}
+	for field, key := range coverage {
+		if _, ok := document[key]; key != "" && !ok {
+			t.Errorf("Stored field %s is missing from the export as %s", field, key)
+		}
+	}
+}
+
+func TestErase(t *testing.T) {
+	user := User{Username: "eraseUser", Firstname: "jane", Lastname: "roe", Phonenumber: "+15550011101"}
+	if err := user.SetPassword("supersecure"); err != nil {
+		t.Fatal("Error encountered setting password: ", err)
+	}
+	if err := user.Save(); err != nil {
+		t.Fatal("Failed to save user in the db: ", user.ToString())
+	}
+	defer removeUser(user)
+	original := user
+
+	if err := user.Erase(); err != nil {
+		t.Fatal("Error encountered erasing user: ", err)
+	}
+	if user.Id != original.Id || !user.Erased {
+		t.Error("Erased user lost its id or erased flag: ", user.ToString())
+	}
+
+	var stored bson.M
+	db.ExecWithCol(CollectionName, func(col *mgo.Collection) error {
+		return col.FindId(original.Id).One(&stored)
+	})
+	if stored == nil {
+		t.Fatal("Erased user document was deleted")
+	}
+	storedText := fmt.Sprint(stored)
+	for _, pii := range []string{original.Username, original.Firstname, original.Lastname, original.Phonenumber, original.PasswordHash} {
+		if strings.Contains(storedText, pii) {
+			t.Errorf("Erased user document still holds %q: %v", pii, stored)
+		}
+	}
+
+	if _, err := FindByID(original.Id.Hex()); err == nil {
+		t.Error("Erased user was still found by id")
+	}
+	if _, err := FindWithUsername(user.Username); err == nil {
+		t.Error("Erased user was found by its placeholder username")
+	}
+	listed, _ := ListUsers(0, MaxPageSize)
+	for _, listedUser := range listed {
+		if listedUser.Id == original.Id {
+			t.Error("Erased user appears in listings")
+		}
+	}
+}
@@ -0,0 +1,84 @@
+// Signed links to user profiles, so read-only profiles can be shared without
+// the link being forged for another user or extended beyond its expiry
+//
+// Links carry the user's id and expiry in their query string, signed with
+// an HMAC under a key only the server knows.
+
+package users
+
+import (
+	"crypto/hmac"
+	"net/url"
+	"strconv"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/njdup/func/utils/security"
+)
+
+// Query parameters of signed profile links
+const (
+	profileLinkID        = "id"
+	profileLinkExpires   = "expires"
+	profileLinkSignature = "sig"
+)
+
+// Returns the given base URL with the user's id, an expiry ttl from now and
+// their signature added to its query, see VerifySignedProfileURL
+// Other query parameters of base are kept, but aren't signed. Returns an
+// empty string if base isn't a valid URL, ttl isn't positive or key is empty,
+// as links signed under an empty key could be forged by anyone.
+func (user *User) SignedProfileURL(base string, ttl time.Duration, key []byte) string {
+	link, err := url.Parse(base)
+	if err != nil || user == nil || ttl <= 0 || len(key) == 0 {
+		return ""
+	}
+
+	hexID := user.Id.Hex()
+	expires := strconv.FormatInt(time.Now().Add(ttl).Unix(), 10)
+	query := link.Query()
+	query.Set(profileLinkID, hexID)
+	query.Set(profileLinkExpires, expires)
+	query.Set(profileLinkSignature, profileLinkSignatureFor(key, hexID, expires))
+	link.RawQuery = query.Encode()
+	return link.String()
+}
+
+// Returns the hex id of the user a signed profile link was made for, given
+// the link's query parameters
+// Returns ErrInvalidProfileLink if the link is malformed, its signature
+// doesn't match or key is empty, or ErrProfileLinkExpired if it expired.
+func VerifySignedProfileURL(values url.Values, key []byte) (hexID string, err error) {
+	if len(key) == 0 {
+		return "", ErrInvalidProfileLink
+	}
+	hexID = values.Get(profileLinkID)
+	expires := values.Get(profileLinkExpires)
+	signature := values.Get(profileLinkSignature)
+	if !bson.IsObjectIdHex(hexID) || expires == "" || signature == "" {
+		return "", ErrInvalidProfileLink
+	}
+
+	expected := profileLinkSignatureFor(key, hexID, expires)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return "", ErrInvalidProfileLink
+	}
+	expiresAt, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return "", ErrInvalidProfileLink
+	}
+	if time.Now().Unix() >= expiresAt {
+		return "", ErrProfileLinkExpired
+	}
+	return hexID, nil
+}
+
+/*
+ * Helper Functions
+ */
+
+// Returns the signature of a profile link for the given id and expiry
+func profileLinkSignatureFor(key []byte, hexID, expires string) string {
+	return security.KeyedHash(key, "profile|"+hexID+"|"+expires)
+}
@@ -0,0 +1,74 @@
+// Tests for signed profile links
+
+package users
+
+import (
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestSignedProfileURL(t *testing.T) {
+	key := []byte("profile link key")
+	user := User{Id: bson.NewObjectId(), Username: "sharedProfile"}
+
+	link := user.SignedProfileURL("https://func.example/profile?ref=share", time.Hour, key)
+	parsed, err := url.Parse(link)
+	if err != nil {
+		t.Fatal("Signed profile link isn't a valid URL: ", link)
+	}
+	values := parsed.Query()
+	if values.Get("ref") != "share" {
+		t.Error("Signing dropped the base URL's query: ", link)
+	}
+
+	hexID, err := VerifySignedProfileURL(values, key)
+	if err != nil || hexID != user.Id.Hex() {
+		t.Errorf("Expected valid link to verify as %s, got %q (err %v)", user.Id.Hex(), hexID, err)
+	}
+	if _, err := VerifySignedProfileURL(values, []byte("other key")); err != ErrInvalidProfileLink {
+		t.Error("Expected link verified with another key to be rejected, got: ", err)
+	}
+
+	tampered := parsed.Query()
+	tampered.Set("id", bson.NewObjectId().Hex())
+	if _, err := VerifySignedProfileURL(tampered, key); err != ErrInvalidProfileLink {
+		t.Error("Expected link with a tampered id to be rejected, got: ", err)
+	}
+	tampered = parsed.Query()
+	tampered.Set("expires", "99999999999")
+	if _, err := VerifySignedProfileURL(tampered, key); err != ErrInvalidProfileLink {
+		t.Error("Expected link with a tampered expiry to be rejected, got: ", err)
+	}
+
+	expired := parsed.Query()
+	past := strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10)
+	expired.Set("expires", past)
+	expired.Set("sig", profileLinkSignatureFor(key, user.Id.Hex(), past))
+	if _, err := VerifySignedProfileURL(expired, key); err != ErrProfileLinkExpired {
+		t.Error("Expected expired link to be rejected, got: ", err)
+	}
+	if _, err := VerifySignedProfileURL(url.Values{}, key); err != ErrInvalidProfileLink {
+		t.Error("Expected empty link to be rejected, got: ", err)
+	}
+
+	// Links under an empty key could be forged by anyone
+	for _, empty := range [][]byte{nil, {}} {
+		if link := user.SignedProfileURL("https://func.example/profile", time.Hour, empty); link != "" {
+			t.Error("Expected no link signed under an empty key, got: ", link)
+		}
+		forged := parsed.Query()
+		forged.Set("sig", profileLinkSignatureFor(empty, user.Id.Hex(), forged.Get("expires")))
+		if _, err := VerifySignedProfileURL(forged, empty); err != ErrInvalidProfileLink {
+			t.Error("Expected link verified under an empty key to be rejected, got: ", err)
+		}
+	}
+	for _, ttl := range []time.Duration{0, -time.Minute} {
+		if link := user.SignedProfileURL("https://func.example/profile", ttl, key); link != "" {
+			t.Errorf("Expected no link for ttl %v, got: %s", ttl, link)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+// Detection of users whose profile is missing optional but desired fields,
+// for onboarding nudges such as engagement emails
+
+package users
+
+import (
+	"context"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	// The profile requirements a user must meet for their profile to be
+	// complete, naming keys of profileRequirements
+	// Replace the list to configure it for a deployment.
+	IncompleteProfileFields = []string{"Firstname", "Lastname", "Email", "EmailVerified"}
+
+	// Queries matching users failing each profile requirement, keyed by the
+	// name used in IncompleteProfileFields
+	profileRequirements = map[string]bson.M{
+		"Firstname":     {"firstName": bson.M{"$in": []interface{}{"", nil}}},
+		"Lastname":      {"lastName": bson.M{"$in": []interface{}{"", nil}}},
+		"Email":         {"email": bson.M{"$in": []interface{}{"", nil}}},
+		"EmailVerified": {"emailVerified": bson.M{"$ne": true}},
+		"PhoneVerified": {"phoneVerified": bson.M{"$ne": true}},
+	}
+)
+
+// Returns up to limit users failing any of the IncompleteProfileFields
+// requirements, ordered by id
+// Soft deleted, erased and disabled users are excluded, and the limit is
+// normalized with NormalizePagination. Returns ErrUnknownProfileField if
+// IncompleteProfileFields names an unknown requirement.
+func ListIncompleteProfiles(limit int) ([]*User, error) {
+	missing := make([]bson.M, 0, len(IncompleteProfileFields))
+	for _, field := range IncompleteProfileFields {
+		requirement, ok := profileRequirements[field]
+		if !ok {
+			return nil, ErrUnknownProfileField
+		}
+		missing = append(missing, requirement)
+	}
+	if len(missing) == 0 {
+		return make([]*User, 0), nil
+	}
+
+	query := bson.M{"active": bson.M{"$ne": false}, "$or": missing}
+	return listMatchingUsersContext(context.Background(), query, 0, limit, "_id")
+}
@@ -0,0 +1,50 @@
+// Tests for the detection of incomplete user profiles
+
+package users
+
+import (
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestListIncompleteProfiles(t *testing.T) {
+	complete := User{Username: "profileComplete", Phonenumber: "+15550190001", Firstname: "Ada", Lastname: "Lovelace", Email: "ada@example.com", EmailVerified: true}
+	noName := User{Username: "profileNoName", Phonenumber: "+15550190002", Email: "noname@example.com", EmailVerified: true}
+	unverified := User{Username: "profileUnverified", Phonenumber: "+15550190003", Firstname: "Grace", Lastname: "Hopper", Email: "grace@example.com"}
+	for _, user := range []*User{&complete, &noName, &unverified} {
+		if err := user.Save(); err != nil {
+			t.Fatal("Failed to save user in the db: ", user.ToString())
+		}
+		defer removeUser(*user)
+	}
+
+	listed := func() map[bson.ObjectId]bool {
+		found, err := ListIncompleteProfiles(MaxPageSize)
+		if err != nil {
+			t.Fatal("Error encountered listing incomplete profiles: ", err)
+		}
+		ids := make(map[bson.ObjectId]bool)
+		for _, user := range found {
+			ids[user.Id] = true
+		}
+		return ids
+	}
+
+	ids := listed()
+	if ids[complete.Id] || !ids[noName.Id] || !ids[unverified.Id] {
+		t.Error("Expected only the incomplete profiles to be listed")
+	}
+
+	defer func(fields []string) { IncompleteProfileFields = fields }(IncompleteProfileFields)
+	IncompleteProfileFields = []string{"Firstname"}
+	ids = listed()
+	if ids[complete.Id] || !ids[noName.Id] || ids[unverified.Id] {
+		t.Error("Expected only profiles failing the configured requirements to be listed")
+	}
+
+	IncompleteProfileFields = []string{"Avatar"}
+	if _, err := ListIncompleteProfiles(10); err != ErrUnknownProfileField {
+		t.Error("Expected ErrUnknownProfileField for an unknown requirement, got: ", err)
+	}
+}
@@ -0,0 +1,41 @@
+// Read-only mode for maintenance windows, blocking writes to users while
+// finders keep working
+//
+// Mutators such as Save, Update and Delete return ErrReadOnly while the mode
+// is enabled, as do bulk writers such as EnsureIndexes, NormalizeAllPhones
+// and MarkRehashNeeded. Logins still succeed, without recording the login.
+
+package users
+
+import (
+	"sync/atomic"
+)
+
+// Set to 1 while read-only mode is enabled, accessed atomically
+var readOnly int32
+
+// Enables or disables read-only mode
+func SetReadOnly(enabled bool) {
+	var value int32
+	if enabled {
+		value = 1
+	}
+	atomic.StoreInt32(&readOnly, value)
+}
+
+// Checks whether read-only mode is enabled
+func IsReadOnly() bool {
+	return atomic.LoadInt32(&readOnly) == 1
+}
+
+/*
+ * Helper Functions
+ */
+
+// Returns ErrReadOnly if read-only mode is enabled
+func checkWritable() error {
+	if IsReadOnly() {
+		return ErrReadOnly
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+// Tests for the read-only maintenance mode
+
+package users
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReadOnly(t *testing.T) {
+	user := User{Username: "readOnlyUser", Phonenumber: "+15550240001"}
+	if err := user.SetPassword("maintenance window"); err != nil {
+		t.Fatal("Error encountered setting password: ", err)
+	}
+	if err := user.Save(); err != nil {
+		t.Fatal("Failed to save user in the db: ", user.ToString())
+	}
+	defer removeUser(user)
+
+	SetReadOnly(true)
+	defer SetReadOnly(false)
+
+	blocked := map[string]func() error{
+		"Save":             (&User{Username: "readOnlyNew", Phonenumber: "+15550240002"}).Save,
+		"Update":           func() error { user.Firstname = "Changed"; return user.Update() },
+		"SoftDelete":       user.SoftDelete,
+		"Delete":           user.Delete,
+		"Erase":            user.Erase,
+		"Disable":          func() error { return user.Disable("admin", "maintenance") },
+		"SetMeta":          func() error { return user.SetMeta("plan", "pro") },
+		"AddRole":          func() error { _, err := AddRoleToUsers([]string{user.Id.Hex()}, "member"); return err },
+		"NewSession":       func() error { _, err := user.NewSessionToken(); return err },
+		"MagicLink":        func() error { _, err := user.GenerateMagicLinkToken(time.Hour); return err },
+		"Reservation":      func() error { _, err := ReserveUsername("readOnlyReserved", time.Hour); return err },
+		"EnsureIndexes":    EnsureIndexes,
+		"MarkRehash":       func() error { _, err := MarkRehashNeeded(14); return err },
+		"NormalizePhones":  func() error { _, _, err := NormalizeAllPhones(); return err },
+		"FixUsernames":     func() error { _, err := FixPhoneInUsername(func(*User) string { return "x" }); return err },
+		"BackfillInserted": func() error { _, err := BackfillInsertedTimestamps(time.Now()); return err },
+	}
+	for name, mutate := range blocked {
+		if err := mutate(); err != ErrReadOnly {
+			t.Errorf("Expected %s to be blocked while read-only, got: %v", name, err)
+		}
+	}
+
+	found, err := FindByID(user.Id.Hex())
+	if err != nil || found.Firstname != "" {
+		t.Error("Expected finders to work while read-only, got: ", found.ToString(), err)
+	}
+	if _, err := ListUsers(0, 10); err != nil {
+		t.Error("Expected listings to work while read-only, got: ", err)
+	}
+	if _, err := Authenticate(user.Username, "maintenance window"); err != nil {
+		t.Error("Expected logins to work while read-only, got: ", err)
+	}
+
+	// Unsaved users can still be edited in memory
+	if err := (&User{}).SetMeta("plan", "pro"); err != nil {
+		t.Error("Expected unsaved users to remain editable, got: ", err)
+	}
+
+	SetReadOnly(false)
+	if err := user.Update(); err != nil {
+		t.Error("Expected writes to resume once read-only is disabled, got: ", err)
+	}
+}
@@ -0,0 +1,254 @@
+// Defensive decoding of stored user documents
+// Documents that predate the current schema may hold values of unexpected
+// types, which bson would otherwise silently drop while decoding
+
+package users
+
+import (
+	"reflect"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// bson element kinds, as defined by the bson spec
+const (
+	kindDouble   = 0x01
+	kindString   = 0x02
+	kindDocument = 0x03
+	kindArray    = 0x04
+	kindBinary   = 0x05
+	kindObjectId = 0x07
+	kindBool     = 0x08
+	kindDatetime = 0x09
+	kindNull     = 0x0A
+	kindInt32    = 0x10
+	kindInt64    = 0x12
+)
+
+var (
+	objectIdType = reflect.TypeOf(bson.ObjectId(""))
+	timeType     = reflect.TypeOf(time.Time{})
+)
+
+// Decodes the given raw document into user, after confirming every stored
+// field holds a value of the type the User struct expects
+// Documents predating Active are decoded as active, as the backfill in
+// EnsureIndexes will store them. Returns a CorruptRecordError naming the
+// first mismatched field
+func decodeUser(raw bson.Raw, user *User) error {
+	var elems bson.RawD
+	if err := raw.Unmarshal(&elems); err != nil {
+		return &CorruptRecordError{Cause: err}
+	}
+
+	var id interface{}
+	hasActive := false
+	for _, elem := range elems {
+		switch elem.Name {
+		case "_id":
+			elem.Value.Unmarshal(&id)
+		case "active":
+			hasActive = true
+		}
+	}
+
+	fields := bsonFieldTypes(reflect.TypeOf(*user))
+	for _, elem := range elems {
+		fieldType, ok := fields[elem.Name]
+		if !ok {
+			continue
+		}
+		if !kindMatches(fieldType, elem.Value) {
+			return &CorruptRecordError{Id: id, Field: elem.Name}
+		}
+	}
+
+	if err := raw.Unmarshal(user); err != nil {
+		return &CorruptRecordError{Id: id, Cause: err}
+	}
+	if !hasActive {
+		user.Active = true
+	}
+	return nil
+}
+
+// Repairs benign inconsistencies of a user decoded from an old document in
+// memory, without writing them back, so callers see consistent data
+// Stray whitespace around the names, username and email address is trimmed,
+// and the lowercased username and search name are derived when missing.
+// Consistent users are left unchanged. Run by the finders, see
+// findMatchingUserContext and listAllMatchingUsersContext.
+func (user *User) normalizeOnLoad() {
+	user.Username = strings.TrimSpace(user.Username)
+	user.Firstname = strings.TrimSpace(user.Firstname)
+	user.Lastname = strings.TrimSpace(user.Lastname)
+	user.Email = strings.TrimSpace(user.Email)
+	if user.UsernameLower == "" {
+		user.UsernameLower = strings.ToLower(user.Username)
+	}
+	if user.SearchName == "" {
+		user.SearchName = searchNameFor(user)
+	}
+}
+
+// Returns a map of the bson key of each field in the given struct type to
+// the go type the field is decoded into
+func bsonFieldTypes(structType reflect.Type) map[string]reflect.Type {
+	result := make(map[string]reflect.Type)
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		if field.PkgPath != "" {
+			continue // Unexported
+		}
+		name := strings.Split(field.Tag.Get("bson"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+		result[name] = field.Type
+	}
+	return result
+}
+
+// Checks whether the raw bson value can be decoded into the given go type
+// without losing data
+func kindMatches(goType reflect.Type, value bson.Raw) bool {
+	if value.Kind == kindNull {
+		return true
+	}
+	for goType.Kind() == reflect.Ptr {
+		goType = goType.Elem()
+	}
+
+	switch {
+	case goType == objectIdType:
+		return value.Kind == kindObjectId
+	case goType == timeType:
+		return value.Kind == kindDatetime
+	}
+
+	switch goType.Kind() {
+	case reflect.String:
+		return value.Kind == kindString
+	case reflect.Bool:
+		return value.Kind == kindBool
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return value.Kind == kindInt32 || value.Kind == kindInt64 || value.Kind == kindDouble
+	case reflect.Map, reflect.Struct:
+		return value.Kind == kindDocument
+	case reflect.Slice:
+		if goType.Elem().Kind() == reflect.Uint8 {
+			return value.Kind == kindBinary
+		}
+		if value.Kind != kindArray {
+			return false
+		}
+		// Arrays share the document encoding, keyed by index
+		var items bson.RawD
+		if err := (bson.Raw{Kind: kindDocument, Data: value.Data}).Unmarshal(&items); err != nil {
+			return false
+		}
+		for _, item := range items {
+			if !kindMatches(goType.Elem(), item.Value) {
+				return false
+			}
+		}
+		return true
+	}
+	return true
+}
+
+// Checks that the user survives being marshalled to bson and back, guarding
+// against fields whose bson tag is malformed or missing
+// Every exported field must declare its bson key, as fields without one are
+// silently stored under their lowercased name. Times are compared at the
+// millisecond precision bson stores, and empty slices and maps are equal to
+// nil ones.
+// Returns a RoundTripError naming the fields that were lost or renamed
+func ValidateBSONRoundTrip(user *User) error {
+	if user == nil {
+		return ErrNilUser
+	}
+	return validateRoundTrip(user)
+}
+
+// Checks that the struct pointed to by value survives being marshalled to
+// bson and back, see ValidateBSONRoundTrip
+func validateRoundTrip(value interface{}) error {
+	original := reflect.ValueOf(value).Elem()
+	data, err := bson.Marshal(value)
+	if err != nil {
+		return &RoundTripError{Cause: err}
+	}
+	decoded := reflect.New(original.Type())
+	if err := bson.Unmarshal(data, decoded.Interface()); err != nil {
+		return &RoundTripError{Cause: err}
+	}
+
+	var fields []string
+	for i := 0; i < original.NumField(); i++ {
+		field := original.Type().Field(i)
+		if field.PkgPath != "" {
+			continue // Unexported, never stored
+		}
+		tag, ok := field.Tag.Lookup("bson")
+		if !ok || strings.Split(tag, ",")[0] == "-" || !roundTripEqual(original.Field(i), decoded.Elem().Field(i)) {
+			fields = append(fields, field.Name)
+		}
+	}
+	if len(fields) != 0 {
+		return &RoundTripError{Fields: fields}
+	}
+	return nil
+}
+
+// Checks whether the decoded value holds the same data as the original,
+// allowing for the precision and empty values lost by bson
+func roundTripEqual(original, decoded reflect.Value) bool {
+	if original.Type() == timeType {
+		a, b := original.Interface().(time.Time), decoded.Interface().(time.Time)
+		return a.Truncate(time.Millisecond).Equal(b.Truncate(time.Millisecond))
+	}
+
+	switch original.Kind() {
+	case reflect.Slice, reflect.Map:
+		if original.Len() == 0 || decoded.Len() == 0 {
+			return original.Len() == decoded.Len()
+		}
+		if original.Kind() == reflect.Map {
+			return reflect.DeepEqual(original.Interface(), decoded.Interface())
+		}
+		if original.Len() != decoded.Len() {
+			return false
+		}
+		for i := 0; i < original.Len(); i++ {
+			if !roundTripEqual(original.Index(i), decoded.Index(i)) {
+				return false
+			}
+		}
+		return true
+	case reflect.Ptr:
+		if original.IsNil() || decoded.IsNil() {
+			return original.IsNil() == decoded.IsNil()
+		}
+		return roundTripEqual(original.Elem(), decoded.Elem())
+	case reflect.Struct:
+		for i := 0; i < original.NumField(); i++ {
+			field := original.Type().Field(i)
+			if field.PkgPath != "" {
+				continue
+			}
+			if _, ok := field.Tag.Lookup("bson"); !ok || !roundTripEqual(original.Field(i), decoded.Field(i)) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(original.Interface(), decoded.Interface())
+}
@@ -0,0 +1,174 @@
+// Tests for decoding stored user documents
+
+package users
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/njdup/func/db"
+)
+
+// Ensures a stored document with mistyped fields produces a friendly error
+func TestCorruptRecord(t *testing.T) {
+	id := bson.NewObjectId()
+	insertMalformed := func(col *mgo.Collection) error {
+		return col.Insert(bson.M{"_id": id, "userName": 1234, "phoneNumber": "+1800CORRUPT"})
+	}
+	if err := db.ExecWithCol(CollectionName, insertMalformed); err != nil {
+		t.Fatal("Failed to insert malformed document: ", err)
+	}
+	defer db.ExecWithCol(CollectionName, func(col *mgo.Collection) error {
+		return col.RemoveId(id)
+	})
+
+	_, err := FindWithPhonenumber("+1800CORRUPT")
+	if !errors.Is(err, ErrCorruptRecord) {
+		t.Fatal("Expected a corrupt record error, got: ", err)
+	}
+	corrupt, ok := err.(*CorruptRecordError)
+	if !ok || corrupt.Field != "userName" {
+		t.Error("Corrupt record error doesn't name the offending field: ", err)
+	}
+
+	if _, err := FindByID(id.Hex()); !errors.Is(err, ErrCorruptRecord) {
+		t.Error("Expected a corrupt record error finding by id, got: ", err)
+	}
+}
+
+// Ensures benign inconsistencies of old documents are repaired in memory only
+func TestNormalizeOnLoad(t *testing.T) {
+	raw, _ := bson.Marshal(bson.M{
+		"_id":         bson.NewObjectId(),
+		"userName":    " OldTimer ",
+		"firstName":   "Ada\t",
+		"lastName":    " Lovelace",
+		"email":       "ada@example.com ",
+		"phoneNumber": "+15550350001",
+	})
+	var user User
+	if err := decodeUser(bson.Raw{Kind: kindDocument, Data: raw}, &user); err != nil {
+		t.Fatal("Error encountered decoding document: ", err)
+	}
+	user.normalizeOnLoad()
+	if user.Username != "OldTimer" || user.Firstname != "Ada" || user.Lastname != "Lovelace" || user.Email != "ada@example.com" {
+		t.Error("Expected stray whitespace to be trimmed, got: ", user.ToString())
+	}
+	if user.UsernameLower != "oldtimer" || user.SearchName != "Ada Lovelace OldTimer" {
+		t.Errorf("Expected derived fields to be filled, got %q and %q", user.UsernameLower, user.SearchName)
+	}
+
+	if !user.Active {
+		t.Error("Expected a document predating Active to decode as active")
+	}
+
+	consistent := user
+	user.normalizeOnLoad()
+	if !reflect.DeepEqual(user, consistent) {
+		t.Error("Expected consistent users to be left unchanged")
+	}
+
+	// Finders repair the stored document, without writing back
+	id := bson.NewObjectId()
+	insertOld := func(col *mgo.Collection) error {
+		return col.Insert(bson.M{"_id": id, "userName": "oldTimer ", "firstName": " Ada", "phoneNumber": "+15550350002"})
+	}
+	if err := db.ExecWithCol(CollectionName, insertOld); err != nil {
+		t.Fatal("Failed to insert old document: ", err)
+	}
+	defer db.ExecWithCol(CollectionName, func(col *mgo.Collection) error {
+		return col.RemoveId(id)
+	})
+
+	found, err := FindByID(id.Hex())
+	if err != nil || found.Username != "oldTimer" || found.Firstname != "Ada" || found.UsernameLower != "oldtimer" {
+		t.Error("Expected the found user to be normalized, got: ", found.ToString(), err)
+	}
+	var stored bson.M
+	db.ExecWithCol(CollectionName, func(col *mgo.Collection) error {
+		return col.FindId(id).One(&stored)
+	})
+	if stored["userName"] != "oldTimer " || stored["usernameLower"] != nil {
+		t.Error("Expected the stored document to be left as is, got: ", stored)
+	}
+}
+
+// Ensures malformed ids are rejected before querying
+func TestFindByInvalidId(t *testing.T) {
+	if _, err := FindByID("not-an-object-id"); err != ErrInvalidId {
+		t.Error("Expected invalid id error, got: ", err)
+	}
+}
+
+// Ensures every field of the User struct survives a bson round-trip
+func TestBSONRoundTrip(t *testing.T) {
+	user := User{}
+	populate(reflect.ValueOf(&user).Elem())
+	if err := ValidateBSONRoundTrip(&user); err != nil {
+		t.Error("Expected populated user to round-trip, got: ", err)
+	}
+	if err := ValidateBSONRoundTrip(&User{}); err != nil {
+		t.Error("Expected empty user to round-trip, got: ", err)
+	}
+}
+
+// Ensures fields with broken bson tags are reported
+func TestBSONRoundTripBrokenTags(t *testing.T) {
+	type brokenUser struct {
+		Username    string `bson:"userName"`
+		Phonenumber string `json:"phoneNumber"` // Missing bson tag, stored as "phonenumber"
+		Password    string `bson:"-"`
+		Nickname    string
+	}
+	broken := brokenUser{"broken", "+15550150001", "secret", "nick"}
+	err, ok := validateRoundTrip(&broken).(*RoundTripError)
+	if !ok {
+		t.Fatal("Expected broken struct to fail the round-trip, got: ", err)
+	}
+	expected := []string{"Phonenumber", "Password", "Nickname"}
+	if !reflect.DeepEqual(err.Fields, expected) {
+		t.Error("Expected broken fields ", expected, ", got: ", err.Fields)
+	}
+}
+
+// Sets every exported field of the given value to a non-zero value, so
+// fields dropped by the round-trip are noticed
+func populate(value reflect.Value) {
+	if value.Type() == timeType {
+		value.Set(reflect.ValueOf(time.Now()))
+		return
+	}
+	if value.Type() == objectIdType {
+		value.Set(reflect.ValueOf(bson.NewObjectId()))
+		return
+	}
+
+	switch value.Kind() {
+	case reflect.String:
+		value.SetString("value")
+	case reflect.Bool:
+		value.SetBool(true)
+	case reflect.Int, reflect.Int64:
+		value.SetInt(7)
+	case reflect.Slice:
+		item := reflect.New(value.Type().Elem()).Elem()
+		populate(item)
+		value.Set(reflect.Append(value, item))
+	case reflect.Map:
+		item := reflect.New(value.Type().Elem()).Elem()
+		populate(item)
+		value.Set(reflect.MakeMap(value.Type()))
+		value.SetMapIndex(reflect.ValueOf("key"), item)
+	case reflect.Struct:
+		for i := 0; i < value.NumField(); i++ {
+			if value.Type().Field(i).PkgPath == "" {
+				populate(value.Field(i))
+			}
+		}
+	}
+}
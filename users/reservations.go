@@ -0,0 +1,170 @@
+// Reservation of usernames by signups in progress, so a username picked on
+// the first step of a signup form can't be taken before the last
+//
+// Reservations are held in their own collection, keyed by lowercased
+// username, and only cover the default tenant. Only the hash of a
+// reservation's token is kept. Abandoned reservations stop holding their
+// username once they expire, and are then removed through a TTL index, see
+// EnsureIndexes.
+
+package users
+
+import (
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/njdup/func/db"
+	"github.com/njdup/func/utils/security"
+	"github.com/njdup/func/utils/web"
+)
+
+var (
+	ReservationCollectionName = "usernameReservations" // Name of the collection holding username reservations
+)
+
+// A username held for a signup in progress
+type usernameReservation struct {
+	UsernameLower string    `bson:"_id"`
+	Username      string    `bson:"userName"` // As given when reserving
+	TokenHash     string    `bson:"tokenHash"`
+	Expires       time.Time `bson:"expires"`
+	Claimed       bool      `bson:"claimed"`
+}
+
+// Holds the given username for ttl, returning the token to claim it with,
+// see ClaimReservation
+// While the reservation lasts, no other user may be saved with the username.
+// Returns an InvalidFieldsError if the username is empty or can't be claimed,
+// ErrInvalidTokenTTL if ttl isn't positive, ErrDuplicateUsername if a user
+// already has the username, or ErrUsernameHeld if another signup reserved it.
+func ReserveUsername(name string, ttl time.Duration) (reservationToken string, err error) {
+	if err := checkWritable(); err != nil {
+		return "", err
+	}
+	if name == "" {
+		return "", &web.InvalidFieldsError{
+			web.GeneralError{"The following fields cannot be empty: Username"},
+			[]string{"Username"},
+		}
+	}
+	if ttl <= 0 {
+		return "", ErrInvalidTokenTTL
+	}
+	if err := ValidateUsername(name); err != nil {
+		return "", err
+	}
+	if err := checkConflicts(map[string]bson.M{"Username": usernameQuery("", name)}); err != nil {
+		return "", err
+	}
+	token, err := security.NewToken()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	reservation := usernameReservation{
+		UsernameLower: strings.ToLower(name),
+		Username:      name,
+		TokenHash:     security.HashToken(token),
+		Expires:       now.Add(ttl),
+	}
+	reserveQuery := func(col *mgo.Collection) error {
+		err := col.Insert(&reservation)
+		if !mgo.IsDup(err) {
+			return err
+		}
+
+		// Take over the reservation if it expired but wasn't removed yet
+		expired := bson.M{"_id": reservation.UsernameLower, "expires": bson.M{"$lte": now}}
+		err = col.Update(expired, &reservation)
+		if err == mgo.ErrNotFound || mgo.IsDup(err) {
+			return ErrUsernameHeld
+		}
+		return err
+	}
+
+	if err := db.ExecWithCol(ReservationCollectionName, reserveQuery); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Claims the reservation made with the given token for the unsaved user,
+// setting their username to the reserved one
+// The reservation is released once the user is saved, see Save. Reservations
+// can only be claimed once, and the claim lapses with the reservation.
+// Returns ErrInvalidReservation if the token is unknown, expired or already
+// claimed.
+func ClaimReservation(token string, user *User) error {
+	if user == nil {
+		return ErrNilUser
+	}
+	if err := checkWritable(); err != nil {
+		return err
+	}
+	if token == "" {
+		return ErrInvalidReservation
+	}
+
+	var reservation usernameReservation
+	claimQuery := func(col *mgo.Collection) error {
+		query := bson.M{
+			"tokenHash": security.HashToken(token),
+			"expires":   bson.M{"$gt": time.Now()},
+			"claimed":   false,
+		}
+		change := mgo.Change{Update: bson.M{"$set": bson.M{"claimed": true}}, ReturnNew: true}
+		_, err := col.Find(query).Apply(change, &reservation)
+		if err == mgo.ErrNotFound {
+			return ErrInvalidReservation
+		}
+		return err
+	}
+
+	if err := db.ExecWithCol(ReservationCollectionName, claimQuery); err != nil {
+		return err
+	}
+	user.Username = reservation.Username
+	user.reservationHash = reservation.TokenHash
+	return nil
+}
+
+/*
+ * Helper Functions
+ */
+
+// Checks that the user's username isn't held by a reservation other than
+// the one the user claimed
+// Returns ErrUsernameHeld if it is
+func checkReservation(col *mgo.Collection, user *User, tenantID string) error {
+	if tenantID != "" {
+		return nil // Reservations only cover the default tenant
+	}
+
+	var reservation usernameReservation
+	query := bson.M{"_id": strings.ToLower(user.Username), "expires": bson.M{"$gt": time.Now()}}
+	err := col.Database.C(ReservationCollectionName).Find(query).One(&reservation)
+	if err == mgo.ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if user.reservationHash == "" || reservation.TokenHash != user.reservationHash {
+		return ErrUsernameHeld
+	}
+	return nil
+}
+
+// Removes the reservation claimed by the user, once they are saved
+// Failures are ignored, as the reservation expires regardless
+func releaseReservation(col *mgo.Collection, user *User) {
+	if user.reservationHash == "" {
+		return
+	}
+	query := bson.M{"_id": strings.ToLower(user.Username), "tokenHash": user.reservationHash}
+	col.Database.C(ReservationCollectionName).Remove(query)
+	user.reservationHash = ""
+}
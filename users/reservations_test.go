@@ -0,0 +1,105 @@
+// Tests for the reservation of usernames by signups in progress
+
+package users
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/njdup/func/db"
+)
+
+// Removes the reservation of the given username, if any
+func removeReservation(name string) error {
+	return db.ExecWithCol(ReservationCollectionName, func(col *mgo.Collection) error {
+		_, err := col.RemoveAll(bson.M{"_id": name})
+		return err
+	})
+}
+
+func TestReserveAndClaim(t *testing.T) {
+	defer removeReservation("reserveduser")
+	token, err := ReserveUsername("ReservedUser", time.Hour)
+	if err != nil {
+		t.Fatal("Error encountered reserving username: ", err)
+	}
+	if _, err := ReserveUsername("reserveduser", time.Hour); err != ErrUsernameHeld {
+		t.Error("Expected reserved username to be held, got: ", err)
+	}
+
+	other := User{Username: "reserveduser", Phonenumber: "+15550140001"}
+	if err := other.Save(); err != ErrUsernameHeld {
+		removeUser(other)
+		t.Error("Expected saving a reserved username to fail, got: ", err)
+	}
+
+	user := User{Phonenumber: "+15550140002"}
+	if err := ClaimReservation(token, &user); err != nil {
+		t.Fatal("Error encountered claiming reservation: ", err)
+	}
+	if user.Username != "ReservedUser" {
+		t.Error("Claiming reservation didn't set the username: ", user.Username)
+	}
+	if err := user.Save(); err != nil {
+		t.Fatal("Failed to save user claiming reservation: ", err)
+	}
+	defer removeUser(user)
+
+	// Saving releases the reservation, leaving the stored user to hold the name
+	if _, err := ReserveUsername("reservedUser", time.Hour); err != ErrDuplicateUsername {
+		t.Error("Expected username of saved user to be taken, got: ", err)
+	}
+}
+
+func TestDoubleClaimRejected(t *testing.T) {
+	defer removeReservation("claimedtwice")
+	token, err := ReserveUsername("claimedTwice", time.Hour)
+	if err != nil {
+		t.Fatal("Error encountered reserving username: ", err)
+	}
+
+	var first, second User
+	if err := ClaimReservation(token, &first); err != nil {
+		t.Fatal("Error encountered claiming reservation: ", err)
+	}
+	if err := ClaimReservation(token, &second); err != ErrInvalidReservation {
+		t.Error("Expected second claim to be rejected, got: ", err)
+	}
+	if second.Username != "" {
+		t.Error("Rejected claim set the username: ", second.Username)
+	}
+	if err := ClaimReservation("not-a-token", &second); err != ErrInvalidReservation {
+		t.Error("Expected unknown token to be rejected, got: ", err)
+	}
+}
+
+func TestReservationExpiry(t *testing.T) {
+	defer removeReservation("expiringname")
+	if _, err := ReserveUsername("expiringName", 0); err != ErrInvalidTokenTTL {
+		t.Error("Expected ErrInvalidTokenTTL for a zero ttl, got: ", err)
+	}
+	token, err := ReserveUsername("expiringName", time.Millisecond)
+	if err != nil {
+		t.Fatal("Error encountered reserving username: ", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	var late User
+	if err := ClaimReservation(token, &late); err != ErrInvalidReservation {
+		t.Error("Expected expired reservation to be rejected, got: ", err)
+	}
+
+	// Expired reservations no longer hold the username
+	if _, err := ReserveUsername("expiringName", time.Hour); err != nil {
+		t.Error("Expected expired reservation to be taken over, got: ", err)
+	}
+	removeReservation("expiringname")
+	user := User{Username: "expiringName", Phonenumber: "+15550140003"}
+	if err := user.Save(); err != nil {
+		t.Error("Failed to save user with an expired reservation's username: ", err)
+	}
+	removeUser(user)
+}
@@ -0,0 +1,213 @@
+// Handling of the roles granted to users
+
+package users
+
+import (
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/njdup/func/db"
+)
+
+var (
+	// Role at least one live user must always hold, so administrators can't
+	// all be demoted or deleted, see ErrLastAdmin
+	// Set to empty to disable the guard.
+	AdminRole = "admin"
+)
+
+// Returns the number of users holding each role, keyed by role name, in a
+// single aggregation
+// Soft deleted and erased users aren't counted, and roles nobody holds are
+// absent from the result.
+func RoleCounts() (map[string]int, error) {
+	pipeline := []bson.M{
+		{"$match": liveQuery(bson.M{"roles": bson.M{"$exists": true}})},
+		{"$unwind": "$roles"},
+		{"$group": bson.M{"_id": "$roles", "count": bson.M{"$sum": 1}}},
+	}
+
+	result := make(map[string]int)
+	countQuery := func(col *mgo.Collection) error {
+		var group struct {
+			Role  string `bson:"_id"`
+			Count int    `bson:"count"`
+		}
+		iter := col.Pipe(pipeline).Iter()
+		for iter.Next(&group) {
+			result[group.Role] = group.Count
+		}
+		return iter.Close()
+	}
+
+	if err := db.ExecWithCol(CollectionName, countQuery); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Grants the given role to each of the users with the given hex encoded ids,
+// in a single update
+// Returns the number of users newly granted the role, so users already
+// holding it aren't counted. Returns ErrInvalidId if any id is malformed, in
+// which case no user is updated.
+func AddRoleToUsers(hexIDs []string, role string) (int, error) {
+	return updateRoles(hexIDs, role, true)
+}
+
+// Revokes the given role from each of the users with the given hex encoded
+// ids, in a single update
+// Returns the number of users the role was revoked from, see AddRoleToUsers,
+// or ErrLastAdmin if revoking AdminRole would leave no user holding it.
+func RemoveRoleFromUsers(hexIDs []string, role string) (int, error) {
+	return updateRoles(hexIDs, role, false)
+}
+
+// Checks whether the user has been granted the given role
+func (user *User) HasRole(role string) bool {
+	if user == nil {
+		return false
+	}
+	for _, held := range user.Roles {
+		if held == role {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the permissions granted by the user's roles, as given by roleMap,
+// each listed once in the order their roles were granted
+// Roles missing from roleMap grant no permissions.
+func (user *User) Permissions(roleMap map[string][]string) []string {
+	permissions := make([]string, 0)
+	if user == nil {
+		return permissions
+	}
+	seen := make(map[string]bool)
+	for _, role := range user.Roles {
+		for _, permission := range roleMap[role] {
+			if !seen[permission] {
+				seen[permission] = true
+				permissions = append(permissions, permission)
+			}
+		}
+	}
+	return permissions
+}
+
+// Finds the user with the given hex encoded id like FindByID, along with
+// the permissions granted by their roles, see Permissions
+func FindByIDWithPermissions(hexID string, roleMap map[string][]string) (*User, []string, error) {
+	user, err := FindByID(hexID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &user, user.Permissions(roleMap), nil
+}
+
+/*
+ * Helper Functions
+ */
+
+// Runs remove, which takes AdminRole away from the users with the given ids,
+// unless that would leave no live user holding AdminRole
+// Admins are counted again once remove is applied, and undo is run if none
+// is left, so concurrent removals can't together remove every admin: at
+// worst each of them is undone. Returns ErrLastAdmin if no admin would be
+// left.
+func guardLastAdmin(col *mgo.Collection, ids []bson.ObjectId, remove, undo func() error) error {
+	if AdminRole == "" {
+		return remove()
+	}
+	affected, err := col.Find(liveQuery(bson.M{"_id": bson.M{"$in": ids}, "roles": AdminRole})).Count()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return remove()
+	}
+	others, err := col.Find(liveQuery(bson.M{"_id": bson.M{"$nin": ids}, "roles": AdminRole})).Count()
+	if err != nil {
+		return err
+	}
+	if others == 0 {
+		return ErrLastAdmin
+	}
+
+	if err := remove(); err != nil {
+		return err
+	}
+	remaining, err := col.Find(liveQuery(bson.M{"roles": AdminRole})).Count()
+	if err == nil && remaining != 0 {
+		return nil
+	}
+	if undoErr := undo(); undoErr != nil {
+		return undoErr
+	}
+	if err != nil {
+		return err
+	}
+	return ErrLastAdmin
+}
+
+// Grants the given role to the users with the given ids if grant is set,
+// otherwise revokes it, returning the number of users changed
+func updateRoles(hexIDs []string, role string, grant bool) (int, error) {
+	if err := checkWritable(); err != nil {
+		return 0, err
+	}
+	if role == "" {
+		return 0, ErrInvalidRole
+	}
+	ids := make([]bson.ObjectId, 0, len(hexIDs))
+	for _, hexId := range hexIDs {
+		if !bson.IsObjectIdHex(hexId) {
+			return 0, ErrInvalidId
+		}
+		ids = append(ids, bson.ObjectIdHex(hexId))
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	// Only users whose roles change are matched, so the count is exact
+	query := liveQuery(bson.M{"_id": bson.M{"$in": ids}, "roles": role})
+	update := bson.M{"$pull": bson.M{"roles": role}}
+	if grant {
+		query["roles"] = bson.M{"$ne": role}
+		update = bson.M{"$addToSet": bson.M{"roles": role}}
+	}
+
+	changed := 0
+	updateQuery := func(col *mgo.Collection) error {
+		apply := func() error {
+			info, err := col.UpdateAll(query, touched(update, time.Now()))
+			if err != nil {
+				return err
+			}
+			changed = info.Updated
+			return nil
+		}
+		if grant || role != AdminRole {
+			return apply()
+		}
+
+		var demoted []bson.ObjectId
+		if err := col.Find(query).Distinct("_id", &demoted); err != nil {
+			return err
+		}
+		restore := func() error {
+			changed = 0
+			_, err := col.UpdateAll(bson.M{"_id": bson.M{"$in": demoted}}, bson.M{"$addToSet": bson.M{"roles": role}})
+			return err
+		}
+		return guardLastAdmin(col, demoted, apply, restore)
+	}
+
+	err := db.ExecWithCol(CollectionName, updateQuery)
+	cachedUsers.clear()
+	return changed, err
+}
@@ -0,0 +1,187 @@
+// Tests for the roles granted to users
+
+package users
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRoleCounts(t *testing.T) {
+	baseline, err := RoleCounts()
+	if err != nil {
+		t.Fatal("Error encountered counting roles: ", err)
+	}
+
+	seeded := []User{
+		{Username: "roleAdmin", Phonenumber: "+15550120001", Roles: []string{"testAdmin", "testMember"}},
+		{Username: "roleMember", Phonenumber: "+15550120002", Roles: []string{"testMember"}},
+		{Username: "roleNone", Phonenumber: "+15550120003"},
+		{Username: "roleDeleted", Phonenumber: "+15550120004", Roles: []string{"testMember"}},
+	}
+	for i := range seeded {
+		if err := seeded[i].Save(); err != nil {
+			t.Fatal("Failed to save user in the db: ", seeded[i].ToString())
+		}
+		defer removeUser(seeded[i])
+	}
+	if err := seeded[3].SoftDelete(); err != nil {
+		t.Fatal("Error encountered soft deleting user: ", err)
+	}
+
+	counts, err := RoleCounts()
+	if err != nil {
+		t.Fatal("Error encountered counting roles: ", err)
+	}
+	expected := map[string]int{"testAdmin": 1, "testMember": 2}
+	for role, count := range expected {
+		if counts[role]-baseline[role] != count {
+			t.Errorf("Expected %d users with role %s, got %d", count, role, counts[role]-baseline[role])
+		}
+	}
+}
+
+func TestHasRole(t *testing.T) {
+	user := &User{Roles: []string{"member", SupportRole}}
+	if !user.HasRole(SupportRole) || user.HasRole("admin") || (*User)(nil).HasRole("member") {
+		t.Error("Unexpected roles reported for ", user.Roles)
+	}
+}
+
+func TestPermissions(t *testing.T) {
+	roleMap := map[string][]string{
+		"member": {"posts:read", "posts:write"},
+		"editor": {"posts:write", "posts:publish"},
+		"admin":  {"users:manage", "posts:read"},
+	}
+	user := &User{Roles: []string{"member", "retired", "editor", "admin"}}
+	expected := []string{"posts:read", "posts:write", "posts:publish", "users:manage"}
+	if permissions := user.Permissions(roleMap); !reflect.DeepEqual(permissions, expected) {
+		t.Errorf("Expected permissions %v, got %v", expected, permissions)
+	}
+
+	for _, empty := range []*User{nil, {}, {Roles: []string{"retired"}}} {
+		if permissions := empty.Permissions(roleMap); permissions == nil || len(permissions) != 0 {
+			t.Error("Expected no permissions, got: ", permissions)
+		}
+	}
+}
+
+func TestFindByIDWithPermissions(t *testing.T) {
+	user := User{Username: "permitted", Phonenumber: "+15550330001", Roles: []string{"member", "ghost"}}
+	if err := user.Save(); err != nil {
+		t.Fatal("Failed to save user in the db: ", user.ToString())
+	}
+	defer removeUser(user)
+
+	roleMap := map[string][]string{"member": {"posts:read", "posts:read", "posts:write"}}
+	found, permissions, err := FindByIDWithPermissions(user.Id.Hex(), roleMap)
+	if err != nil || found.Id != user.Id {
+		t.Fatal("Error encountered finding user with permissions: ", err)
+	}
+	if expected := []string{"posts:read", "posts:write"}; !reflect.DeepEqual(permissions, expected) {
+		t.Errorf("Expected permissions %v, got %v", expected, permissions)
+	}
+
+	if _, _, err := FindByIDWithPermissions("not an id", roleMap); err != ErrInvalidId {
+		t.Error("Expected ErrInvalidId for a malformed id, got: ", err)
+	}
+}
+
+func TestBatchRoleUpdates(t *testing.T) {
+	listed := []User{
+		{Username: "promotedOne", Phonenumber: "+15550140001"},
+		{Username: "promotedTwo", Phonenumber: "+15550140002", Roles: []string{"testModerator"}},
+	}
+	unlisted := User{Username: "notPromoted", Phonenumber: "+15550140003"}
+	hexIDs := make([]string, 0, len(listed))
+	for i := range listed {
+		if err := listed[i].Save(); err != nil {
+			t.Fatal("Failed to save user in the db: ", listed[i].ToString())
+		}
+		defer removeUser(listed[i])
+		hexIDs = append(hexIDs, listed[i].Id.Hex())
+	}
+	if err := unlisted.Save(); err != nil {
+		t.Fatal("Failed to save user in the db: ", unlisted.ToString())
+	}
+	defer removeUser(unlisted)
+
+	if _, err := AddRoleToUsers(append(hexIDs, "malformed"), "testModerator"); err != ErrInvalidId {
+		t.Error("Expected malformed id to be rejected, got: ", err)
+	}
+	if added, err := AddRoleToUsers(hexIDs, "testModerator"); err != nil || added != 1 {
+		t.Errorf("Expected the role to be added to 1 user, got %d (%v)", added, err)
+	}
+	if added, err := AddRoleToUsers(hexIDs, "testModerator"); err != nil || added != 0 {
+		t.Errorf("Expected re-adding the role to change nothing, got %d (%v)", added, err)
+	}
+
+	for _, user := range listed {
+		found, err := FindByID(user.Id.Hex())
+		if err != nil || !found.HasRole("testModerator") || len(found.Roles) != 1 {
+			t.Error("Listed user doesn't hold the role exactly once: ", found.Roles, err)
+		}
+	}
+	if found, _ := FindByID(unlisted.Id.Hex()); found.HasRole("testModerator") {
+		t.Error("Role was added to an unlisted user")
+	}
+
+	if removed, err := RemoveRoleFromUsers(hexIDs, "testModerator"); err != nil || removed != 2 {
+		t.Errorf("Expected the role to be removed from 2 users, got %d (%v)", removed, err)
+	}
+}
+
+func TestLastAdminGuard(t *testing.T) {
+	defer func(role string) { AdminRole = role }(AdminRole)
+	AdminRole = "testLastAdmin"
+
+	sole := User{Username: "soleAdmin", Phonenumber: "+15550390001", Roles: []string{AdminRole}}
+	if err := sole.Save(); err != nil {
+		t.Fatal("Failed to save user in the db: ", sole.ToString())
+	}
+	defer removeUser(sole)
+
+	blocked := map[string]func() error{
+		"RemoveRole": func() error { _, err := RemoveRoleFromUsers([]string{sole.Id.Hex()}, AdminRole); return err },
+		"SoftDelete": sole.SoftDelete,
+		"Delete":     sole.Delete,
+		"Erase":      sole.Erase,
+	}
+	for name, remove := range blocked {
+		if err := remove(); err != ErrLastAdmin {
+			t.Errorf("Expected %s of the sole admin to be blocked, got: %v", name, err)
+		}
+	}
+	if found, err := FindByID(sole.Id.Hex()); err != nil || !found.HasRole(AdminRole) {
+		t.Fatal("Expected the sole admin to be kept, got: ", err)
+	}
+
+	second := User{Username: "secondAdmin", Phonenumber: "+15550390002", Roles: []string{AdminRole}}
+	if err := second.Save(); err != nil {
+		t.Fatal("Failed to save user in the db: ", second.ToString())
+	}
+	defer removeUser(second)
+
+	// Demoting both admins at once would still leave none
+	if _, err := RemoveRoleFromUsers([]string{sole.Id.Hex(), second.Id.Hex()}, AdminRole); err != ErrLastAdmin {
+		t.Error("Expected demoting every admin to be blocked, got: ", err)
+	}
+	if changed, err := RemoveRoleFromUsers([]string{sole.Id.Hex()}, AdminRole); err != nil || changed != 1 {
+		t.Fatalf("Expected demoting one of two admins to succeed, got %d (err %v)", changed, err)
+	}
+	if found, _ := FindByID(sole.Id.Hex()); found.HasRole(AdminRole) {
+		t.Error("Expected the demoted admin to lose the role")
+	}
+	if err := second.SoftDelete(); err != ErrLastAdmin {
+		t.Error("Expected the now sole admin to be kept, got: ", err)
+	}
+
+	// Roles other than AdminRole are never guarded
+	if _, err := AddRoleToUsers([]string{sole.Id.Hex()}, "testMember"); err != nil {
+		t.Fatal("Error encountered granting role: ", err)
+	}
+	if changed, err := RemoveRoleFromUsers([]string{sole.Id.Hex()}, "testMember"); err != nil || changed != 1 {
+		t.Errorf("Expected other roles to be revoked freely, got %d (err %v)", changed, err)
+	}
+}
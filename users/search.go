@@ -0,0 +1,58 @@
+// Accent-insensitive search of users by name and username
+//
+// Users store a searchName field, the folded form of their names and
+// username (see foldToASCII), kept current by Save and Update, so searching
+// for "jose" finds "José".
+
+package users
+
+import (
+	"context"
+	"regexp"
+	"strings"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Returns the page of users whose name or username holds every term of the
+// given query, ignoring case and accents, ordered by id
+// Terms are separated by whitespace and match anywhere in the names. An
+// empty query matches no users. The page is normalized with
+// NormalizePagination.
+func SearchUsers(query string, offset, limit int) ([]*User, error) {
+	terms := strings.Fields(foldToASCII(query))
+	if len(terms) == 0 {
+		return make([]*User, 0), nil
+	}
+
+	conditions := make([]bson.M, len(terms))
+	for i, term := range terms {
+		conditions[i] = bson.M{"searchName": bson.RegEx{Pattern: regexp.QuoteMeta(term)}}
+	}
+	return listMatchingUsersContext(context.Background(), bson.M{"$and": conditions}, offset, limit, "_id")
+}
+
+/*
+ * Helper Functions
+ */
+
+// Returns the searchName stored for the user
+func searchNameFor(user *User) string {
+	return strings.Join(strings.Fields(foldToASCII(user.Firstname+" "+user.Lastname+" "+user.Username)), " ")
+}
+
+// Stores the searchName of users saved before users were searchable
+func backfillSearchName(col *mgo.Collection) error {
+	var stored User
+	query := bson.M{"searchName": bson.M{"$exists": false}}
+	iter := col.Find(query).Select(bson.M{"firstName": 1, "lastName": 1, "userName": 1}).Iter()
+	for iter.Next(&stored) {
+		update := bson.M{"$set": bson.M{"searchName": searchNameFor(&stored)}}
+		if err := col.UpdateId(stored.Id, update); err != nil {
+			iter.Close()
+			return err
+		}
+	}
+	return iter.Close()
+}
@@ -0,0 +1,52 @@
+// Tests for accent-insensitive search of users
+
+package users
+
+import (
+	"testing"
+)
+
+func TestSearchUsers(t *testing.T) {
+	user := User{Username: "josesearch", Phonenumber: "+15550250001", Firstname: "José", Lastname: "Muñoz"}
+	if err := user.Save(); err != nil {
+		t.Fatal("Failed to save user in the db: ", user.ToString())
+	}
+	defer removeUser(user)
+	if user.SearchName != "jose munoz josesearch" {
+		t.Error("Unexpected search name stored: ", user.SearchName)
+	}
+
+	found := func(query string) bool {
+		results, err := SearchUsers(query, 0, MaxPageSize)
+		if err != nil {
+			t.Fatal("Error encountered searching users: ", err)
+		}
+		for _, result := range results {
+			if result.Id == user.Id {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, query := range []string{"jose", "JOSÉ", "munoz jose", "Muñoz", "josesearch"} {
+		if !found(query) {
+			t.Errorf("Expected %q to find %s %s", query, user.Firstname, user.Lastname)
+		}
+	}
+	if found("jose garcia") {
+		t.Error("Expected every search term to be required")
+	}
+
+	user.Lastname = "García"
+	if err := user.Update(); err != nil {
+		t.Fatal("Error encountered updating user: ", err)
+	}
+	if !found("jose garcia") || found("munoz") {
+		t.Error("Search name wasn't updated with the changed name: ", user.SearchName)
+	}
+
+	if results, err := SearchUsers("  ", 0, 10); err != nil || len(results) != 0 {
+		t.Error("Expected an empty query to match no users, got: ", len(results), err)
+	}
+}
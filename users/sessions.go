@@ -0,0 +1,195 @@
+// Session tokens keeping users logged in across requests
+//
+// Sessions are held in their own collection, and only the hash of a
+// session's token is kept. Expired sessions stop resolving immediately, and
+// are removed through a TTL index, see EnsureIndexes.
+
+package users
+
+import (
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/njdup/func/db"
+	"github.com/njdup/func/utils/security"
+)
+
+// What NewSessionToken does with a user at MaxActiveSessions, see
+// SessionLimitMode
+const (
+	SessionLimitEvictOldest = "evict"  // End the user's oldest sessions to make room
+	SessionLimitReject      = "reject" // Refuse the new session with ErrTooManySessions
+)
+
+var (
+	SessionCollectionName = "userSessions"      // Name of the collection holding sessions
+	SessionTTL            = 30 * 24 * time.Hour // How long new sessions last
+
+	// Largest number of sessions a user may have active at once, unlimited
+	// when zero
+	// Concurrent logins may briefly exceed the cap, as sessions are counted
+	// before the new one is stored.
+	MaxActiveSessions = 0
+	// What happens to new sessions beyond MaxActiveSessions
+	SessionLimitMode = SessionLimitEvictOldest
+)
+
+// A logged in session of a user
+type session struct {
+	Id        bson.ObjectId `bson:"_id,omitempty"`
+	UserId    bson.ObjectId `bson:"userId"`
+	TokenHash string        `bson:"tokenHash"`
+	Created   time.Time     `bson:"created"`
+	Expires   time.Time     `bson:"expires"`
+}
+
+// Starts a session for the stored user, returning its token, valid for
+// SessionTTL, see ResolveSession
+// Users already at MaxActiveSessions have their oldest sessions ended, or
+// the new session refused, depending on SessionLimitMode.
+// Returns ErrUserNotFound if the user isn't stored, or ErrTooManySessions if
+// the new session was refused.
+func (user *User) NewSessionToken() (string, error) {
+	if user == nil || user.Id == "" {
+		return "", ErrUserNotFound
+	}
+	if err := checkWritable(); err != nil {
+		return "", err
+	}
+	token, err := security.NewToken()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	createQuery := func(col *mgo.Collection) error {
+		if _, err := loadStoredUser(col, user.Id); err != nil {
+			return err
+		}
+		sessions := col.Database.C(SessionCollectionName)
+		if err := enforceSessionLimit(sessions, user.Id, now); err != nil {
+			return err
+		}
+		return sessions.Insert(&session{
+			UserId:    user.Id,
+			TokenHash: security.HashToken(token),
+			Created:   now,
+			Expires:   now.Add(SessionTTL),
+		})
+	}
+
+	if err := db.ExecWithCol(CollectionName, createQuery); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Returns the user logged in with the given session token
+// Returns ErrInvalidSession if the token is unknown or expired, or if its
+// user is no longer stored or was disabled.
+func ResolveSession(token string) (*User, error) {
+	if token == "" {
+		return nil, ErrInvalidSession
+	}
+
+	var user *User
+	resolveQuery := func(col *mgo.Collection) error {
+		var found session
+		query := bson.M{"tokenHash": security.HashToken(token), "expires": bson.M{"$gt": time.Now()}}
+		if err := col.Database.C(SessionCollectionName).Find(query).One(&found); err == mgo.ErrNotFound {
+			return ErrInvalidSession
+		} else if err != nil {
+			return err
+		}
+
+		var err error
+		if user, err = loadStoredUser(col, found.UserId); err != nil {
+			return err
+		}
+		if !user.Active {
+			return ErrInvalidSession
+		}
+		return nil
+	}
+
+	err := db.ExecWithCol(CollectionName, resolveQuery)
+	if err == ErrUserNotFound {
+		err = ErrInvalidSession
+	}
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// Counts the user's sessions that haven't expired
+func (user *User) ActiveSessionCount() (int, error) {
+	if user == nil {
+		return 0, ErrNilUser
+	}
+	var count int
+	countQuery := func(col *mgo.Collection) error {
+		var err error
+		count, err = col.Find(activeSessionsQuery(user.Id, time.Now())).Count()
+		return err
+	}
+
+	err := db.ExecWithCol(SessionCollectionName, countQuery)
+	return count, err
+}
+
+// Ends every session of the user in one operation, such as after their
+// password changed, so stolen session tokens stop resolving
+func (user *User) RevokeAllSessions() error {
+	if user == nil || user.Id == "" {
+		return ErrUserNotFound
+	}
+	if err := checkWritable(); err != nil {
+		return err
+	}
+	revokeQuery := func(col *mgo.Collection) error {
+		_, err := col.RemoveAll(bson.M{"userId": user.Id})
+		return err
+	}
+
+	return db.ExecWithCol(SessionCollectionName, revokeQuery)
+}
+
+/*
+ * Helper Functions
+ */
+
+// Makes room for a new session of the user under MaxActiveSessions, by
+// ending their oldest sessions or returning ErrTooManySessions
+func enforceSessionLimit(sessions *mgo.Collection, userId bson.ObjectId, now time.Time) error {
+	if MaxActiveSessions <= 0 {
+		return nil
+	}
+	query := activeSessionsQuery(userId, now)
+	count, err := sessions.Find(query).Count()
+	if err != nil || count < MaxActiveSessions {
+		return err
+	}
+	if SessionLimitMode == SessionLimitReject {
+		return ErrTooManySessions
+	}
+
+	var oldest []session
+	excess := count - MaxActiveSessions + 1
+	if err := sessions.Find(query).Sort("created", "_id").Limit(excess).Select(bson.M{"_id": 1}).All(&oldest); err != nil {
+		return err
+	}
+	ids := make([]bson.ObjectId, len(oldest))
+	for i, evicted := range oldest {
+		ids[i] = evicted.Id
+	}
+	_, err = sessions.RemoveAll(bson.M{"_id": bson.M{"$in": ids}})
+	return err
+}
+
+// Returns a query matching the user's sessions that haven't expired
+func activeSessionsQuery(userId bson.ObjectId, now time.Time) bson.M {
+	return bson.M{"userId": userId, "expires": bson.M{"$gt": now}}
+}
@@ -0,0 +1,133 @@
+// Tests for session tokens and the cap on active sessions
+
+package users
+
+import (
+	"testing"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/njdup/func/db"
+)
+
+// Removes every session of the given user
+func removeSessions(user User) error {
+	return db.ExecWithCol(SessionCollectionName, func(col *mgo.Collection) error {
+		_, err := col.RemoveAll(bson.M{"userId": user.Id})
+		return err
+	})
+}
+
+func TestSessionLimitEviction(t *testing.T) {
+	user := User{Username: "sessionEvicted", Phonenumber: "+15550200001"}
+	if err := user.Save(); err != nil {
+		t.Fatal("Failed to save user in the db: ", user.ToString())
+	}
+	defer removeUser(user)
+	defer removeSessions(user)
+
+	defer func(max int, mode string) { MaxActiveSessions, SessionLimitMode = max, mode }(MaxActiveSessions, SessionLimitMode)
+	MaxActiveSessions, SessionLimitMode = 2, SessionLimitEvictOldest
+
+	tokens := make([]string, 3)
+	for i := range tokens {
+		var err error
+		if tokens[i], err = user.NewSessionToken(); err != nil {
+			t.Fatal("Error encountered starting session: ", err)
+		}
+	}
+
+	if count, err := user.ActiveSessionCount(); err != nil || count != 2 {
+		t.Errorf("Expected the cap of 2 active sessions, got %d (err %v)", count, err)
+	}
+	if _, err := ResolveSession(tokens[0]); err != ErrInvalidSession {
+		t.Error("Expected the oldest session to be evicted, got: ", err)
+	}
+	for _, token := range tokens[1:] {
+		if found, err := ResolveSession(token); err != nil || found.Id != user.Id {
+			t.Error("Expected newer sessions to remain, got: ", err)
+		}
+	}
+}
+
+func TestSessionLimitRejection(t *testing.T) {
+	user := User{Username: "sessionRejected", Phonenumber: "+15550200002"}
+	if err := user.Save(); err != nil {
+		t.Fatal("Failed to save user in the db: ", user.ToString())
+	}
+	defer removeUser(user)
+	defer removeSessions(user)
+
+	defer func(max int, mode string) { MaxActiveSessions, SessionLimitMode = max, mode }(MaxActiveSessions, SessionLimitMode)
+	MaxActiveSessions, SessionLimitMode = 2, SessionLimitReject
+
+	for i := 0; i < 2; i++ {
+		if _, err := user.NewSessionToken(); err != nil {
+			t.Fatal("Error encountered starting session below the cap: ", err)
+		}
+	}
+	if _, err := user.NewSessionToken(); err != ErrTooManySessions {
+		t.Error("Expected session beyond the cap to be rejected, got: ", err)
+	}
+	if count, err := user.ActiveSessionCount(); err != nil || count != 2 {
+		t.Errorf("Expected 2 active sessions, got %d (err %v)", count, err)
+	}
+	if _, err := ResolveSession("not-a-token"); err != ErrInvalidSession {
+		t.Error("Expected unknown session token to be rejected, got: ", err)
+	}
+}
+
+func TestRevokeSessionsOnPasswordChange(t *testing.T) {
+	user := User{Username: "sessionRevoked", Phonenumber: "+15550200003"}
+	if err := user.SetPassword("original password"); err != nil {
+		t.Fatal("Error encountered setting password: ", err)
+	}
+	if err := user.Save(); err != nil {
+		t.Fatal("Failed to save user in the db: ", user.ToString())
+	}
+	defer removeUser(user)
+	defer removeSessions(user)
+
+	startSessions := func() []string {
+		tokens := make([]string, 2)
+		for i := range tokens {
+			var err error
+			if tokens[i], err = user.NewSessionToken(); err != nil {
+				t.Fatal("Error encountered starting session: ", err)
+			}
+			if _, err := ResolveSession(tokens[i]); err != nil {
+				t.Fatal("Expected new session to resolve, got: ", err)
+			}
+		}
+		return tokens
+	}
+	expectRevoked := func(tokens []string, change string) {
+		for _, token := range tokens {
+			if _, err := ResolveSession(token); err != ErrInvalidSession {
+				t.Errorf("Expected sessions to be revoked by %s, got: %v", change, err)
+			}
+		}
+	}
+
+	tokens := startSessions()
+	if err := user.ChangePassword("wrong password", "chosen password"); err == nil {
+		t.Fatal("Expected the change with a wrong password to be rejected")
+	}
+	if count, _ := user.ActiveSessionCount(); count != 2 {
+		t.Error("Expected a rejected change to keep the sessions, got: ", count)
+	}
+	if err := user.ChangePassword("original password", "chosen password"); err != nil {
+		t.Fatal("Error encountered changing password: ", err)
+	}
+	expectRevoked(tokens, "ChangePassword")
+
+	tokens = startSessions()
+	if err := user.AdminSetPassword("temporary password", true); err != nil {
+		t.Fatal("Error encountered resetting password: ", err)
+	}
+	expectRevoked(tokens, "AdminSetPassword")
+	if count, _ := user.ActiveSessionCount(); count != 0 {
+		t.Error("Expected no active sessions left, got: ", count)
+	}
+}
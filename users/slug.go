@@ -0,0 +1,99 @@
+// Generation of URL-safe slugs for user profile URLs
+
+package users
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/njdup/func/db"
+)
+
+const (
+	fallbackSlug    = "user" // Used when a username has no characters that survive slugging
+	maxSlugAttempts = 5      // Inserts tried by Save while concurrent saves take its slug
+)
+
+// Returns a lowercased, ASCII, hyphen-separated slug derived from the username
+// Diacritics are stripped ("José" becomes "jose") and runs of punctuation or
+// whitespace collapse into a single hyphen
+// The slug isn't guaranteed to be unique, see EnsureUniqueSlug
+func (user *User) Slug() string {
+	if user == nil {
+		return fallbackSlug
+	}
+	var slug strings.Builder
+	pendingHyphen := false
+	for _, r := range foldToASCII(user.Username) {
+		if ('a' <= r && r <= 'z') || ('0' <= r && r <= '9') {
+			if pendingHyphen && slug.Len() > 0 {
+				slug.WriteByte('-')
+			}
+			slug.WriteRune(r)
+			pendingHyphen = false
+		} else {
+			pendingHyphen = true
+		}
+	}
+
+	if slug.Len() == 0 {
+		return fallbackSlug
+	}
+	return slug.String()
+}
+
+// Returns the given slug if no user holds it yet, otherwise the first of
+// base-2, base-3, ... that is free
+func EnsureUniqueSlug(base string) (string, error) {
+	var result string
+	slugQuery := func(col *mgo.Collection) error {
+		var err error
+		result, err = uniqueSlug(col, base)
+		return err
+	}
+
+	err := db.ExecWithCol(CollectionName, slugQuery)
+	return result, err
+}
+
+/*
+ * Helper Functions
+ */
+
+// Finds the first free slug for base within the given collection
+// The taken slugs of base are read in a single query, through the slug index
+// created by EnsureIndexes.
+func uniqueSlug(col *mgo.Collection, base string) (string, error) {
+	var stored struct {
+		Slug string `bson:"slug"`
+	}
+	pattern := bson.RegEx{Pattern: "^" + regexp.QuoteMeta(base) + "(-[0-9]+)?$"}
+	taken := make(map[string]bool)
+	iter := col.Find(bson.M{"slug": pattern}).Select(bson.M{"slug": 1}).Iter()
+	for iter.Next(&stored) {
+		taken[stored.Slug] = true
+	}
+	if err := iter.Close(); err != nil {
+		return "", err
+	}
+
+	candidate := base
+	for suffix := 2; taken[candidate]; suffix++ {
+		candidate = base + "-" + strconv.Itoa(suffix)
+	}
+	return candidate, nil
+}
+
+// Checks whether the given error reports a write rejected by the unique
+// slug index
+func isDuplicateSlug(err error) bool {
+	if !mgo.IsDup(err) {
+		return false
+	}
+	match := duplicateIndexPattern.FindStringSubmatch(err.Error())
+	return match != nil && strings.HasPrefix(match[1], "slug_")
+}
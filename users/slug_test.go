@@ -0,0 +1,67 @@
+// Tests for profile slug generation
+
+package users
+
+import (
+	"errors"
+	"testing"
+
+	"gopkg.in/mgo.v2"
+)
+
+func TestSlug(t *testing.T) {
+	cases := map[string]string{
+		"user":              "user",
+		"José Ñúñez":        "jose-nunez",
+		"Mr. O'Brien!!":     "mr-o-brien",
+		"  --Straße 42--  ": "strasse-42",
+		"Crème_Brûlée":      "creme-brulee",
+		"!!!":               fallbackSlug,
+	}
+
+	for username, expected := range cases {
+		user := User{Username: username}
+		if slug := user.Slug(); slug != expected {
+			t.Errorf("Slug for %q was %q, expected %q", username, slug, expected)
+		}
+	}
+}
+
+func TestUniqueSlugs(t *testing.T) {
+	first := User{Username: "Slug Tester", Phonenumber: "+15550003001"}
+	second := User{Username: "slug-tester!", Phonenumber: "+15550003002"}
+	for _, user := range []*User{&first, &second} {
+		if err := user.Save(); err != nil {
+			t.Fatal("Failed to save user in the db: ", user.ToString())
+		}
+		defer removeUser(*user)
+	}
+
+	if first.ProfileSlug != "slug-tester" {
+		t.Error("Unexpected slug for first user: ", first.ProfileSlug)
+	}
+	if second.ProfileSlug != "slug-tester-2" {
+		t.Error("Colliding slug wasn't suffixed: ", second.ProfileSlug)
+	}
+
+	next, err := EnsureUniqueSlug("slug-tester")
+	if err != nil {
+		t.Fatal("Error encountered ensuring unique slug: ", err)
+	}
+	if next != "slug-tester-3" {
+		t.Error("Expected the next free suffix, got: ", next)
+	}
+}
+
+func TestIsDuplicateSlug(t *testing.T) {
+	slugTaken := &mgo.LastError{Code: 11000, Err: `E11000 duplicate key error collection: func.users index: slug_1 dup key: { : "jose" }`}
+	if !isDuplicateSlug(slugTaken) {
+		t.Error("Expected a rejected slug to be recognized: ", slugTaken)
+	}
+	emailTaken := &mgo.LastError{Code: 11000, Err: `E11000 duplicate key error collection: func.users index: email_1 dup key: { : "a@example.com" }`}
+	for _, err := range []error{emailTaken, errors.New("connection reset"), nil} {
+		if isDuplicateSlug(err) {
+			t.Error("Expected only rejected slugs to be recognized, got: ", err)
+		}
+	}
+}
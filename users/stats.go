@@ -0,0 +1,164 @@
+// Reporting helpers giving aggregate information about the users collection
+
+package users
+
+import (
+	"context"
+	"regexp"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/njdup/func/db"
+)
+
+// Returns an estimate of the number of stored users
+// The estimate is read from the collection metadata kept by the storage engine
+// rather than scanning documents, so it is cheap but approximate: it may be
+// off after unclean shutdowns or while writes are in flight. Use it for
+// dashboards, not for logic that needs an exact count.
+func EstimatedUserCount() (int64, error) {
+	var stats struct {
+		Count int64 `bson:"count"`
+	}
+	statsQuery := func(col *mgo.Collection) error {
+		return col.Database.Run(bson.D{{"collStats", col.Name}}, &stats)
+	}
+
+	err := db.ExecWithCol(CollectionName, statsQuery)
+	return stats.Count, err
+}
+
+// The StorageStats struct reports the size of the users collection, as
+// returned by CollectionStats
+// Sizes are in bytes, and include soft deleted and erased users.
+type StorageStats struct {
+	Count         int64 `bson:"count" json:"count"`             // Number of stored documents
+	AvgObjectSize int64 `bson:"avgObjSize" json:"avgObjSize"`   // Average size of a document
+	Size          int64 `bson:"size" json:"size"`               // Uncompressed size of all documents
+	StorageSize   int64 `bson:"storageSize" json:"storageSize"` // Space allocated on disk
+}
+
+// Returns the size of the users collection, for capacity planning
+// The figures are read from the storage engine through the collStats
+// command, so like EstimatedUserCount they are cheap but approximate.
+func CollectionStats() (StorageStats, error) {
+	var stats StorageStats
+	statsQuery := func(col *mgo.Collection) error {
+		return col.Database.Run(bson.D{{"collStats", col.Name}}, &stats)
+	}
+
+	err := db.ExecWithCol(CollectionName, statsQuery)
+	return stats, err
+}
+
+// Counts the users inserted within the trailing window, so bursts of signups
+// can be rate limited or alerted on
+// Users deleted or erased since signing up are counted too
+func SignupRate(window time.Duration) (int, error) {
+	return countSignups(bson.M{}, window)
+}
+
+// Counts the users inserted within the trailing window whose phonenumber
+// starts with the given prefix, such as "+1555", for bursts from one area
+// Users whose plaintext phonenumber isn't stored, see PhonePrivacy, can't be
+// matched and are never counted
+func SignupRateByPhonePrefix(prefix string, window time.Duration) (int, error) {
+	query := bson.M{"phoneNumber": bson.RegEx{Pattern: "^" + regexp.QuoteMeta(prefix)}}
+	return countSignups(query, window)
+}
+
+// Returns the most recently inserted user, excluding soft deleted and erased
+// users
+// Returns ErrUserNotFound if there are no such users
+func NewestUser() (*User, error) {
+	return firstUserBy("-inserted", "-_id")
+}
+
+// Returns the earliest inserted user, excluding soft deleted and erased users
+// Returns ErrUserNotFound if there are no such users
+func OldestUser() (*User, error) {
+	return firstUserBy("inserted", "_id")
+}
+
+// Sets the insertion time of users stored without one, such as legacy or
+// manually inserted documents, so age calculations and sorting hold
+// The time is derived from the user's ObjectId, which embeds its creation
+// time, falling back to the given time for users with other kinds of ids.
+// Returns the number of users updated.
+func BackfillInsertedTimestamps(fallback time.Time) (int, error) {
+	if err := checkWritable(); err != nil {
+		return 0, err
+	}
+	updated := 0
+	backfillQuery := func(col *mgo.Collection) error {
+		var stored struct {
+			Id interface{} `bson:"_id"`
+		}
+		iter := col.Find(missingInsertedQuery()).Select(bson.M{"_id": 1}).Iter()
+		for iter.Next(&stored) {
+			inserted := fallback
+			if id, ok := stored.Id.(bson.ObjectId); ok && id.Valid() {
+				inserted = id.Time()
+			}
+
+			query := missingInsertedQuery()
+			query["_id"] = stored.Id
+			err := col.Update(query, bson.M{"$set": bson.M{"inserted": inserted}})
+			if err == mgo.ErrNotFound {
+				continue // Backfilled concurrently
+			} else if err != nil {
+				iter.Close()
+				return err
+			}
+			updated++
+		}
+		return iter.Close()
+	}
+
+	err := db.ExecWithCol(CollectionName, backfillQuery)
+	if updated != 0 {
+		cachedUsers.clear()
+	}
+	return updated, err
+}
+
+/*
+ * Helper Functions
+ */
+
+// Returns a query matching users whose insertion time is missing, null or
+// the zero time
+func missingInsertedQuery() bson.M {
+	return bson.M{"$or": []bson.M{
+		{"inserted": nil},
+		{"inserted": time.Time{}},
+	}}
+}
+
+// Returns the first user in the given sort order, see NewestUser
+func firstUserBy(sort ...string) (*User, error) {
+	users, err := listMatchingUsersContext(context.Background(), bson.M{}, 0, 1, sort...)
+	if err != nil {
+		return nil, err
+	}
+	if len(users) == 0 {
+		return nil, ErrUserNotFound
+	}
+	return users[0], nil
+}
+
+// Counts the users matching the given query inserted within the trailing window
+func countSignups(query bson.M, window time.Duration) (int, error) {
+	query["inserted"] = bson.M{"$gte": time.Now().Add(-window)}
+	count := 0
+	countQuery := func(col *mgo.Collection) error {
+		var err error
+		count, err = col.Find(query).Count()
+		return err
+	}
+
+	err := db.ExecWithCol(CollectionName, countQuery)
+	return count, err
+}
@@ -0,0 +1,176 @@
+// Tests for the users collection reporting helpers
+
+package users
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/njdup/func/db"
+)
+
+func TestEstimatedUserCount(t *testing.T) {
+	for _, user := range validUsers {
+		if err := user.Save(); err != nil {
+			t.Fatal("Failed to save user in the db: ", user.ToString())
+		}
+		defer removeUser(user)
+	}
+
+	count, err := EstimatedUserCount()
+	if err != nil {
+		t.Fatal("Error encountered estimating user count: ", err)
+	}
+	if count < int64(len(validUsers)) {
+		t.Errorf("Estimated count %d is below the %d seeded users", count, len(validUsers))
+	}
+}
+
+func TestCollectionStats(t *testing.T) {
+	for _, user := range validUsers {
+		if err := user.Save(); err != nil {
+			t.Fatal("Failed to save user in the db: ", user.ToString())
+		}
+		defer removeUser(user)
+	}
+
+	stats, err := CollectionStats()
+	if err != nil {
+		t.Fatal("Error encountered reading collection stats: ", err)
+	}
+	if stats.Count < int64(len(validUsers)) {
+		t.Errorf("Stats count %d is below the %d seeded users", stats.Count, len(validUsers))
+	}
+	if stats.AvgObjectSize <= 0 || stats.Size <= 0 || stats.StorageSize < 0 {
+		t.Error("Expected sizes of a seeded collection to be populated: ", stats)
+	}
+}
+
+func TestSignupRate(t *testing.T) {
+	window := time.Hour
+	baseline, err := SignupRate(window)
+	if err != nil {
+		t.Fatal("Error encountered counting signups: ", err)
+	}
+	prefixBaseline, err := SignupRateByPhonePrefix("+1555006", window)
+	if err != nil {
+		t.Fatal("Error encountered counting signups by prefix: ", err)
+	}
+
+	now := time.Now()
+	seeded := []User{
+		{Username: "burst1", Phonenumber: "+15550060001", Inserted: now.Add(-time.Minute)},
+		{Username: "burst2", Phonenumber: "+15550060002", Inserted: now.Add(-30 * time.Minute)},
+		{Username: "burstOther", Phonenumber: "+14440060003", Inserted: now.Add(-time.Minute)},
+		{Username: "burstStale", Phonenumber: "+15550060004", Inserted: now.Add(-2 * window)},
+	}
+	for i := range seeded {
+		seeded[i].Id = bson.NewObjectId()
+		user := seeded[i]
+		err := db.ExecWithCol(CollectionName, func(col *mgo.Collection) error {
+			return col.Insert(&user)
+		})
+		if err != nil {
+			t.Fatal("Error encountered seeding signup: ", err)
+		}
+		defer removeUser(user)
+	}
+
+	if count, err := SignupRate(window); err != nil || count != baseline+3 {
+		t.Errorf("Expected %d signups in the window, got %d (%v)", baseline+3, count, err)
+	}
+	if count, err := SignupRateByPhonePrefix("+1555006", window); err != nil || count != prefixBaseline+2 {
+		t.Errorf("Expected %d signups for the prefix, got %d (%v)", prefixBaseline+2, count, err)
+	}
+}
+
+func TestNewestAndOldestUser(t *testing.T) {
+	now := time.Now()
+	seeded := []User{
+		{Username: "boundaryNewest", Phonenumber: "+15550160001", Inserted: now.Add(time.Hour)},
+		{Username: "boundaryOldest", Phonenumber: "+15550160002", Inserted: time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{Username: "boundaryDeleted", Phonenumber: "+15550160003", Inserted: now.Add(2 * time.Hour), DeletedAt: now},
+		{Username: "boundaryErased", Phonenumber: "+15550160004", Inserted: time.Date(1999, 1, 1, 0, 0, 0, 0, time.UTC), Erased: true},
+	}
+	for i := range seeded {
+		seeded[i].Id = bson.NewObjectId()
+		user := seeded[i]
+		err := db.ExecWithCol(CollectionName, func(col *mgo.Collection) error {
+			return col.Insert(&user)
+		})
+		if err != nil {
+			t.Fatal("Error encountered seeding user: ", err)
+		}
+		defer removeUser(user)
+	}
+
+	if newest, err := NewestUser(); err != nil || newest.Id != seeded[0].Id {
+		t.Error("Wrong newest user found: ", newest, err)
+	}
+	if oldest, err := OldestUser(); err != nil || oldest.Id != seeded[1].Id {
+		t.Error("Wrong oldest user found: ", oldest, err)
+	}
+}
+
+func TestNewestUserOfEmptyCollection(t *testing.T) {
+	defer func(name string) { CollectionName = name }(CollectionName)
+	CollectionName = "emptyUsers"
+	if _, err := NewestUser(); err != ErrUserNotFound {
+		t.Error("Expected ErrUserNotFound for an empty collection, got: ", err)
+	}
+	if _, err := OldestUser(); err != ErrUserNotFound {
+		t.Error("Expected ErrUserNotFound for an empty collection, got: ", err)
+	}
+}
+
+func TestBackfillInsertedTimestamps(t *testing.T) {
+	withObjectId := bson.NewObjectId()
+	fallback := time.Date(2015, time.March, 1, 0, 0, 0, 0, time.UTC)
+	seeded := []bson.M{
+		{"_id": withObjectId, "userName": "noInserted", "phoneNumber": "+15550210001"},
+		{"_id": "legacy-string-id", "userName": "zeroInserted", "phoneNumber": "+15550210002", "inserted": time.Time{}},
+	}
+	db.ExecWithCol(CollectionName, func(col *mgo.Collection) error {
+		for _, doc := range seeded {
+			if err := col.Insert(doc); err != nil {
+				t.Fatal("Failed to seed timestamp-less user: ", err)
+			}
+		}
+		return nil
+	})
+	defer db.ExecWithCol(CollectionName, func(col *mgo.Collection) error {
+		_, err := col.RemoveAll(bson.M{"_id": bson.M{"$in": []interface{}{withObjectId, "legacy-string-id"}}})
+		return err
+	})
+
+	updated, err := BackfillInsertedTimestamps(fallback)
+	if err != nil {
+		t.Fatal("Error encountered backfilling inserted timestamps: ", err)
+	}
+	if updated < len(seeded) {
+		t.Errorf("Expected at least %d users to be backfilled, got %d", len(seeded), updated)
+	}
+
+	expected := map[interface{}]time.Time{
+		withObjectId:       withObjectId.Time(),
+		"legacy-string-id": fallback,
+	}
+	for id, inserted := range expected {
+		var stored struct {
+			Inserted time.Time `bson:"inserted"`
+		}
+		db.ExecWithCol(CollectionName, func(col *mgo.Collection) error {
+			return col.FindId(id).One(&stored)
+		})
+		if !stored.Inserted.Equal(inserted) {
+			t.Errorf("Expected %v to be inserted at %v, got %v", id, inserted, stored.Inserted)
+		}
+	}
+
+	if updated, err := BackfillInsertedTimestamps(fallback); err != nil || updated != 0 {
+		t.Errorf("Expected nothing left to backfill, got %d (err %v)", updated, err)
+	}
+}
@@ -0,0 +1,98 @@
+// Disabling and enabling of users, keeping an append-only history of the
+// changes for compliance
+
+package users
+
+import (
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/njdup/func/db"
+)
+
+// Statuses recorded in StatusChange.NewStatus
+const (
+	StatusActive   = "active"
+	StatusDisabled = "disabled"
+)
+
+// The StatusChange struct records a change to whether a user is active
+type StatusChange struct {
+	By        string    `bson:"by" json:"by"` // Who made the change, such as an admin's username
+	Reason    string    `bson:"reason" json:"reason"`
+	At        time.Time `bson:"at" json:"at"`
+	NewStatus string    `bson:"newStatus" json:"newStatus"` // StatusActive or StatusDisabled
+}
+
+// Disables the active user, recording who disabled them and why
+// Returns ErrStatusUnchanged if the stored user is already disabled, or
+// ErrUserNotFound if the user isn't stored.
+func (user *User) Disable(by, reason string) error {
+	return user.changeStatus(false, by, reason)
+}
+
+// Enables the disabled user, recording who enabled them and why
+// Returns ErrStatusUnchanged if the stored user is already active, or
+// ErrUserNotFound if the user isn't stored.
+func (user *User) Enable(by, reason string) error {
+	return user.changeStatus(true, by, reason)
+}
+
+/*
+ * Helper Functions
+ */
+
+// Sets whether the user is active, appending the change to their status
+// history in the same update
+// The stored user is only matched in the opposite status, so concurrent
+// changes can't both apply and the history never records a no-op.
+func (user *User) changeStatus(active bool, by, reason string) error {
+	if user == nil || user.Id == "" {
+		return ErrUserNotFound
+	}
+	if err := checkWritable(); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	change := StatusChange{By: by, Reason: reason, At: now, NewStatus: StatusDisabled}
+	query := liveQuery(bson.M{"_id": user.Id, "active": bson.M{"$ne": false}})
+	if active {
+		change.NewStatus = StatusActive
+		query["active"] = false
+	}
+	update := bson.M{
+		"$set":  bson.M{"active": active},
+		"$push": bson.M{"statusHistory": change},
+	}
+
+	statusQuery := func(col *mgo.Collection) error {
+		err := col.Update(query, touched(update, now))
+		if err != mgo.ErrNotFound {
+			return err
+		}
+		// Tell users in the requested status apart from missing users
+		if _, err := loadStoredUser(col, user.Id); err != nil {
+			return err
+		}
+		return ErrStatusUnchanged
+	}
+
+	if err := db.ExecWithCol(CollectionName, statusQuery); err != nil {
+		return err
+	}
+	cachedUsers.invalidate(user.Id)
+	user.Active = active
+	user.StatusHistory = append(user.StatusHistory, change)
+	user.Updated = now
+	user.Version++
+	return nil
+}
+
+// Marks users saved before users could be disabled as active
+func backfillActive(col *mgo.Collection) error {
+	_, err := col.UpdateAll(bson.M{"active": bson.M{"$exists": false}}, bson.M{"$set": bson.M{"active": true}})
+	return err
+}
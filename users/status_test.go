@@ -0,0 +1,138 @@
+// Tests for disabling and enabling users
+
+package users
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/njdup/func/db"
+	"github.com/njdup/func/utils/security"
+)
+
+func TestStatusHistory(t *testing.T) {
+	user := User{Username: "statusUser", Phonenumber: "+15550150001"}
+	if err := user.Save(); err != nil {
+		t.Fatal("Failed to save user in the db: ", user.ToString())
+	}
+	defer removeUser(user)
+	if !user.Active {
+		t.Error("New user isn't active")
+	}
+
+	if err := user.Enable("admin", "already active"); err != ErrStatusUnchanged {
+		t.Error("Expected enabling an active user to change nothing, got: ", err)
+	}
+	if err := user.Disable("admin", "spam reports"); err != nil {
+		t.Fatal("Error encountered disabling user: ", err)
+	}
+	if err := user.Disable("admin", "more spam"); err != ErrStatusUnchanged {
+		t.Error("Expected disabling a disabled user to change nothing, got: ", err)
+	}
+	if err := user.Enable("support", "appeal granted"); err != nil {
+		t.Fatal("Error encountered enabling user: ", err)
+	}
+
+	found, err := FindByID(user.Id.Hex())
+	if err != nil {
+		t.Fatal("Error encountered querying for user ", user.ToString())
+	}
+	if !found.Active || len(found.StatusHistory) != 2 {
+		t.Fatal("Expected an active user with 2 status changes, got: ", found.Active, found.StatusHistory)
+	}
+	expected := []StatusChange{
+		{By: "admin", Reason: "spam reports", NewStatus: StatusDisabled},
+		{By: "support", Reason: "appeal granted", NewStatus: StatusActive},
+	}
+	for i, change := range found.StatusHistory {
+		if change.By != expected[i].By || change.Reason != expected[i].Reason ||
+			change.NewStatus != expected[i].NewStatus || change.At.IsZero() {
+			t.Errorf("Unexpected status change %d: %+v", i, change)
+		}
+	}
+
+	missing := User{}
+	if err := missing.Disable("admin", "missing"); err != ErrUserNotFound {
+		t.Error("Expected ErrUserNotFound disabling an unsaved user, got: ", err)
+	}
+}
+
+func TestDisabledUsersCantLogIn(t *testing.T) {
+	user := User{Username: "disabledLogin", Phonenumber: "+15550150002"}
+	if err := user.SetPassword("correct horse battery"); err != nil {
+		t.Fatal("Error encountered setting password: ", err)
+	}
+	if err := user.Save(); err != nil {
+		t.Fatal("Failed to save user in the db: ", user.ToString())
+	}
+	defer removeUser(user)
+
+	token, err := user.GenerateMagicLinkToken(time.Hour)
+	if err != nil {
+		t.Fatal("Error encountered generating login token: ", err)
+	}
+	if err := user.Disable("admin", "compliance hold"); err != nil {
+		t.Fatal("Error encountered disabling user: ", err)
+	}
+
+	if _, err := Authenticate("disabledLogin", "correct horse battery"); err != ErrInvalidCredentials {
+		t.Error("Expected disabled user's password login to be rejected, got: ", err)
+	}
+	if _, err := ConsumeMagicLink(token); err != ErrInvalidMagicLink {
+		t.Error("Expected disabled user's login token to be rejected, got: ", err)
+	}
+
+	if err := user.Enable("admin", "hold lifted"); err != nil {
+		t.Fatal("Error encountered enabling user: ", err)
+	}
+	if _, err := Authenticate("disabledLogin", "correct horse battery"); err != nil {
+		t.Error("Error encountered authenticating re-enabled user: ", err)
+	}
+}
+
+// Ensures users stored before Active existed keep logging in before the
+// backfill in EnsureIndexes ran
+func TestLegacyUsersAreActive(t *testing.T) {
+	hash, err := security.HashPassword("correct horse battery")
+	if err != nil {
+		t.Fatal("Error encountered hashing password: ", err)
+	}
+	token := "legacy-login-token"
+	id := bson.NewObjectId()
+	insertLegacy := func(col *mgo.Collection) error {
+		return col.Insert(bson.M{
+			"_id":              id,
+			"userName":         "legacyLogin",
+			"usernameLower":    "legacylogin",
+			"phoneNumber":      "+15550150003",
+			"password":         hash,
+			"magicLinkHash":    security.HashToken(token),
+			"magicLinkExpires": time.Now().Add(time.Hour),
+		})
+	}
+	if err := db.ExecWithCol(CollectionName, insertLegacy); err != nil {
+		t.Fatal("Failed to insert legacy document: ", err)
+	}
+	defer db.ExecWithCol(CollectionName, func(col *mgo.Collection) error {
+		return col.RemoveId(id)
+	})
+
+	user, err := Authenticate("legacyLogin", "correct horse battery")
+	if err != nil || !user.Active {
+		t.Fatal("Expected legacy user to authenticate as active, got: ", err)
+	}
+	session, err := user.NewSessionToken()
+	if err != nil {
+		t.Fatal("Error encountered starting session: ", err)
+	}
+	defer user.RevokeAllSessions()
+	if _, err := ResolveSession(session); err != nil {
+		t.Error("Expected legacy user's session to resolve, got: ", err)
+	}
+	if _, err := ConsumeMagicLink(token); err != nil {
+		t.Error("Expected legacy user's login token to be accepted, got: ", err)
+	}
+}
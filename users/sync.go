@@ -0,0 +1,67 @@
+// Incremental listing of changed users, for downstream systems such as a
+// search index keeping a copy of user data in sync
+
+package users
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Returns up to limit users updated at or after since, ordered by update
+// time then id, along with a cursor for the next page
+// afterID is the cursor returned by the previous call, or "" for the first
+// page. When no further users changed the given cursor is returned as is, so
+// callers can keep polling with it. Soft deleted and erased users are
+// included, so the downstream copy can drop them.
+func ListUpdatedSince(since time.Time, limit int, afterID string) ([]*User, string, error) {
+	query := bson.M{"updated": bson.M{"$gte": since}}
+	if afterID != "" {
+		updated, id, err := parseSyncCursor(afterID)
+		if err != nil {
+			return nil, "", err
+		}
+		query["$or"] = []bson.M{
+			{"updated": bson.M{"$gt": updated}},
+			{"updated": updated, "_id": bson.M{"$gt": id}},
+		}
+	}
+
+	users, err := listAllMatchingUsersContext(context.Background(), query, 0, limit, "updated", "_id")
+	if err != nil {
+		return nil, "", err
+	}
+	if len(users) == 0 {
+		return users, afterID, nil
+	}
+	last := users[len(users)-1]
+	return users, syncCursor(last.Updated, last.Id), nil
+}
+
+/*
+ * Helper Functions
+ */
+
+// Returns the cursor resuming a sync after the given user
+// Stored timestamps have millisecond precision, so that's all it keeps
+func syncCursor(updated time.Time, id bson.ObjectId) string {
+	return fmt.Sprintf("%d-%s", updated.UnixNano()/int64(time.Millisecond), id.Hex())
+}
+
+// Reads back the update time and user id held by a sync cursor
+func parseSyncCursor(cursor string) (time.Time, bson.ObjectId, error) {
+	parts := strings.SplitN(cursor, "-", 2)
+	if len(parts) != 2 || !bson.IsObjectIdHex(parts[1]) {
+		return time.Time{}, "", ErrInvalidCursor
+	}
+	millis, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return time.Time{}, "", ErrInvalidCursor
+	}
+	return time.Unix(0, millis*int64(time.Millisecond)), bson.ObjectIdHex(parts[1]), nil
+}
@@ -0,0 +1,62 @@
+// Tests for incremental listing of changed users
+
+package users
+
+import (
+	"testing"
+	"time"
+)
+
+func TestListUpdatedSince(t *testing.T) {
+	seeded := []User{
+		{Username: "syncUnchanged", Phonenumber: "+15550014001"},
+		{Username: "syncChanged1", Phonenumber: "+15550014002"},
+		{Username: "syncChanged2", Phonenumber: "+15550014003"},
+	}
+	for i := range seeded {
+		if err := seeded[i].Save(); err != nil {
+			t.Fatal("Failed to save user in the db: ", seeded[i].ToString())
+		}
+		defer removeUser(seeded[i])
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	since := time.Now()
+	for i := 1; i < len(seeded); i++ {
+		seeded[i].Firstname = "changed"
+		if err := seeded[i].Update(); err != nil {
+			t.Fatal("Error encountered updating user: ", err)
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	seen := make([]string, 0)
+	cursor := ""
+	for page := 0; page < len(seeded)+1; page++ {
+		users, next, err := ListUpdatedSince(since, 1, cursor)
+		if err != nil {
+			t.Fatal("Error encountered listing updated users: ", err)
+		}
+		if len(users) == 0 {
+			if next != cursor {
+				t.Error("Cursor moved on an empty page")
+			}
+			break
+		}
+		if next == cursor {
+			t.Error("Cursor didn't advance past page ", page)
+		}
+		cursor = next
+		for _, user := range users {
+			seen = append(seen, user.Username)
+		}
+	}
+
+	if len(seen) != 2 || seen[0] != "syncChanged1" || seen[1] != "syncChanged2" {
+		t.Error("Unexpected users listed as updated: ", seen)
+	}
+
+	if _, _, err := ListUpdatedSince(since, 1, "not-a-cursor"); err != ErrInvalidCursor {
+		t.Error("Expected invalid cursor to be rejected, got: ", err)
+	}
+}
@@ -0,0 +1,78 @@
+// Scoping of usernames to tenants, for deployments serving several
+// organizations from one users collection
+//
+// Usernames are unique per tenant, ignoring case, and are looked up within a
+// tenant. Phonenumbers stay unique across tenants, as incoming texts are
+// routed to a user by their phonenumber alone. Users without a TenantID
+// belong to the default tenant, which single tenant deployments use.
+
+package users
+
+import (
+	"context"
+	"strings"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Finds the user that matches the given username within the given tenant
+// Returns an error if no such user exists
+func FindWithUsernameInTenant(tenantID, username string) (User, error) {
+	return findMatchingUserContext(context.Background(), tenantQuery(tenantID, bson.M{"userName": username}))
+}
+
+/*
+ * Helper Functions
+ */
+
+// Returns a copy of the given query restricted to users of the given tenant
+func tenantQuery(tenantID string, query bson.M) bson.M {
+	result := bson.M{"tenantId": tenantID}
+	if tenantID == "" {
+		result["tenantId"] = nil // Matches both null and missing
+	}
+	for key, value := range query {
+		result[key] = value
+	}
+	return result
+}
+
+// Returns a query matching users of the given tenant holding the given
+// username, ignoring case
+func usernameQuery(tenantID, username string) bson.M {
+	return tenantQuery(tenantID, bson.M{"usernameLower": strings.ToLower(username)})
+}
+
+// Stores the lowercased username of users saved before usernames were
+// scoped to tenants, so the unique index created by EnsureIndexes covers them
+func backfillUsernameLower(col *mgo.Collection) error {
+	var stored struct {
+		Id       bson.ObjectId `bson:"_id"`
+		Username string        `bson:"userName"`
+	}
+	iter := col.Find(bson.M{"usernameLower": bson.M{"$exists": false}}).Select(bson.M{"userName": 1}).Iter()
+	for iter.Next(&stored) {
+		update := bson.M{"$set": bson.M{"usernameLower": strings.ToLower(stored.Username)}}
+		if err := col.UpdateId(stored.Id, update); err != nil {
+			iter.Close()
+			return err
+		}
+	}
+	return iter.Close()
+}
+
+// Drops the global unique index on usernames created before usernames were
+// scoped to tenants, which would keep tenants from sharing usernames
+func dropLegacyUsernameIndex(col *mgo.Collection) error {
+	indexes, err := col.Indexes()
+	if err != nil {
+		return err
+	}
+	for _, index := range indexes {
+		if index.Name == "userName_1" {
+			return col.DropIndexName(index.Name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+// Tests for scoping usernames to tenants
+
+package users
+
+import (
+	"testing"
+
+	"github.com/njdup/func/utils/web"
+)
+
+// Ensures usernames are unique within a tenant but may repeat across tenants
+func TestTenantUsernameScope(t *testing.T) {
+	if err := EnsureIndexes(); err != nil {
+		t.Fatal("Error encountered ensuring indexes: ", err)
+	}
+
+	acme := User{TenantID: "acme", Username: "sharedName", Phonenumber: "+15550020001"}
+	globex := User{TenantID: "globex", Username: "sharedName", Phonenumber: "+15550020002"}
+	for _, user := range []*User{&acme, &globex} {
+		if err := user.Save(); err != nil {
+			t.Fatal("Error encountered saving user under its tenant: ", err)
+		}
+		defer removeUser(*user)
+	}
+
+	duplicates := []User{
+		{TenantID: "acme", Username: "sharedName", Phonenumber: "+15550020003"},
+		{TenantID: "acme", Username: "SHAREDNAME", Phonenumber: "+15550020004"}, // Case is ignored
+	}
+	for _, duplicate := range duplicates {
+		err := duplicate.Save()
+		if err == nil {
+			removeUser(duplicate)
+			t.Error("Duplicate username within a tenant was saved: ", duplicate.ToString())
+			continue
+		}
+		if invalid, ok := err.(*web.InvalidFieldsError); !ok || invalid.Fields[0] != "Username" {
+			t.Error("Expected username conflict, got: ", err)
+		}
+	}
+
+	found, err := FindWithUsernameInTenant("globex", "sharedName")
+	if err != nil || found.Id != globex.Id {
+		t.Error("Wrong user found for username within tenant: ", err)
+	}
+	if _, err := FindWithUsername("sharedName"); err == nil {
+		t.Error("Tenant user was found in the default tenant")
+	}
+
+	// Renames are checked within the tenant too
+	globex.Username = "SharedName"
+	if err := globex.Update(); err != nil {
+		t.Error("Error encountered changing the case of a username: ", err)
+	}
+	acme.Username = "sharedname"
+	if err := acme.Update(); err != nil {
+		t.Error("Error encountered changing the case of a username: ", err)
+	}
+}
@@ -0,0 +1,75 @@
+// Text helpers for deriving normalized forms of user supplied strings
+
+package users
+
+import (
+	"strings"
+	"unicode"
+)
+
+// ASCII replacements for common accented latin characters
+var asciiReplacements = map[rune]string{
+	'à': "a", 'á': "a", 'â': "a", 'ã': "a", 'ä': "a", 'å': "a", 'ā': "a", 'ă': "a", 'ą': "a",
+	'ç': "c", 'ć': "c", 'ĉ': "c", 'ċ': "c", 'č': "c",
+	'ď': "d", 'đ': "d", 'ð': "d",
+	'è': "e", 'é': "e", 'ê': "e", 'ë': "e", 'ē': "e", 'ĕ': "e", 'ė': "e", 'ę': "e", 'ě': "e",
+	'ĝ': "g", 'ğ': "g", 'ġ': "g", 'ģ': "g",
+	'ĥ': "h", 'ħ': "h",
+	'ì': "i", 'í': "i", 'î': "i", 'ï': "i", 'ĩ': "i", 'ī': "i", 'ĭ': "i", 'į': "i", 'ı': "i",
+	'ĵ': "j", 'ķ': "k",
+	'ĺ': "l", 'ļ': "l", 'ľ': "l", 'ŀ': "l", 'ł': "l",
+	'ñ': "n", 'ń': "n", 'ņ': "n", 'ň': "n",
+	'ò': "o", 'ó': "o", 'ô': "o", 'õ': "o", 'ö': "o", 'ø': "o", 'ō': "o", 'ŏ': "o", 'ő': "o",
+	'ŕ': "r", 'ŗ': "r", 'ř': "r",
+	'ś': "s", 'ŝ': "s", 'ş': "s", 'š': "s", 'ß': "ss",
+	'ţ': "t", 'ť': "t", 'ŧ': "t", 'þ': "th",
+	'ù': "u", 'ú': "u", 'û': "u", 'ü': "u", 'ũ': "u", 'ū': "u", 'ŭ': "u", 'ů': "u", 'ű': "u", 'ų': "u",
+	'ŵ': "w", 'ý': "y", 'ÿ': "y", 'ŷ': "y",
+	'ź': "z", 'ż': "z", 'ž': "z",
+	'æ': "ae", 'œ': "oe",
+}
+
+// Returns the lowercased form of the given string with accented latin
+// characters replaced by their closest ASCII equivalent
+// Characters without a known replacement are kept as is
+func foldToASCII(s string) string {
+	var result strings.Builder
+	for _, r := range strings.ToLower(s) {
+		if replacement, ok := asciiReplacements[r]; ok {
+			result.WriteString(replacement)
+		} else if !unicode.Is(unicode.Mn, r) { // Drop stray combining marks
+			result.WriteRune(r)
+		}
+	}
+	return result.String()
+}
+
+// Returns the number of single character edits (insertions, deletions or
+// substitutions) needed to turn a into b
+func editDistance(a, b string) int {
+	source, target := []rune(a), []rune(b)
+	previous := make([]int, len(target)+1)
+	current := make([]int, len(target)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(source); i++ {
+		current[0] = i
+		for j := 1; j <= len(target); j++ {
+			cost := 1
+			if source[i-1] == target[j-1] {
+				cost = 0
+			}
+			current[j] = previous[j-1] + cost
+			if deletion := previous[j] + 1; deletion < current[j] {
+				current[j] = deletion
+			}
+			if insertion := current[j-1] + 1; insertion < current[j] {
+				current[j] = insertion
+			}
+		}
+		previous, current = current, previous
+	}
+	return previous[len(target)]
+}
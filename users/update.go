@@ -0,0 +1,254 @@
+// Updating of stored users, including tracking exactly what changed for
+// admin audit trails
+
+package users
+
+import (
+	"reflect"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/njdup/func/db"
+)
+
+var (
+	AuditCollectionName = "userAudit" // Name of the collection holding user audit records
+
+	// The fields of a user that may be edited, mapped to their bson keys
+	// Only these fields are compared by Diff and written by Update, so
+	// sensitive fields such as the password hash are never included
+	editableFields = map[string]string{
+		"Username":    "userName",
+		"Firstname":   "firstName",
+		"Lastname":    "lastName",
+		"Phonenumber": "phoneNumber",
+		"Email":       "email",
+		"Metadata":    "metadata",
+	}
+)
+
+// Captures the old and new value of a changed field
+type fieldChange struct {
+	Old interface{} `bson:"old" json:"old"`
+	New interface{} `bson:"new" json:"new"`
+}
+
+// The AuditRecord struct records the changes made to a user by an Update
+type AuditRecord struct {
+	Id      bson.ObjectId          `bson:"_id,omitempty" json:"-"`
+	UserId  bson.ObjectId          `bson:"userId" json:"userId"`
+	At      time.Time              `bson:"at" json:"at"`
+	Changes map[string]fieldChange `bson:"changes" json:"changes"`
+}
+
+// Returns the editable fields whose value differs between the receiver and
+// the proposed user, keyed by field name
+// A nil user is compared as an empty one
+func (user *User) Diff(proposed *User) map[string]fieldChange {
+	changes := make(map[string]fieldChange)
+	current, next := editableValues(user), editableValues(proposed)
+	for field, old := range current {
+		if !reflect.DeepEqual(old, next[field]) {
+			changes[field] = fieldChange{Old: old, New: next[field]}
+		}
+	}
+	return changes
+}
+
+// Persists changes made to the editable fields of the receiver, a user
+// previously loaded from the database
+// Changed fields are validated, see validateForUpdate, changed UniqueFields
+// are checked for uniqueness like in Save, and an AuditRecord of the
+// changes is written alongside.
+// Returns ErrUserNotFound if the user isn't stored.
+func (user *User) Update() error {
+	if user == nil || user.Id == "" {
+		return ErrUserNotFound
+	}
+	if err := checkWritable(); err != nil {
+		return err
+	}
+	if err := normalizeForWrite(user); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	updateQuery := func(col *mgo.Collection) error {
+		stored, err := loadStoredUser(col, user.Id)
+		if err != nil {
+			return err
+		}
+		// Stored users may only have the hash of their phonenumber
+		hashOnly := stored.Phonenumber == "" && stored.PhoneHash != ""
+		if hashOnly && PhonePrivacy.Enabled && stored.PhoneHash == hashPhonenumber(user.Phonenumber) {
+			stored.Phonenumber = user.Phonenumber
+		}
+
+		changes := stored.Diff(user)
+		if len(changes) == 0 {
+			return nil
+		}
+		if err := validateForUpdate(user, changes); err != nil {
+			return err
+		}
+
+		set, unset := bson.M{}, bson.M{}
+		for field, change := range changes {
+			set[editableFields[field]] = change.New
+		}
+		if _, ok := changes["Username"]; ok {
+			if err := checkReservation(col, user, stored.TenantID); err != nil {
+				return err
+			}
+			set["usernameLower"] = strings.ToLower(user.Username)
+		}
+		_, renamed := changes["Username"]
+		_, firstnameChanged := changes["Firstname"]
+		_, lastnameChanged := changes["Lastname"]
+		if renamed || firstnameChanged || lastnameChanged {
+			set["searchName"] = searchNameFor(user)
+		}
+		if _, ok := changes["Email"]; ok {
+			if user.Email == "" {
+				// Removed addresses are unset, as the sparse unique index would
+				// count empty ones as duplicates
+				delete(set, "email")
+				unset["email"] = ""
+			}
+			set["emailVerified"] = false // A new address must be verified again
+		}
+		if _, ok := changes["Phonenumber"]; ok {
+			set["phoneVerified"] = false // A new number must be verified again
+			if PhonePrivacy.Enabled {
+				set["phoneHash"] = hashPhonenumber(user.Phonenumber)
+				if PhonePrivacy.OmitPlaintext {
+					delete(set, "phoneNumber")
+					changes["Phonenumber"] = fieldChange{Old: stored.PhoneHash, New: set["phoneHash"]}
+				}
+			}
+		}
+		checks, err := uniquenessChecks(user)
+		if err != nil {
+			return err
+		}
+		for field, query := range checks {
+			if _, ok := changes[field]; !ok {
+				delete(checks, field)
+				continue
+			}
+			query["_id"] = bson.M{"$ne": user.Id}
+		}
+		if err := checkConflicts(checks); err != nil {
+			return err
+		}
+
+		update := bson.M{"$set": set}
+		if len(unset) != 0 {
+			update["$unset"] = unset
+		}
+		if err := col.UpdateId(user.Id, touched(update, now)); err != nil {
+			return duplicateKeyError(err)
+		}
+		cachedUsers.invalidate(user.Id)
+		user.Updated = now
+		user.Version = stored.Version + 1
+		if searchName, ok := set["searchName"].(string); ok {
+			user.SearchName = searchName
+		}
+		if _, ok := changes["Email"]; ok {
+			user.EmailVerified = false
+		}
+		if _, ok := changes["Phonenumber"]; ok {
+			user.PhoneVerified = false
+			user.PhoneHash, _ = set["phoneHash"].(string)
+		}
+
+		record := AuditRecord{UserId: user.Id, At: now, Changes: changes}
+		return col.Database.C(AuditCollectionName).Insert(&record)
+	}
+
+	return db.ExecWithCol(CollectionName, updateQuery)
+}
+
+// Checks whether the stored user changed since the receiver was loaded, by
+// comparing their versions, so handlers can reload it before a critical
+// mutation
+// Only the stored version is read. Returns ErrUserNotFound if the user isn't
+// stored.
+func (user *User) IsStale() (bool, error) {
+	if user == nil || user.Id == "" {
+		return false, ErrUserNotFound
+	}
+	var stored struct {
+		Version int `bson:"version"`
+	}
+	versionQuery := func(col *mgo.Collection) error {
+		err := col.Find(liveQuery(bson.M{"_id": user.Id})).Select(bson.M{"version": 1}).One(&stored)
+		if err == mgo.ErrNotFound {
+			return ErrUserNotFound
+		}
+		return err
+	}
+
+	if err := db.ExecWithCol(CollectionName, versionQuery); err != nil {
+		return false, err
+	}
+	return stored.Version != user.Version, nil
+}
+
+// Returns the audit records written for the user, oldest first
+func (user *User) AuditTrail() ([]AuditRecord, error) {
+	if user == nil {
+		return nil, ErrNilUser
+	}
+	result := make([]AuditRecord, 0)
+	auditQuery := func(col *mgo.Collection) error {
+		return col.Database.C(AuditCollectionName).Find(bson.M{"userId": user.Id}).Sort("at").All(&result)
+	}
+
+	err := db.ExecWithCol(CollectionName, auditQuery)
+	return result, err
+}
+
+/*
+ * Helper Functions
+ */
+
+// Returns the current value of each editable field of the user
+func editableValues(user *User) map[string]interface{} {
+	if user == nil {
+		user = &User{}
+	}
+	metadata := user.Metadata
+	if len(metadata) == 0 {
+		metadata = nil // Missing and empty metadata are the same
+	}
+	return map[string]interface{}{
+		"Username":    user.Username,
+		"Firstname":   user.Firstname,
+		"Lastname":    user.Lastname,
+		"Phonenumber": user.Phonenumber,
+		"Email":       user.Email,
+		"Metadata":    metadata,
+	}
+}
+
+// Loads the stored state of the user with the given id from the collection
+// Returns ErrUserNotFound if no such user exists or it was soft deleted
+func loadStoredUser(col *mgo.Collection, id bson.ObjectId) (*User, error) {
+	var raw bson.Raw
+	if err := col.Find(liveQuery(bson.M{"_id": id})).One(&raw); err == mgo.ErrNotFound {
+		return nil, ErrUserNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	stored := new(User)
+	if err := decodeUser(raw, stored); err != nil {
+		return nil, err
+	}
+	return stored, nil
+}
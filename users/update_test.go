@@ -0,0 +1,125 @@
+// Tests for updating stored users
+
+package users
+
+import (
+	"testing"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/njdup/func/db"
+)
+
+func TestDiff(t *testing.T) {
+	current := User{Username: "diffUser", Firstname: "john", Lastname: "doe", Phonenumber: "+15550009001"}
+	current.PasswordHash = "old-hash"
+
+	proposed := current
+	proposed.Firstname = "johnny"
+	proposed.Phonenumber = "+15550009002"
+	proposed.PasswordHash = "new-hash"
+
+	changes := current.Diff(&proposed)
+	if len(changes) != 2 {
+		t.Errorf("Expected 2 changed fields, got %d: %v", len(changes), changes)
+	}
+	if change := changes["Firstname"]; change.Old != "john" || change.New != "johnny" {
+		t.Error("Unexpected change recorded for Firstname: ", change)
+	}
+	if change := changes["Phonenumber"]; change.Old != current.Phonenumber || change.New != proposed.Phonenumber {
+		t.Error("Unexpected change recorded for Phonenumber: ", change)
+	}
+	if _, ok := changes["PasswordHash"]; ok {
+		t.Error("Password hash included in diff")
+	}
+
+	if changes := current.Diff(&current); len(changes) != 0 {
+		t.Error("Diff of unchanged user isn't empty: ", changes)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	user := User{Username: "updateUser", Firstname: "john", Phonenumber: "+15550009101"}
+	other := User{Username: "updateOther", Phonenumber: "+15550009102"}
+	for _, u := range []*User{&user, &other} {
+		if err := u.Save(); err != nil {
+			t.Fatal("Failed to save user in the db: ", u.ToString())
+		}
+		defer removeUser(*u)
+	}
+	defer db.ExecWithCol(CollectionName, func(col *mgo.Collection) error {
+		_, err := col.Database.C(AuditCollectionName).RemoveAll(bson.M{"userId": user.Id})
+		return err
+	})
+
+	user.Firstname = "johnny"
+	if err := user.Update(); err != nil {
+		t.Fatal("Error encountered updating user: ", err)
+	}
+	found, err := FindByID(user.Id.Hex())
+	if err != nil || found.Firstname != "johnny" {
+		t.Error("Updated field wasn't persisted: ", err)
+	}
+	if found.Version != user.Version || user.Version != 2 {
+		t.Errorf("Expected version 2, stored %d, in memory %d", found.Version, user.Version)
+	}
+
+	// Changed identifiers must stay unique
+	conflicting := found
+	conflicting.Username = other.Username
+	if err := conflicting.Update(); err == nil {
+		t.Error("Error not encountered updating to a taken username")
+	}
+
+	trail, err := user.AuditTrail()
+	if err != nil {
+		t.Fatal("Error encountered reading audit trail: ", err)
+	}
+	if len(trail) != 1 || len(trail[0].Changes) != 1 || trail[0].Changes["Firstname"].New != "johnny" {
+		t.Error("Unexpected audit trail for update: ", trail)
+	}
+
+	unsaved := User{Username: "neverSaved", Phonenumber: "+15550009103"}
+	if err := unsaved.Update(); err != ErrUserNotFound {
+		t.Error("Expected ErrUserNotFound updating unsaved user, got: ", err)
+	}
+}
+
+func TestIsStale(t *testing.T) {
+	user := User{Username: "staleCheck", Phonenumber: "+15550300001"}
+	if err := user.Save(); err != nil {
+		t.Fatal("Failed to save user in the db: ", user.ToString())
+	}
+	defer removeUser(user)
+
+	held, err := FindByID(user.Id.Hex())
+	if err != nil {
+		t.Fatal("Error encountered querying for user ", user.ToString())
+	}
+	if stale, err := held.IsStale(); err != nil || stale {
+		t.Errorf("Expected freshly loaded user not to be stale, got %v (err %v)", stale, err)
+	}
+
+	// Another handler updates the user out of band
+	user.Firstname = "Changed"
+	if err := user.Update(); err != nil {
+		t.Fatal("Error encountered updating user: ", err)
+	}
+	if stale, err := held.IsStale(); err != nil || !stale {
+		t.Errorf("Expected held copy to be stale after an update, got %v (err %v)", stale, err)
+	}
+	if stale, _ := user.IsStale(); stale {
+		t.Error("Expected the updating copy not to be stale")
+	}
+
+	if err := user.SoftDelete(); err != nil {
+		t.Fatal("Error encountered soft deleting user: ", err)
+	}
+	if _, err := held.IsStale(); err != ErrUserNotFound {
+		t.Error("Expected ErrUserNotFound for a deleted user, got: ", err)
+	}
+	if _, err := (&User{}).IsStale(); err != ErrUserNotFound {
+		t.Error("Expected ErrUserNotFound for an unsaved user, got: ", err)
+	}
+}
@@ -6,7 +6,10 @@
 package users
 
 import (
+	"context"
 	"fmt"
+	"reflect"
+	"regexp"
 	"strings"
 	"time"
 
@@ -24,15 +27,78 @@ import (
 type User struct {
 	Id       bson.ObjectId `bson:"_id,omitempty" json:"-"`
 	Inserted time.Time     `bson:"inserted" json"-"`
+	Updated  time.Time     `bson:"updated" json:"-"`
+	Version  int           `bson:"version" json:"-"` // Incremented on every update of the stored user
+	// Set when the user is soft deleted, see SoftDelete
+	DeletedAt time.Time `bson:"deletedAt,omitempty" json:"-"`
+	// Set once the user's personal data has been erased, see Erase
+	Erased bool `bson:"erased,omitempty" json:"-"`
+
+	// Tenant the user belongs to, empty for the default tenant, see tenants.go
+	TenantID string `bson:"tenantId,omitempty" json:"tenantId,omitempty"`
 
 	Username     string `bson:"userName" json:"userName"`
 	Firstname    string `bson:"firstName" json:"firstName"`
 	Lastname     string `bson:"lastName" json:"lastName"`
-	Phonenumber  string `bson:"phoneNumber" json:"phoneNumber`
+	Phonenumber  string `bson:"phoneNumber,omitempty" json:"phoneNumber"`
+	Email        string `bson:"email,omitempty" json:"email,omitempty"` // Optional, see NormalizeEmail
 	PasswordHash string `bson:"password" json:"-"`
+	RehashNeeded bool   `bson:"rehashNeeded" json:"-"` // Set when the hash is weaker than the current policy
+	// Set by SetPassword, see PasswordExpired
+	PasswordChangedAt time.Time `bson:"passwordChangedAt,omitempty" json:"-"`
+	// Hashes of the user's previous passwords, most recent first, see PasswordHistorySize
+	PasswordHistory []string `bson:"passwordHistory,omitempty" json:"-"`
+	// Keyed hash of the password, see PasswordFingerprints
+	PasswordFingerprint string `bson:"passwordFingerprint,omitempty" json:"-"`
+	// Set when an administrator reset the password, see AdminSetPassword
+	MustChangePassword bool `bson:"mustChangePassword" json:"-"`
+	// Time of the user's last login
+	LastLogin time.Time `bson:"lastLogin,omitempty" json:"-"`
+	// Hash and expiry of the user's pending login link, see GenerateMagicLinkToken
+	MagicLinkHash    string    `bson:"magicLinkHash,omitempty" json:"-"`
+	MagicLinkExpires time.Time `bson:"magicLinkExpires,omitempty" json:"-"`
+
+	// Lowercased username, backing the per-tenant uniqueness of usernames
+	UsernameLower string `bson:"usernameLower" json:"-"`
+	// Folded names and username, backing SearchUsers
+	SearchName string `bson:"searchName" json:"-"`
+
+	// URL-safe identifier for the user's profile, unique across users
+	ProfileSlug string `bson:"slug" json:"slug"`
+
+	// Set once the SMS provider confirms the user owns their phonenumber
+	PhoneVerified bool `bson:"phoneVerified" json:"phoneVerified"`
+	// Keyed hash of the phonenumber, stored when PhonePrivacy is enabled
+	PhoneHash string `bson:"phoneHash,omitempty" json:"-"`
+	// Set once the user confirms they own their email address
+	EmailVerified bool `bson:"emailVerified" json:"emailVerified"`
+
+	// Optional, see AgeYears
+	Birthdate *time.Time `bson:"birthdate,omitempty" json:"birthdate,omitempty"`
+
+	// Cleared while the user is disabled, see Disable
+	Active bool `bson:"active" json:"active"`
+	// Append-only record of the changes to Active
+	StatusHistory []StatusChange `bson:"statusHistory,omitempty" json:"-"`
+
+	// Set on accounts created on the user's behalf, such as by an
+	// administrator, before Save, see ListPendingInvites
+	Pending bool `bson:"pending,omitempty" json:"-"`
+
+	// Names of the roles granted to the user, such as "admin"
+	Roles []string `bson:"roles,omitempty" json:"roles,omitempty"`
 
 	// Store slice of ids for each program owned by the user
 	Programs []bson.ObjectId `bson:"programs" json:"-"`
+
+	// Small per-user flags, see SetMeta
+	Metadata map[string]string `bson:"metadata,omitempty" json:"metadata,omitempty"`
+
+	// Accounts with external providers (Google, GitHub, ...) the user signs in with
+	ExternalIdentities []ExternalIdentity `bson:"externalIdentities" json:"-"`
+
+	// Hash of the username reservation claimed for the user, see ClaimReservation
+	reservationHash string
 }
 
 var (
@@ -41,6 +107,9 @@ var (
 
 // Returns a string representation of the user object
 func (user *User) ToString() string {
+	if user == nil {
+		return "User <nil>"
+	}
 	return fmt.Sprintf(
 		"User %s (%s): %s %s",
 		user.Username,
@@ -50,92 +119,433 @@ func (user *User) ToString() string {
 	)
 }
 
+// Returns a key identifying the current state of the user, for caching layers
+// The key combines the id with the version, so it is stable until the stored
+// user is updated. An empty key is returned for unsaved users.
+func (user *User) CacheKey() string {
+	if user == nil || user.Id == "" {
+		return ""
+	}
+	return fmt.Sprintf("user:%s:v%d", user.Id.Hex(), user.Version)
+}
+
+// Checks whether the user was inserted more than d ago
+// Authorization checks can use it to gate actions prone to spam, such as
+// messaging strangers, on a minimum account age. Users that haven't been
+// saved have no age and are never older than d.
+func (user *User) OlderThan(d time.Duration) bool {
+	if user == nil || user.Inserted.IsZero() {
+		return false
+	}
+	return time.Since(user.Inserted) > d
+}
+
+// Returns a deep copy of the user, sharing no slices or maps with it, so
+// handlers can hand a defensive copy to templates or goroutines
+func (user *User) Clone() *User {
+	if user == nil {
+		return nil
+	}
+	clone := *user
+	if user.Birthdate != nil {
+		birthdate := *user.Birthdate
+		clone.Birthdate = &birthdate
+	}
+	if user.PasswordHistory != nil {
+		clone.PasswordHistory = append([]string{}, user.PasswordHistory...)
+	}
+	if user.Roles != nil {
+		clone.Roles = append([]string{}, user.Roles...)
+	}
+	if user.StatusHistory != nil {
+		clone.StatusHistory = append([]StatusChange{}, user.StatusHistory...)
+	}
+	if user.Programs != nil {
+		clone.Programs = append([]bson.ObjectId{}, user.Programs...)
+	}
+	if user.ExternalIdentities != nil {
+		clone.ExternalIdentities = append([]ExternalIdentity{}, user.ExternalIdentities...)
+	}
+	if user.Metadata != nil {
+		clone.Metadata = make(map[string]string, len(user.Metadata))
+		for key, value := range user.Metadata {
+			clone.Metadata[key] = value
+		}
+	}
+	return &clone
+}
+
 // Inserts the receiver User into the database
 // Returns an error if any are encountered, including
 // validation errors
+// The OnUserCreated hooks are run once the user is stored, and their
+// failures are only returned, as a HookError, if HookPolicy reports them
+// Usernames held by another signup's reservation are rejected with
+// ErrUsernameHeld, see ReserveUsername
+// The outcome is reported to Instrumentation
 func (user *User) Save() error {
-	if emptyFields := checkEmptyFields(user); len(emptyFields) != 0 {
-		invalid := strings.Join(emptyFields, " ")
-		return &web.InvalidFieldsError{
-			web.GeneralError{"The following fields cannot be empty: " + invalid},
-			emptyFields,
-		}
+	err := user.save(nil)
+	recordSignup(err)
+	return err
+}
+
+// Inserts the receiver User into the database like Save, only if the given
+// condition holds
+// The condition is evaluated on the users collection, once the user is
+// validated and right before the insert, so it sees the latest state. It
+// isn't atomic with the insert: conditions racing concurrent writes should
+// be backed by a unique index. Returns ErrConditionFailed if the condition
+// doesn't hold, or the condition's error.
+func (user *User) SaveIf(cond func(col *mgo.Collection) (bool, error)) error {
+	if cond == nil {
+		return ErrConditionFailed
+	}
+	err := user.save(cond)
+	recordSignup(err)
+	return err
+}
+
+// Inserts the receiver User into the database if the given condition holds,
+// or unconditionally when it is nil, see Save and SaveIf
+func (user *User) save(cond func(col *mgo.Collection) (bool, error)) error {
+	if user == nil {
+		return ErrNilUser
+	}
+	if err := checkWritable(); err != nil {
+		return err
+	}
+	if err := validateForCreate(user); err != nil {
+		return err
 	}
 
 	insertQuery := func(col *mgo.Collection) error {
-		nameCh := make(chan int)
-		go checkExistence(col, bson.M{"userName": user.Username}, nameCh)
-		phoneCh := make(chan int)
-		go checkExistence(col, bson.M{"phoneNumber": user.Phonenumber}, phoneCh)
-
-		if nameMatches := <-nameCh; nameMatches != 0 {
-			return &web.InvalidFieldsError{
-				web.GeneralError{"A user with the given username already exists"},
-				[]string{"Username"},
+		checks, err := uniquenessChecks(user)
+		if err != nil {
+			return err
+		}
+		if err := checkConflicts(checks); err != nil {
+			return err
+		}
+		if err := checkReservation(col, user, user.TenantID); err != nil {
+			return err
+		}
+
+		if cond != nil {
+			if holds, err := cond(col); err != nil {
+				return err
+			} else if !holds {
+				return ErrConditionFailed
 			}
 		}
 
-		if phoneMatches := <-phoneCh; phoneMatches != 0 {
-			return &web.InvalidFieldsError{
-				web.GeneralError{"A user with the given phonenumber already exists"},
-				[]string{"Phonenumber"},
+		generatedSlug := user.ProfileSlug == ""
+		if generatedSlug {
+			slug, err := uniqueSlug(col, user.Slug())
+			if err != nil {
+				return err
 			}
+			user.ProfileSlug = slug
 		}
 
+		if user.Id == "" {
+			user.Id = bson.NewObjectId()
+		}
+		user.UsernameLower = strings.ToLower(user.Username)
+		user.SearchName = searchNameFor(user)
+		user.Active = true
 		user.Inserted = time.Now()
-		return col.Insert(user) // Inserts the user, returning nil or an error
+		user.Updated = user.Inserted
+		user.Version = 1
+
+		stored := user
+		if PhonePrivacy.Enabled {
+			user.PhoneHash = hashPhonenumber(user.Phonenumber)
+			if PhonePrivacy.OmitPlaintext {
+				withoutPhone := *user
+				withoutPhone.Phonenumber = ""
+				stored = &withoutPhone
+			}
+		}
+		err = col.Insert(stored)
+		// Concurrent saves of users with the same slug, such as "José" and
+		// "jose", race between finding a free slug and inserting
+		for attempt := 1; generatedSlug && attempt < maxSlugAttempts && isDuplicateSlug(err); attempt++ {
+			slug, slugErr := uniqueSlug(col, user.Slug())
+			if slugErr != nil {
+				return slugErr
+			}
+			user.ProfileSlug, stored.ProfileSlug = slug, slug
+			err = col.Insert(stored)
+		}
+		if err != nil {
+			return duplicateKeyError(err)
+		}
+		releaseReservation(col, user)
+		return nil
 	}
 
-	return db.ExecWithCol(CollectionName, insertQuery)
+	if err := db.ExecWithCol(CollectionName, insertQuery); err != nil {
+		return err
+	}
+	return runHooks(createdHooks, user)
 }
 
 // Stores the given password for the user after hashing
-// Returns the error encountered while hashing the password if applicable,
-// otherwise nil is returned
+// The password must pass every check of WouldAcceptPassword, and the
+// replaced password is kept in the user's PasswordHistory. The password is
+// only stored by Save, or by ChangePassword and AdminSetPassword for stored
+// users. Only those two revoke the user's sessions and run the
+// OnPasswordChanged hooks, so any password reset flow must go through them
+// rather than SetPassword and Save.
+// Returns the first check failed or the error encountered while hashing the
+// password if applicable, otherwise nil is returned
 func (user *User) SetPassword(password string) error {
-	if !security.PasswordPolicy.PasswordValid(password) {
-		return &web.InvalidFieldsError{
-			web.GeneralError{"Given password is not acceptable"},
-			[]string{"Password"},
-		}
+	if err := user.WouldAcceptPassword(password); err != nil {
+		return err
 	}
+	previous := user.PasswordHash
 	var err error
 	user.PasswordHash, err = security.HashPassword(password)
+	if err == nil {
+		user.PasswordHistory = pushPasswordHistory(user.PasswordHistory, previous)
+		user.PasswordFingerprint = passwordFingerprint(password)
+		user.RehashNeeded = false
+		user.PasswordChangedAt = time.Now()
+		user.MustChangePassword = false
+	}
 	return err
 }
 
 // Checks whether the given password matches the password for the user
 func (user *User) PasswordsMatch(givenPassword string) bool {
+	if user == nil || user.PasswordHash == "" {
+		return false
+	}
 	return security.ConfirmPassword(user.PasswordHash, givenPassword)
 }
 
-// Finds the user that matches the given username
+// Finds the user of the default tenant that matches the given username
 // Returns an error if no such user exists
 func FindWithUsername(username string) (User, error) {
-	return findMatchingUser(bson.M{"userName": username})
+	return FindByUsernameContext(context.Background(), username)
 }
 
-// Finds the user that matches the given password
-// Returns an error if no such user exists
+// Finds the user that matches the given phonenumber, sharing the query with
+// concurrent identical lookups
+// The number is normalized first where possible, so formatted input still
+// matches. Returns an error if no such user exists
 func FindWithPhonenumber(phonenumber string) (User, error) {
-	return findMatchingUser(bson.M{"phoneNumber": phonenumber})
+	if normalized, err := NormalizePhonenumber(phonenumber); err == nil {
+		phonenumber = normalized
+	}
+	return findCoalesced(context.Background(), lookupKey("phoneNumber", phonenumber), phoneQuery(phonenumber))
+}
+
+// Finds the user with the given hex encoded id
+// Returns ErrInvalidId if the id is malformed, or an error if no such user exists
+func FindByID(hexId string) (User, error) {
+	return FindByIDContext(context.Background(), hexId)
+}
+
+// Resolves the given usernames of the default tenant to the ids of their
+// users in one query, ignoring case, for bulk tagging and mentions
+// The returned map is keyed by the names as given. Names without a user are
+// absent from it, see UnresolvedUsernames.
+func ResolveUsernames(names []string) (map[string]bson.ObjectId, error) {
+	result := make(map[string]bson.ObjectId)
+	if len(names) == 0 {
+		return result, nil
+	}
+	byLower := make(map[string][]string, len(names))
+	lowered := make([]string, 0, len(names))
+	for _, name := range names {
+		lower := strings.ToLower(name)
+		if _, ok := byLower[lower]; !ok {
+			lowered = append(lowered, lower)
+		}
+		byLower[lower] = append(byLower[lower], name)
+	}
+
+	resolveQuery := func(col *mgo.Collection) error {
+		var stored struct {
+			Id            bson.ObjectId `bson:"_id"`
+			UsernameLower string        `bson:"usernameLower"`
+		}
+		query := liveQuery(tenantQuery("", bson.M{"usernameLower": bson.M{"$in": lowered}}))
+		iter := col.Find(query).Select(bson.M{"usernameLower": 1}).Iter()
+		for iter.Next(&stored) {
+			for _, name := range byLower[stored.UsernameLower] {
+				result[name] = stored.Id
+			}
+		}
+		return iter.Close()
+	}
+
+	if err := db.ExecWithCol(CollectionName, resolveQuery); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Returns the given names missing from the result of ResolveUsernames
+func UnresolvedUsernames(names []string, resolved map[string]bson.ObjectId) []string {
+	result := make([]string, 0)
+	for _, name := range names {
+		if _, ok := resolved[name]; !ok {
+			result = append(result, name)
+		}
+	}
+	return result
+}
+
+// Returns up to limit users, skipping the first offset users
+// Users are ordered by id, so pages are stable across calls
+// The page is normalized with NormalizePagination
+func ListUsers(offset, limit int) ([]*User, error) {
+	return ListUsersContext(context.Background(), offset, limit)
+}
+
+// Finds all users sharing the given first and last name, ignoring case,
+// so UIs know when to show extra disambiguation
+// At most MaxPageSize users are returned
+func UsersWithSameName(firstname, lastname string) ([]*User, error) {
+	query := bson.M{
+		"firstName": exactIgnoringCase(firstname),
+		"lastName":  exactIgnoringCase(lastname),
+	}
+	return listMatchingUsersContext(context.Background(), query, 0, MaxPageSize, "_id")
+}
+
+// Returns the fields on which the two users would collide under the
+// uniqueness rules enforced by Save, without querying the database, so batch
+// imports can find duplicates within a batch
+// Usernames collide within a tenant ignoring case, and phonenumbers collide
+// when they match the same stored value, see phoneQuery, and email addresses
+// collide once normalized. Empty fields never collide.
+func ConflictsWith(a, b *User) []string {
+	result := make([]string, 0)
+	if a == nil || b == nil {
+		return result
+	}
+
+	if a.Username != "" && a.TenantID == b.TenantID &&
+		strings.ToLower(a.Username) == strings.ToLower(b.Username) {
+		result = append(result, "Username")
+	}
+	if a.Phonenumber != "" && b.Phonenumber != "" &&
+		reflect.DeepEqual(phoneQuery(a.Phonenumber), phoneQuery(b.Phonenumber)) {
+		result = append(result, "Phonenumber")
+	}
+	if a.Email != "" && b.Email != "" && normalizedEmail(a.Email) == normalizedEmail(b.Email) {
+		result = append(result, "Email")
+	}
+	return result
 }
 
 /*
  * Helper Functions
  */
 
-// Checks for the existence of entries matching the given query in
-// the specified collection.
-// The count of entries generated by the query is sent down the passed in
-// channel. -1 is sent if an error occurs.
-func checkExistence(col *mgo.Collection, query bson.M, ch chan int) {
-	count, err := col.Find(query).Limit(1).Count()
-	if err != nil {
-		ch <- -1 // TODO: Is there a better way to handle an error here?
-		return
+// Returns a query value matching exactly the given string, ignoring case
+func exactIgnoringCase(value string) bson.RegEx {
+	return bson.RegEx{Pattern: "^" + regexp.QuoteMeta(value) + "$", Options: "i"}
+}
+
+// Counts the entries matching the given query in the collection
+// Stored in a variable so tests can simulate database failures
+var countMatches = func(col *mgo.Collection, query bson.M) (int, error) {
+	return col.Find(query).Limit(1).Count()
+}
+
+// Returns the checked fields whose query matches a stored user, keyed like
+// the given checks, in a single round-trip
+// The combined $or match narrows the collection down through the indexes,
+// then each field's own query is re-applied to the few candidates left.
+// Stored in a variable so tests can simulate database failures
+var matchConflicts = func(col *mgo.Collection, checks map[string]bson.M) (map[string]bool, error) {
+	alternatives := make([]bson.M, 0, len(checks))
+	facets := bson.M{}
+	for field, query := range checks {
+		alternatives = append(alternatives, query)
+		facets[field] = []bson.M{{"$match": query}, {"$limit": 1}, {"$project": bson.M{"_id": 1}}}
 	}
-	ch <- count
+	pipeline := []bson.M{
+		{"$match": bson.M{"$or": alternatives}},
+		{"$facet": facets},
+	}
+
+	var result map[string][]bson.Raw
+	if err := col.Pipe(pipeline).One(&result); err != nil {
+		return nil, err
+	}
+	matched := make(map[string]bool)
+	for field, users := range result {
+		if len(users) != 0 {
+			matched[field] = true
+		}
+	}
+	return matched, nil
+}
+
+// Runs the given existence checks, keyed by the field each checks, in a
+// single query, returning the error for the first conflict found
+// Conflicts are reported in the order of UniqueFields. A failing query is
+// reported as ErrExistenceCheckFailed rather than as an existing entry.
+func checkConflicts(checks map[string]bson.M) error {
+	if len(checks) == 0 {
+		return nil
+	}
+	var matched map[string]bool
+	conflictQuery := func(col *mgo.Collection) error {
+		var err error
+		matched, err = matchConflicts(col, checks)
+		return err
+	}
+
+	if err := db.ExecWithCol(CollectionName, conflictQuery); err != nil {
+		return ErrExistenceCheckFailed
+	}
+	for _, field := range UniqueFields {
+		if matched[field] {
+			return duplicateFieldError(field)
+		}
+	}
+	for field := range matched {
+		return duplicateFieldError(field)
+	}
+	return nil
+}
+
+// Adds the bookkeeping made by every update of stored users to the given
+// update document, stamping the update time and bumping the version
+func touched(update bson.M, now time.Time) bson.M {
+	set, ok := update["$set"].(bson.M)
+	if !ok {
+		set = bson.M{}
+		update["$set"] = set
+	}
+	set["updated"] = now
+
+	inc, ok := update["$inc"].(bson.M)
+	if !ok {
+		inc = bson.M{}
+		update["$inc"] = inc
+	}
+	inc["version"] = 1
+	return update
+}
+
+// Checks that the required fields of a user object are set
+// Returns an InvalidFieldsError listing the empty fields otherwise
+func checkRequiredFields(user *User) error {
+	if emptyFields := checkEmptyFields(user); len(emptyFields) != 0 {
+		invalid := strings.Join(emptyFields, " ")
+		return &web.InvalidFieldsError{
+			web.GeneralError{"The following fields cannot be empty: " + invalid},
+			emptyFields,
+		}
+	}
+	return nil
 }
 
 // Checks whether the required fields of a user object are set
@@ -156,12 +566,31 @@ func checkEmptyFields(user *User) []string {
 // Searchs the DB for a user matching the given query
 // returns the found user and nil if a matching user is found,
 // otherwise an empty user struct and an error is returned
+// A CorruptRecordError is returned if the stored document doesn't match the User struct
+// Soft deleted users are never matched
 func findMatchingUser(query bson.M) (User, error) {
+	return findMatchingUserContext(context.Background(), query)
+}
+
+// Searches the DB for a user matching the given query like findMatchingUser,
+// abandoning the query once the given context is done
+func findMatchingUserContext(ctx context.Context, query bson.M) (User, error) {
 	result := User{}
 	searchQuery := func(col *mgo.Collection) error {
-		return col.Find(query).One(&result)
+		var raw bson.Raw
+		if err := col.Find(liveQuery(query)).One(&raw); err != nil {
+			return err
+		}
+		if err := decodeUser(raw, &result); err != nil {
+			return err
+		}
+		result.normalizeOnLoad()
+		return nil
 	}
 
-	err := db.ExecWithCol(CollectionName, searchQuery)
-	return result, err
+	err := db.ExecWithColContext(ctx, CollectionName, searchQuery)
+	if err != nil {
+		return User{}, err
+	}
+	return result, nil
 }
@@ -31,11 +31,7 @@ func createUser(resp http.ResponseWriter, req *http.Request, sessions *sessions.
 
 	phonenumber, err := parsePhonenumber(req.FormValue("Phonenumber"))
 	if err != nil {
-		errorMsg := &web.InvalidFieldsError{
-			web.GeneralError{"The given phonenumber is invalid"},
-			[]string{"Phonenumber"},
-		}
-		web.SendErrorResponse(resp, errorMsg, http.StatusBadRequest)
+		web.SendErrorResponse(resp, err, http.StatusBadRequest)
 		return
 	}
 	newUser.Phonenumber = phonenumber
@@ -52,7 +48,13 @@ func createUser(resp http.ResponseWriter, req *http.Request, sessions *sessions.
 	}
 
 	// Attempt to save, and send an error response if an error encountered
-	if err = newUser.Save(); err != nil {
+	// Failing hooks don't fail the signup, as the user is stored regardless
+	err = newUser.Save()
+	if hookErr, ok := err.(*HookError); ok {
+		fmt.Printf("Hooks failed for created user %s: %s\n", newUser.Username, hookErr.Error())
+		err = nil
+	}
+	if err != nil {
 		web.SendErrorResponse(resp, err, http.StatusBadRequest)
 	} else {
 		web.SendSuccessResponse(resp, "User successfully created")
@@ -65,7 +67,6 @@ func createUser(resp http.ResponseWriter, req *http.Request, sessions *sessions.
 
 // Takes the given phone number and converts it into a standardized form
 // Returns an error is the given number cannot be correctly converted
-// TODO: Figure this out lol
 func parsePhonenumber(phonenumber string) (string, error) {
-	return phonenumber, nil
+	return NormalizePhonenumber(phonenumber)
 }
@@ -3,15 +3,18 @@
 package users
 
 import (
+	"errors"
 	"os"
 	"reflect"
 	"testing"
+	"time"
 
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 
 	"github.com/njdup/func/db"
 	"github.com/njdup/func/settings"
+	"github.com/njdup/func/utils/web"
 )
 
 // TODO: Add more test users, including malformed users
@@ -37,6 +40,9 @@ func TestMain(m *testing.M) {
 
 func removeUser(user User) error {
 	return db.ExecWithCol(CollectionName, func(col *mgo.Collection) error {
+		if user.Id != "" {
+			return col.RemoveId(user.Id)
+		}
 		return col.Remove(bson.M{"userName": user.Username, "phoneNumber": user.Phonenumber})
 	})
 }
@@ -136,3 +142,329 @@ func TestFindingUsers(t *testing.T) {
 		removeUser(user)
 	}
 }
+
+// Ensures a failing uniqueness check is reported as such, not as a duplicate
+func TestExistenceCheckFailure(t *testing.T) {
+	realMatch := matchConflicts
+	defer func() { matchConflicts = realMatch }()
+	matchConflicts = func(col *mgo.Collection, checks map[string]bson.M) (map[string]bool, error) {
+		return nil, errors.New("simulated database failure")
+	}
+
+	user := User{Username: "existenceCheckUser", Phonenumber: "+15550002001"}
+	if err := user.Save(); err != ErrExistenceCheckFailed {
+		removeUser(user)
+		t.Error("Expected existence check failure, got: ", err)
+	}
+}
+
+// Ensures a single query detects username and phone conflicts, alone or together
+func TestCombinedExistenceCheck(t *testing.T) {
+	user := validUsers[0]
+	if err := user.Save(); err != nil {
+		t.Fatal("Failed to save user in the db: ", user.ToString())
+	}
+	defer removeUser(user)
+
+	realMatch := matchConflicts
+	defer func() { matchConflicts = realMatch }()
+	var queries int
+	var matched map[string]bool
+	matchConflicts = func(col *mgo.Collection, checks map[string]bson.M) (map[string]bool, error) {
+		queries++
+		var err error
+		matched, err = realMatch(col, checks)
+		return matched, err
+	}
+
+	cases := []struct {
+		user     User
+		conflict string
+		matched  []string
+	}{
+		{User{Username: user.Username, Phonenumber: "+15550002101"}, "Username", []string{"Username"}},
+		{User{Username: "combinedCheckUser", Phonenumber: user.Phonenumber}, "Phonenumber", []string{"Phonenumber"}},
+		{User{Username: user.Username, Phonenumber: user.Phonenumber}, "Username", []string{"Username", "Phonenumber"}},
+	}
+	for _, c := range cases {
+		queries = 0
+		err := c.user.Save()
+		if fieldsErr, ok := err.(*web.InvalidFieldsError); !ok || fieldsErr.Fields[0] != c.conflict {
+			removeUser(c.user)
+			t.Errorf("Expected a %s conflict for %s, got: %v", c.conflict, c.user.ToString(), err)
+		}
+		if queries != 1 {
+			t.Errorf("Expected a single existence query, got %d", queries)
+		}
+		if len(matched) != len(c.matched) {
+			t.Errorf("Expected conflicts on %v, got %v", c.matched, matched)
+		}
+		for _, field := range c.matched {
+			if !matched[field] {
+				t.Errorf("Expected conflicts on %v, got %v", c.matched, matched)
+			}
+		}
+	}
+}
+
+// Ensures the cache key is stable until the stored user changes
+func TestCacheKey(t *testing.T) {
+	if key := (&User{Username: "unsaved"}).CacheKey(); key != "" {
+		t.Error("Unsaved user has a cache key: ", key)
+	}
+
+	user := User{Username: "cacheKeyUser", Phonenumber: "+15550007001"}
+	if err := user.Save(); err != nil {
+		t.Fatal("Failed to save user in the db: ", user.ToString())
+	}
+	defer removeUser(user)
+
+	key := user.CacheKey()
+	found, err := FindByID(user.Id.Hex())
+	if err != nil {
+		t.Fatal("Error encountered querying for user ", user.ToString())
+	}
+	if found.CacheKey() != key {
+		t.Errorf("Cache key changed without an update: %s != %s", found.CacheKey(), key)
+	}
+
+	if err := found.LinkIdentity("github", "cache-key"); err != nil {
+		t.Fatal("Error encountered updating user: ", err)
+	}
+	if found.CacheKey() == key {
+		t.Error("Cache key didn't change after an update")
+	}
+	updated, _ := FindByID(user.Id.Hex())
+	if updated.CacheKey() != found.CacheKey() {
+		t.Errorf("Stored cache key %s doesn't match updated user %s", updated.CacheKey(), found.CacheKey())
+	}
+}
+
+// Ensures users sharing a name are grouped regardless of case
+func TestUsersWithSameName(t *testing.T) {
+	sameName := []User{
+		{Username: "smith1", Firstname: "John", Lastname: "Smith", Phonenumber: "+15550013001"},
+		{Username: "smith2", Firstname: "john", Lastname: "SMITH", Phonenumber: "+15550013002"},
+	}
+	others := []User{
+		{Username: "smith3", Firstname: "Johnny", Lastname: "Smith", Phonenumber: "+15550013003"},
+		{Username: "smith4", Firstname: "John", Lastname: "Smithers", Phonenumber: "+15550013004"},
+		{Username: "smith5", Firstname: "John", Lastname: "Smith", Phonenumber: "+15550013005"},
+	}
+	for i := range sameName {
+		if err := sameName[i].Save(); err != nil {
+			t.Fatal("Failed to save user in the db: ", sameName[i].ToString())
+		}
+		defer removeUser(sameName[i])
+	}
+	for i := range others {
+		if err := others[i].Save(); err != nil {
+			t.Fatal("Failed to save user in the db: ", others[i].ToString())
+		}
+		defer removeUser(others[i])
+	}
+	if err := others[2].SoftDelete(); err != nil {
+		t.Fatal("Error encountered soft deleting user: ", err)
+	}
+
+	found, err := UsersWithSameName("JOHN", "smith")
+	if err != nil {
+		t.Fatal("Error encountered finding users with the same name: ", err)
+	}
+	if len(found) != len(sameName) {
+		t.Errorf("Found %d users named John Smith, expected %d", len(found), len(sameName))
+	}
+	for _, user := range found {
+		if user.Id != sameName[0].Id && user.Id != sameName[1].Id {
+			t.Error("Unexpected user found with the same name: ", user.ToString())
+		}
+	}
+}
+
+// Ensures methods called on a nil user fail gracefully rather than panic
+func TestNilUser(t *testing.T) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatal("Method on nil user panicked: ", r)
+		}
+	}()
+
+	var user *User
+	if user.ToString() == "" {
+		t.Error("Empty string representation for nil user")
+	}
+	if user.PasswordsMatch("password") {
+		t.Error("Password matched for nil user")
+	}
+	if err := user.SetPassword("supersecure"); err != ErrNilUser {
+		t.Error("Expected ErrNilUser setting password, got: ", err)
+	}
+	if err := user.Save(); err != ErrNilUser {
+		t.Error("Expected ErrNilUser saving, got: ", err)
+	}
+	if err := user.Update(); err != ErrUserNotFound {
+		t.Error("Expected ErrUserNotFound updating, got: ", err)
+	}
+	if err := user.SoftDelete(); err != ErrUserNotFound {
+		t.Error("Expected ErrUserNotFound deleting, got: ", err)
+	}
+	if err := user.Erase(); err != ErrUserNotFound {
+		t.Error("Expected ErrUserNotFound erasing, got: ", err)
+	}
+	if err := user.LinkIdentity("github", "1"); err != ErrNilUser {
+		t.Error("Expected ErrNilUser linking identity, got: ", err)
+	}
+	if _, err := user.ExportPersonalData(); err != ErrNilUser {
+		t.Error("Expected ErrNilUser exporting, got: ", err)
+	}
+	if _, err := user.AuditTrail(); err != ErrNilUser {
+		t.Error("Expected ErrNilUser reading audit trail, got: ", err)
+	}
+	if user.CacheKey() != "" || user.IsDeleted() || user.Slug() != fallbackSlug {
+		t.Error("Unexpected zero values for nil user")
+	}
+	if changes := user.Diff(&User{Username: "someone"}); len(changes) != 1 {
+		t.Error("Unexpected diff against nil user: ", changes)
+	}
+}
+
+// Ensures batch conflicts are found under the same rules as Save
+func TestConflictsWith(t *testing.T) {
+	base := &User{Username: "batchUser", Phonenumber: "+15550040001"}
+	cases := []struct {
+		other    *User
+		expected []string
+	}{
+		{&User{Username: "BATCHUSER", Phonenumber: "+15550040002"}, []string{"Username"}},
+		{&User{Username: "otherUser", Phonenumber: "+15550040001"}, []string{"Phonenumber"}},
+		{&User{Username: "batchUser", Phonenumber: "+15550040001"}, []string{"Username", "Phonenumber"}},
+		{&User{TenantID: "acme", Username: "batchUser", Phonenumber: "+15550040003"}, []string{}},
+		{&User{Username: "otherUser", Phonenumber: "+15550040004"}, []string{}},
+		{&User{Username: "otherUser", Phonenumber: "+15550040005", Email: "batch@example.com"}, []string{}},
+		{nil, []string{}},
+	}
+	for _, c := range cases {
+		if conflicts := ConflictsWith(base, c.other); !reflect.DeepEqual(conflicts, c.expected) {
+			t.Errorf("Expected conflicts %v with %s, got %v", c.expected, c.other.ToString(), conflicts)
+		}
+	}
+
+	withEmail := &User{Username: "emailUser", Phonenumber: "+15550040006", Email: " Batch@Example.com"}
+	if conflicts := ConflictsWith(&User{Email: "batch@example.com"}, withEmail); !reflect.DeepEqual(conflicts, []string{"Email"}) {
+		t.Error("Expected an email conflict, got: ", conflicts)
+	}
+
+	// Hashed phonenumbers are normalized, so formatting doesn't hide a conflict
+	defer func(privacy PhonePrivacyConfig) { PhonePrivacy = privacy }(PhonePrivacy)
+	PhonePrivacy = PhonePrivacyConfig{Enabled: true, Key: []byte("test key")}
+	formatted := &User{Username: "otherUser", Phonenumber: "(555) 004-0001"}
+	if conflicts := ConflictsWith(base, formatted); !reflect.DeepEqual(conflicts, []string{"Phonenumber"}) {
+		t.Error("Expected a phonenumber conflict with a reformatted number, got: ", conflicts)
+	}
+}
+
+// Ensures mutating a clone leaves the original untouched
+func TestClone(t *testing.T) {
+	original := &User{
+		Username:           "cloned",
+		Roles:              []string{"member"},
+		Programs:           []bson.ObjectId{bson.NewObjectId()},
+		ExternalIdentities: []ExternalIdentity{{Provider: "github", Subject: "1"}},
+		Metadata:           map[string]string{"beta": "on"},
+	}
+	clone := original.Clone()
+	if !reflect.DeepEqual(clone, original) {
+		t.Fatal("Clone differs from the original: ", clone.ToString())
+	}
+
+	clone.Username = "changed"
+	clone.Roles[0] = "admin"
+	clone.Roles = append(clone.Roles, "staff")
+	clone.Programs[0] = bson.NewObjectId()
+	clone.Programs = append(clone.Programs, bson.NewObjectId())
+	clone.ExternalIdentities[0].Subject = "2"
+	clone.Metadata["beta"] = "off"
+
+	if original.Username != "cloned" || len(original.Programs) != 1 || len(original.Roles) != 1 {
+		t.Error("Original changed along with its clone: ", original.ToString())
+	}
+	if original.Roles[0] != "member" || original.Programs[0] == clone.Programs[0] || original.ExternalIdentities[0].Subject != "1" {
+		t.Error("Original shares slices with its clone")
+	}
+	if original.Metadata["beta"] != "on" {
+		t.Error("Original shares metadata with its clone")
+	}
+	if (*User)(nil).Clone() != nil {
+		t.Error("Cloning a nil user should return nil")
+	}
+}
+
+func TestResolveUsernames(t *testing.T) {
+	alice := User{Username: "resolveAlice", Phonenumber: "+15550070001"}
+	bob := User{Username: "resolveBob", Phonenumber: "+15550070002"}
+	for _, user := range []*User{&alice, &bob} {
+		if err := user.Save(); err != nil {
+			t.Fatal("Failed to save user in the db: ", user.ToString())
+		}
+		defer removeUser(*user)
+	}
+
+	names := []string{"resolveAlice", "RESOLVEBOB", "resolveNobody"}
+	resolved, err := ResolveUsernames(names)
+	if err != nil {
+		t.Fatal("Error encountered resolving usernames: ", err)
+	}
+	expected := map[string]bson.ObjectId{"resolveAlice": alice.Id, "RESOLVEBOB": bob.Id}
+	if !reflect.DeepEqual(resolved, expected) {
+		t.Error("Unexpected resolved usernames: ", resolved)
+	}
+	if missing := UnresolvedUsernames(names, resolved); !reflect.DeepEqual(missing, []string{"resolveNobody"}) {
+		t.Error("Unexpected unresolved usernames: ", missing)
+	}
+}
+
+func TestOlderThan(t *testing.T) {
+	minimumAge := 24 * time.Hour
+	fresh := User{Inserted: time.Now().Add(-time.Minute)}
+	if fresh.OlderThan(minimumAge) {
+		t.Error("Fresh account reported as older than the minimum age")
+	}
+	old := User{Inserted: time.Now().Add(-2 * minimumAge)}
+	if !old.OlderThan(minimumAge) {
+		t.Error("Old account not reported as older than the minimum age")
+	}
+	unsaved := User{}
+	if unsaved.OlderThan(0) || (*User)(nil).OlderThan(0) {
+		t.Error("Account without an insert time reported as old")
+	}
+}
+
+func TestSaveIf(t *testing.T) {
+	noAdmin := func(col *mgo.Collection) (bool, error) {
+		count, err := col.Find(liveQuery(bson.M{"roles": "bootstrapAdmin"})).Count()
+		return count == 0, err
+	}
+
+	first := User{Username: "firstAdmin", Phonenumber: "+15550360001", Roles: []string{"bootstrapAdmin"}}
+	if err := first.SaveIf(noAdmin); err != nil {
+		t.Fatal("Expected the first admin to be saved, got: ", err)
+	}
+	defer removeUser(first)
+
+	second := User{Username: "secondAdmin", Phonenumber: "+15550360002", Roles: []string{"bootstrapAdmin"}}
+	if err := second.SaveIf(noAdmin); err != ErrConditionFailed {
+		removeUser(second)
+		t.Fatal("Expected ErrConditionFailed once an admin exists, got: ", err)
+	}
+	if second.Id != "" {
+		t.Error("Expected the blocked user not to be assigned an id")
+	}
+	if _, err := FindWithUsername(second.Username); err == nil {
+		t.Error("Expected the blocked user not to be stored")
+	}
+
+	failing := errors.New("condition query failed")
+	if err := second.SaveIf(func(*mgo.Collection) (bool, error) { return true, failing }); err != failing {
+		t.Error("Expected the condition's error, got: ", err)
+	}
+}
@@ -0,0 +1,214 @@
+// Validation of user supplied fields beyond the required field checks
+//
+// Users are validated on two paths. validateForCreate runs once, when Save
+// first stores a user, and applies every rule: required fields, the username
+// rules (ValidateUsername and checkPlaceholderFields), the email format,
+// SignupPolicy, the birthdate and MinimumSignupAge, and the metadata limits. validateForUpdate runs on every
+// Update, checking required fields but applying the other rules to changed
+// fields only, so values stored before a rule was tightened (such as a
+// legacy username that is now reserved) don't block unrelated edits.
+
+package users
+
+import (
+	"strings"
+	"time"
+	"unicode"
+)
+
+// UsernameSet is a case-insensitive set of usernames
+type UsernameSet map[string]bool
+
+// Returns a UsernameSet holding the given names
+func NewUsernameSet(names ...string) UsernameSet {
+	set := make(UsernameSet)
+	set.Add(names...)
+	return set
+}
+
+// Adds the given names to the set
+func (set UsernameSet) Add(names ...string) {
+	for _, name := range names {
+		set[strings.ToLower(name)] = true
+	}
+}
+
+// Removes the given names from the set
+func (set UsernameSet) Remove(names ...string) {
+	for _, name := range names {
+		delete(set, strings.ToLower(name))
+	}
+}
+
+// Checks whether the set holds the given name, ignoring case
+func (set UsernameSet) Contains(name string) bool {
+	return set[strings.ToLower(name)]
+}
+
+var (
+	// Usernames that can't be claimed by users signing up
+	// Add to or replace the set to configure it for a deployment
+	ReservedUsernames = NewUsernameSet(
+		"admin", "administrator", "root", "support", "api", "help",
+		"system", "staff", "func", "login", "logout", "signup", "users",
+	)
+
+	// Rejects signups whose username is their phonenumber or a placeholder
+	// when set, see checkPlaceholderFields
+	RejectPlaceholderSignups = true
+	// Usernames rejected as obvious placeholder junk, kept to names nobody
+	// would choose on purpose to avoid false positives
+	// Add to or replace the set to configure it for a deployment
+	PlaceholderUsernames = NewUsernameSet(
+		"asdf", "asdfasdf", "qwerty", "test", "test123", "testuser", "username", "placeholder",
+	)
+)
+
+// Restricts who may sign up, see SignupPolicy
+// Each list is optional, and empty lists allow everyone.
+type SignupPolicyConfig struct {
+	// Email domains users must sign up with, such as "example.com"
+	// Users without an email address can't sign up when set.
+	AllowedEmailDomains []string
+	// Phonenumber prefixes users can't sign up with, such as "+44"
+	DeniedPhonePrefixes []string
+}
+
+// The restrictions checked when new users are saved
+var SignupPolicy = SignupPolicyConfig{}
+
+// Checks whether the given username may be claimed by a user
+// Returns ErrReservedUsername if the name is reserved
+func ValidateUsername(username string) error {
+	if ReservedUsernames.Contains(username) {
+		return ErrReservedUsername
+	}
+	return nil
+}
+
+/*
+ * Helper Functions
+ */
+
+// Checks that a new user may be stored, see the validation paths above
+// The email address, phonenumber and names are normalized first, see
+// normalizeForWrite
+func validateForCreate(user *User) error {
+	if err := checkRequiredFields(user); err != nil {
+		return err
+	}
+	if err := ValidateUsername(user.Username); err != nil {
+		return err
+	}
+	if err := checkPlaceholderFields(user); err != nil {
+		return err
+	}
+	if err := normalizeForWrite(user); err != nil {
+		return err
+	}
+	if err := checkSignupPolicy(user); err != nil {
+		return err
+	}
+	if err := checkBirthdate(user, time.Now()); err != nil {
+		return err
+	}
+	return validateMetadata(user.Metadata)
+}
+
+// Checks that the given changes to a stored user may be written, see the
+// validation paths above
+// The user must have been normalized with normalizeForWrite before its
+// changes were computed.
+func validateForUpdate(user *User, changes map[string]fieldChange) error {
+	if err := checkRequiredFields(user); err != nil {
+		return err
+	}
+	if _, ok := changes["Username"]; ok {
+		if err := ValidateUsername(user.Username); err != nil {
+			return err
+		}
+		if err := checkPlaceholderFields(user); err != nil {
+			return err
+		}
+	}
+	if _, ok := changes["Metadata"]; ok {
+		return validateMetadata(user.Metadata)
+	}
+	return nil
+}
+
+// Normalizes the email address, phonenumber and names of a user about to be
+// written
+// Returns ErrInvalidEmail if the email address can't be normalized
+func normalizeForWrite(user *User) error {
+	if err := normalizeUserEmail(user); err != nil {
+		return err
+	}
+	normalizeUserPhone(user)
+	normalizeUserNames(user)
+	return nil
+}
+
+// Checks that the user may sign up under SignupPolicy
+// Returns ErrSignupNotAllowed if the user's email domain isn't allowed or
+// their phonenumber has a denied prefix
+func checkSignupPolicy(user *User) error {
+	if domains := SignupPolicy.AllowedEmailDomains; len(domains) != 0 {
+		at := strings.LastIndex(user.Email, "@")
+		if at < 0 || !containsFold(domains, user.Email[at+1:]) {
+			return ErrSignupNotAllowed
+		}
+	}
+
+	phonenumber := user.Phonenumber
+	if normalized, err := NormalizePhonenumber(phonenumber); err == nil {
+		phonenumber = normalized
+	}
+	for _, prefix := range SignupPolicy.DeniedPhonePrefixes {
+		if strings.HasPrefix(phonenumber, prefix) {
+			return ErrSignupNotAllowed
+		}
+	}
+	return nil
+}
+
+// Checks whether the list holds the given value, ignoring case
+func containsFold(list []string, value string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks that the user's required fields aren't trivially related or
+// obvious placeholders, when RejectPlaceholderSignups is set
+// Returns ErrUsernameIsPhonenumber if the username is the phonenumber, in any
+// formatting, or ErrPlaceholderUsername if it is in PlaceholderUsernames
+func checkPlaceholderFields(user *User) error {
+	if !RejectPlaceholderSignups {
+		return nil
+	}
+	if PlaceholderUsernames.Contains(user.Username) {
+		return ErrPlaceholderUsername
+	}
+	if user.Username == user.Phonenumber || samePhonenumber(user.Username, user.Phonenumber) {
+		return ErrUsernameIsPhonenumber
+	}
+	return nil
+}
+
+// Checks whether the given username is a formatting of the phonenumber
+// Usernames holding letters are never considered phonenumbers
+func samePhonenumber(username, phonenumber string) bool {
+	if strings.IndexFunc(username, unicode.IsLetter) >= 0 {
+		return false
+	}
+	normalizedUsername, err := NormalizePhonenumber(username)
+	if err != nil {
+		return false
+	}
+	normalizedPhonenumber, err := NormalizePhonenumber(phonenumber)
+	return err == nil && normalizedUsername == normalizedPhonenumber
+}
@@ -0,0 +1,133 @@
+// Tests for validation of user supplied fields
+
+package users
+
+import (
+	"testing"
+)
+
+func TestReservedUsernames(t *testing.T) {
+	for _, username := range []string{"admin", "Admin", "ROOT", "sUpPoRt"} {
+		user := User{Username: username, Phonenumber: "+15550005001"}
+		if err := user.Save(); err != ErrReservedUsername {
+			removeUser(user)
+			t.Errorf("Expected reserved username %q to be rejected, got: %v", username, err)
+		}
+	}
+
+	ReservedUsernames.Add("Reserved-For-Test")
+	defer ReservedUsernames.Remove("reserved-for-test")
+	if err := ValidateUsername("reserved-for-TEST"); err != ErrReservedUsername {
+		t.Error("Configured reserved username wasn't rejected, got: ", err)
+	}
+
+	if err := ValidateUsername("regularUser"); err != nil {
+		t.Error("Unreserved username was rejected: ", err)
+	}
+}
+
+func TestPlaceholderSignups(t *testing.T) {
+	for _, username := range []string{"+15550005101", "5550005101", "(555) 000-5101"} {
+		user := User{Username: username, Phonenumber: "+15550005101"}
+		if err := checkPlaceholderFields(&user); err != ErrUsernameIsPhonenumber {
+			t.Errorf("Expected username %q to be rejected as the phonenumber, got: %v", username, err)
+		}
+	}
+	for _, username := range []string{"ASDF", "test"} {
+		user := User{Username: username, Phonenumber: "+15550005101"}
+		if err := user.Save(); err != ErrPlaceholderUsername {
+			removeUser(user)
+			t.Errorf("Expected placeholder username %q to be rejected, got: %v", username, err)
+		}
+	}
+
+	PlaceholderUsernames.Add("Lorem")
+	defer PlaceholderUsernames.Remove("lorem")
+	user := User{Username: "lorem", Phonenumber: "+15550005101"}
+	if err := checkPlaceholderFields(&user); err != ErrPlaceholderUsername {
+		t.Error("Configured placeholder username wasn't rejected, got: ", err)
+	}
+
+	// Related but distinct values are left alone
+	for _, username := range []string{"tester", "5550005102", "alice5550005101"} {
+		user := User{Username: username, Phonenumber: "+15550005101"}
+		if err := checkPlaceholderFields(&user); err != nil {
+			t.Errorf("Username %q was rejected: %v", username, err)
+		}
+	}
+
+	defer func(enabled bool) { RejectPlaceholderSignups = enabled }(RejectPlaceholderSignups)
+	RejectPlaceholderSignups = false
+	user = User{Username: "asdf", Phonenumber: "+15550005101"}
+	if err := checkPlaceholderFields(&user); err != nil {
+		t.Error("Placeholder username rejected with the check disabled: ", err)
+	}
+}
+
+func TestSignupPolicy(t *testing.T) {
+	defer func(policy SignupPolicyConfig) { SignupPolicy = policy }(SignupPolicy)
+
+	user := User{Username: "policyUser", Phonenumber: "+445550005201", Email: "policy@example.com"}
+	if err := checkSignupPolicy(&user); err != nil {
+		t.Error("Signup rejected without a policy: ", err)
+	}
+
+	SignupPolicy = SignupPolicyConfig{AllowedEmailDomains: []string{"Example.com", "example.org"}}
+	if err := checkSignupPolicy(&user); err != nil {
+		t.Error("Signup with an allowed domain was rejected: ", err)
+	}
+	for _, email := range []string{"policy@other.com", "policy@mail.example.com", ""} {
+		user.Email = email
+		if err := checkSignupPolicy(&user); err != ErrSignupNotAllowed {
+			t.Errorf("Expected signup with email %q to be rejected, got: %v", email, err)
+		}
+	}
+	user.Email = "policy@example.com"
+
+	SignupPolicy.DeniedPhonePrefixes = []string{"+44", "+1900"}
+	if err := checkSignupPolicy(&user); err != ErrSignupNotAllowed {
+		t.Error("Expected signup with a denied phone prefix to be rejected, got: ", err)
+	}
+	user.Phonenumber = "(900) 555-0052" // Normalized to +1900...
+	if err := checkSignupPolicy(&user); err != ErrSignupNotAllowed {
+		t.Error("Expected formatted number with a denied prefix to be rejected, got: ", err)
+	}
+	user.Phonenumber = "+15550005201"
+	if err := checkSignupPolicy(&user); err != nil {
+		t.Error("Signup with an allowed phone prefix was rejected: ", err)
+	}
+
+	user.Username = "policyRejected"
+	user.Email = "policy@other.com"
+	if err := user.Save(); err != ErrSignupNotAllowed {
+		removeUser(user)
+		t.Error("Expected Save to enforce the signup policy, got: ", err)
+	}
+}
+
+// Ensures usernames that predate stricter rules don't block other edits
+func TestLegacyUsernameUpdate(t *testing.T) {
+	user := User{Username: "legacyName", Phonenumber: "+15550160001"}
+	if err := user.Save(); err != nil {
+		t.Fatal("Failed to save user in the db: ", user.ToString())
+	}
+	defer removeUser(user)
+
+	// Tighten the rules after the user chose their username
+	ReservedUsernames.Add("legacyName", "otherLegacyName")
+	defer ReservedUsernames.Remove("legacyName", "otherLegacyName")
+
+	user.Phonenumber = "+15550160002"
+	if err := user.Update(); err != nil {
+		t.Fatal("Expected legacy username to allow phone updates, got: ", err)
+	}
+	stored, err := FindByID(user.Id.Hex())
+	if err != nil || stored.Phonenumber != "+15550160002" {
+		t.Error("Phone update wasn't stored: ", stored.ToString(), err)
+	}
+
+	stored.Username = "otherLegacyName"
+	if err := stored.Update(); err != ErrReservedUsername {
+		t.Error("Expected changed username to be validated, got: ", err)
+	}
+}
@@ -0,0 +1,90 @@
+// Defines the argon2id password hash format, an alternative to bcrypt
+
+package security
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Prefix of argon2id hashes, in the PHC string format:
+// $argon2id$v=19$m=<memory>,t=<time>,p=<threads>$<salt>$<key>
+const argon2idPrefix = "$argon2id$"
+
+// Parameters of newly generated argon2id hashes
+// Hashes store the parameters they were generated with, so changing them
+// doesn't break verification of existing hashes.
+type Argon2Config struct {
+	Time       uint32 // Number of passes over the memory
+	Memory     uint32 // Memory used, in KiB
+	Threads    uint8
+	SaltLength uint32 // In bytes
+	KeyLength  uint32 // In bytes
+}
+
+// The parameters of newly generated argon2id hashes, following the
+// recommendations of RFC 9106
+var Argon2Params = Argon2Config{Time: 1, Memory: 64 * 1024, Threads: 4, SaltLength: 16, KeyLength: 32}
+
+// Largest memory, in KiB, a stored argon2id hash may ask to be verified
+// with, so a tampered hash can't exhaust the memory of the server
+var MaxArgon2Memory uint32 = 1024 * 1024
+
+/*
+ * Helper Functions
+ */
+
+// Returns the argon2id hash of the given password, with a random salt
+func hashArgon2id(password string) (string, error) {
+	params := Argon2Params
+	salt := make([]byte, params.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, params.KeyLength)
+
+	return fmt.Sprintf(
+		"%sv=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2idPrefix, argon2.Version, params.Memory, params.Time, params.Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// Checks whether the given password matches the argon2id hash
+// Malformed hashes never match, including hashes with parameters argon2
+// can't run with or with memory beyond MaxArgon2Memory
+func confirmArgon2id(passwordHash, password string) bool {
+	parts := strings.Split(strings.TrimPrefix(passwordHash, argon2idPrefix), "$")
+	if len(parts) != 4 {
+		return false
+	}
+
+	var version int
+	var params Argon2Config
+	if _, err := fmt.Sscanf(parts[0], "v=%d", &version); err != nil || version != argon2.Version {
+		return false
+	}
+	if _, err := fmt.Sscanf(parts[1], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &params.Threads); err != nil {
+		return false
+	}
+	if params.Time < 1 || params.Threads < 1 || params.Memory > MaxArgon2Memory {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	expected, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil || len(expected) == 0 {
+		return false
+	}
+
+	key := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, uint32(len(expected)))
+	return subtle.ConstantTimeCompare(key, expected) == 1
+}
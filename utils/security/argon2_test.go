@@ -0,0 +1,67 @@
+// Tests for the argon2id password hash format
+
+package security
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPasswordAlgorithms(t *testing.T) {
+	defer func(algorithm string) { PasswordAlgorithm = algorithm }(PasswordAlgorithm)
+
+	PasswordAlgorithm = AlgorithmBcrypt
+	bcryptHash, err := HashPassword("supersecure")
+	if err != nil {
+		t.Fatal("Error encountered hashing password: ", err)
+	}
+	if HashAlgorithm(bcryptHash) != AlgorithmBcrypt || NeedsUpgrade(bcryptHash) {
+		t.Error("Unexpected algorithm for bcrypt hash: ", HashAlgorithm(bcryptHash))
+	}
+
+	PasswordAlgorithm = AlgorithmArgon2id
+	argonHash, err := HashPassword("supersecure")
+	if err != nil {
+		t.Fatal("Error encountered hashing password: ", err)
+	}
+	if !strings.HasPrefix(argonHash, "$argon2id$v=19$m=65536,t=1,p=4$") {
+		t.Error("Unexpected argon2id hash format: ", argonHash)
+	}
+	if again, _ := HashPassword("supersecure"); again == argonHash {
+		t.Error("Argon2id hashes aren't salted")
+	}
+
+	// Hashes of either algorithm verify whichever is configured
+	for _, algorithm := range []string{AlgorithmBcrypt, AlgorithmArgon2id} {
+		PasswordAlgorithm = algorithm
+		for _, hash := range []string{bcryptHash, argonHash} {
+			if !ConfirmPassword(hash, "supersecure") {
+				t.Errorf("Hash %s doesn't verify with %s configured", hash, algorithm)
+			}
+			if ConfirmPassword(hash, "wrongpassword") {
+				t.Errorf("Hash %s matched the wrong password", hash)
+			}
+		}
+	}
+
+	PasswordAlgorithm = AlgorithmArgon2id
+	if !NeedsUpgrade(bcryptHash) || NeedsUpgrade(argonHash) {
+		t.Error("Only hashes of another algorithm should need upgrading")
+	}
+	if _, err := HashCost(argonHash); err == nil {
+		t.Error("Expected no bcrypt cost for an argon2id hash")
+	}
+
+	for _, malformed := range []string{
+		"$argon2id$",
+		"$argon2id$v=19$m=1,t=1,p=1$salt",
+		"$argon2id$v=18$m=1,t=1,p=1$c2FsdA$a2V5",
+		"$argon2id$v=19$m=65536,t=0,p=4$c2FsdA$a2V5",
+		"$argon2id$v=19$m=65536,t=1,p=0$c2FsdA$a2V5",
+		"$argon2id$v=19$m=4294967295,t=1,p=4$c2FsdA$a2V5",
+	} {
+		if ConfirmPassword(malformed, "supersecure") {
+			t.Error("Malformed hash matched: ", malformed)
+		}
+	}
+}
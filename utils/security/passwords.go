@@ -3,6 +3,11 @@
 package security
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -30,8 +35,29 @@ var (
 			meetsMinLength,
 		},
 	}
+
+	// Server-side secret mixed into passwords before hashing, disabled when empty
+	// Keep it outside the database, so a database leak alone isn't enough
+	// to crack the stored hashes
+	PasswordPepper []byte
+
+	// Algorithm of newly generated password hashes, AlgorithmBcrypt or
+	// AlgorithmArgon2id
+	// Hashes of either algorithm verify whichever is configured, so
+	// deployments can migrate between them, see NeedsUpgrade.
+	PasswordAlgorithm = AlgorithmBcrypt
+)
+
+// Password hashing algorithms, see PasswordAlgorithm
+const (
+	AlgorithmBcrypt   = "bcrypt"
+	AlgorithmArgon2id = "argon2id"
 )
 
+// Marks hashes of peppered passwords, so hashes stored before a pepper was
+// configured keep verifying
+const pepperedPrefix = "peppered:"
+
 /*
  * Password Validation Functions
  */
@@ -44,20 +70,99 @@ func meetsMinLength(password string) bool {
  * Functions for securely handling/storing passwords
  */
 
-// Returns a cryptographically secure hash of the given password
+// Returns a cryptographically secure hash of the given password, using the
+// configured PasswordAlgorithm
+// The password is peppered first when PasswordPepper is configured
 func HashPassword(password string) (string, error) {
+	prefix := ""
+	if len(PasswordPepper) != 0 {
+		password, prefix = pepper(password), pepperedPrefix
+	}
+
+	if PasswordAlgorithm == AlgorithmArgon2id {
+		hash, err := hashArgon2id(password)
+		if err != nil {
+			return "", err
+		}
+		return prefix + hash, nil
+	}
+
 	passwordBytes := []byte(password)
 	hash, err := bcrypt.GenerateFromPassword(passwordBytes, bcrypt.DefaultCost)
 	if err != nil {
 		return "", err // TODO: Better error handling
 	}
-	return string(hash[:]), nil
+	return prefix + string(hash[:]), nil
 }
 
 // Confirms whether the given password matches the expected password
 // for the user
+// The hash is verified with the algorithm it was generated with, whatever
+// the configured PasswordAlgorithm
+// Peppered hashes never match while no pepper is configured
 func ConfirmPassword(passwordHash string, password string) bool {
+	if strings.HasPrefix(passwordHash, pepperedPrefix) {
+		if len(PasswordPepper) == 0 {
+			return false
+		}
+		passwordHash, password = strings.TrimPrefix(passwordHash, pepperedPrefix), pepper(password)
+	}
+	if strings.HasPrefix(passwordHash, argon2idPrefix) {
+		return confirmArgon2id(passwordHash, password)
+	}
+
 	passwordBytes := []byte(password)
 	storedHash := []byte(passwordHash)
 	return bcrypt.CompareHashAndPassword(storedHash, passwordBytes) == nil
 }
+
+// Checks whether the given hash predates the configured pepper, and should
+// be replaced by rehashing the password on the user's next successful login
+func NeedsPepper(passwordHash string) bool {
+	return len(PasswordPepper) != 0 && !strings.HasPrefix(passwordHash, pepperedPrefix)
+}
+
+// Returns the algorithm the given hash was generated with, or "" if unknown
+func HashAlgorithm(passwordHash string) string {
+	passwordHash = strings.TrimPrefix(passwordHash, pepperedPrefix)
+	switch {
+	case strings.HasPrefix(passwordHash, argon2idPrefix):
+		return AlgorithmArgon2id
+	case strings.HasPrefix(passwordHash, "$2"): // $2a$, $2b$ or $2y$
+		return AlgorithmBcrypt
+	}
+	return ""
+}
+
+// Checks whether the given hash should be replaced by rehashing the password
+// on the user's next successful login, as it predates the configured pepper
+// or uses another algorithm than PasswordAlgorithm
+func NeedsUpgrade(passwordHash string) bool {
+	return NeedsPepper(passwordHash) || HashAlgorithm(passwordHash) != PasswordAlgorithm
+}
+
+// Returns the bcrypt cost the given hash was generated with
+// The cost is read from the hash prefix, so no plaintext is needed
+// Returns an error for hashes generated by other algorithms
+func HashCost(passwordHash string) (int, error) {
+	return bcrypt.Cost([]byte(strings.TrimPrefix(passwordHash, pepperedPrefix)))
+}
+
+// Returns the hex encoded HMAC-SHA256 of the given value under key
+// Used to store values that must be matched but never revealed
+func KeyedHash(key []byte, value string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+/*
+ * Helper Functions
+ */
+
+// Mixes the configured pepper into the given password
+// The hex encoded HMAC is also short enough to never hit bcrypt's 72 byte
+// input limit
+func pepper(password string) string {
+	return KeyedHash(PasswordPepper, password)
+}
@@ -0,0 +1,50 @@
+// Tests for password security utilities
+
+package security
+
+import (
+	"testing"
+)
+
+func TestPepperedPasswords(t *testing.T) {
+	defer func(pepper []byte) { PasswordPepper = pepper }(PasswordPepper)
+
+	PasswordPepper = nil
+	legacyHash, err := HashPassword("supersecure")
+	if err != nil {
+		t.Fatal("Error encountered hashing password: ", err)
+	}
+
+	PasswordPepper = []byte("server-side-secret")
+	hash, err := HashPassword("supersecure")
+	if err != nil {
+		t.Fatal("Error encountered hashing peppered password: ", err)
+	}
+	if !ConfirmPassword(hash, "supersecure") {
+		t.Error("Peppered hash doesn't verify with the pepper")
+	}
+	if ConfirmPassword(hash, "wrongpassword") {
+		t.Error("Peppered hash verified the wrong password")
+	}
+	if NeedsPepper(hash) {
+		t.Error("Peppered hash reported as needing a pepper")
+	}
+
+	// Hashes from before the pepper was configured keep verifying, but are
+	// flagged for an upgrade
+	if !ConfirmPassword(legacyHash, "supersecure") {
+		t.Error("Unpeppered hash doesn't verify once a pepper is configured")
+	}
+	if !NeedsPepper(legacyHash) {
+		t.Error("Unpeppered hash not flagged as needing a pepper")
+	}
+
+	PasswordPepper = []byte("another-secret")
+	if ConfirmPassword(hash, "supersecure") {
+		t.Error("Peppered hash verified with the wrong pepper")
+	}
+	PasswordPepper = nil
+	if ConfirmPassword(hash, "supersecure") {
+		t.Error("Peppered hash verified without a pepper")
+	}
+}
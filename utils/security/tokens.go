@@ -0,0 +1,32 @@
+// Defines utilities for random single-use tokens, such as login links
+
+package security
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+)
+
+// Number of random bytes in tokens returned by NewToken
+const tokenBytes = 32
+
+// Returns a new random token, URL safe so it can be embedded in links
+// Returns an error if the system's random source fails
+func NewToken() (string, error) {
+	buf := make([]byte, tokenBytes)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// Returns the hex encoded SHA-256 of the given token, for storing tokens
+// that must be matched but never revealed
+// Unlike passwords, tokens are random enough that a fast unsalted hash is
+// safe to store.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
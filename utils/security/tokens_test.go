@@ -0,0 +1,21 @@
+// Tests for single-use token utilities
+
+package security
+
+import (
+	"testing"
+)
+
+func TestTokens(t *testing.T) {
+	token, err := NewToken()
+	if err != nil {
+		t.Fatal("Error encountered generating token: ", err)
+	}
+	other, _ := NewToken()
+	if token == other || len(token) < tokenBytes {
+		t.Error("Tokens aren't random: ", token, other)
+	}
+	if HashToken(token) != HashToken(token) || HashToken(token) == HashToken(other) || HashToken(token) == token {
+		t.Error("Unexpected token hashes for ", token, other)
+	}
+}